@@ -1,5 +1,7 @@
 package main
 
+import "strings"
+
 type Record struct {
 	Ts    int64
 	Value float64
@@ -12,6 +14,65 @@ type Datastore interface {
 	Query(name string, form, until int64) ([]Record, error)
 	LatestBefore(name string, ts int64) (Record, error)
 	ListNames(pattern string) ([]string, error)
+	// Delete removes the series matching pattern and returns their names
+	Delete(pattern string) ([]string, error)
+	// Rename renames a series with all of its channels and sketches,
+	// failing if the new series has any
+	Rename(oldSeries, newSeries string) error
+	// Resolution returns the interval between two records in seconds
+	Resolution() int64
+}
+
+// TieredDatastore is implemented by datastores which keep coarser copies
+// of old data. QueryGranularity returns the records in (from, until] best
+// suited for aggregating intervals of gran seconds.
+type TieredDatastore interface {
+	QueryGranularity(name string, from, until, gran int64) ([]Record, error)
+}
+
+// Sketch is a serialized summary of the samples of an interval, like the
+// digest of a timer, which can't be kept as a channel of floats.
+type Sketch struct {
+	Ts   int64
+	Data []byte
+}
+
+// SketchDatastore is implemented by datastores which keep sketches next to
+// the channels of a series. Sketches are not listed by ListNames, but they
+// are deleted and renamed like channels. QuerySketches returns the
+// sketches in (from, until] best suited for aggregating intervals of gran
+// seconds.
+type SketchDatastore interface {
+	InsertSketch(name string, s Sketch) error
+	QuerySketches(name string, from, until, gran int64) ([]Sketch, error)
+}
+
+// SyncDatastore is implemented by datastores which buffer inserts. Sync
+// returns once the records inserted before are durable.
+type SyncDatastore interface {
+	Sync() error
 }
 
 const ErrNoData = Error("No data")
+
+// checkSeriesName checks that name is a metric name followed by canonical
+// tags, if any.
+func checkSeriesName(name string) error {
+	metric, tags := splitSeriesName(name)
+	if CheckMetricName(metric) != nil {
+		return Error("Invalid series name: " + name)
+	}
+	if t, err := ParseTags(tags); err != nil || t != tags || SeriesName(metric, t) != name {
+		return Error("Invalid series name: " + name)
+	}
+	return nil
+}
+
+// seriesOf returns the series of a channel or sketch name, which may be
+// that of a tier.
+func seriesOf(name string) string {
+	if i := strings.LastIndex(name, ":"); i != -1 {
+		return name[:i]
+	}
+	return name
+}
@@ -4,42 +4,65 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"io"
+	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	fsDsISize = 16
-	fsDsDSize = 8
+	fsDsISize        = 16
+	fsDsBlockRecords = 256
+	fsDsRetryDelay   = 100 * time.Millisecond
 )
 
 type FsDatastore struct {
-	Dir      string
-	NoSync   bool
-	mu       sync.Mutex
-	cond     sync.Cond
-	streams  map[string]*fsDsStream
-	names    map[string]int
-	queue    []*fsDsStream
-	running  bool
-	stopping bool
-	quit     chan int
-	wg       sync.WaitGroup
+	Dir       string
+	NoSync    bool
+	Interval  int64
+	Retention []RetentionPolicy
+	mu        sync.Mutex
+	cond      sync.Cond
+	streams   map[string]*fsDsStream
+	names     map[string]int
+	queue     []*fsDsStream
+	running   bool
+	stopping  bool
+	quit      chan int
+	wg        sync.WaitGroup
+	res       int64
+	rquit     chan int
+	rmu       sync.Mutex // held while rolling up, deleting or renaming
+	smu       sync.Mutex // held while writing sketch files
+	wquit     chan int
+	rwg       sync.WaitGroup
+	wal       fsDsWal
+	bmu       sync.Mutex
+	backfills map[string]int64 // earliest record backfilled, by stream
 }
 
 type fsDsStream struct {
+	walSeq int64 // first for 64-bit alignment
 	sync.Mutex
 	ds       *FsDatastore
 	name     string
+	res      int64
 	tail     []fsDsRecord
 	dat, idx *os.File
 	valid    bool
 	lastWr   int64
 	dsize    int64
 	isize    int64
+	sealed   int64
+	open     []fsDsRecord
 }
 
 type fsDsRecord struct {
@@ -49,11 +72,13 @@ type fsDsRecord struct {
 
 type fsDsSnapshot struct {
 	ds       *FsDatastore
+	res      int64
 	tail     []fsDsRecord
 	dat, idx *os.File
 	lastWr   int64
-	dsize    int64
 	isize    int64
+	sealed   int64
+	open     []fsDsRecord
 }
 
 func (ds *FsDatastore) Open() error {
@@ -75,10 +100,22 @@ func (ds *FsDatastore) Open() error {
 	if err := ds.loadNames(); err != nil {
 		return err
 	}
+	if err := ds.checkResolution(); err != nil {
+		return err
+	}
+	if err := ds.checkRetention(); err != nil {
+		return err
+	}
 
 	ds.streams = make(map[string]*fsDsStream)
 	ds.cond.L = &ds.mu
+	if err := ds.replayWal(); err != nil {
+		ds.streams = nil
+		ds.queue = nil
+		return err
+	}
 	if err := ds.loadTails(); err != nil {
+		ds.wal.close()
 		ds.streams = nil
 		ds.queue = nil
 		return err
@@ -86,6 +123,14 @@ func (ds *FsDatastore) Open() error {
 	ds.running = true
 	ds.quit = make(chan int, 1)
 	go ds.write()
+	ds.wquit = make(chan int)
+	ds.rwg.Add(1)
+	go ds.maintainWal()
+	if len(ds.Retention) > 0 {
+		ds.rquit = make(chan int)
+		ds.rwg.Add(1)
+		go ds.retain()
+	}
 	return nil
 }
 
@@ -103,6 +148,12 @@ func (ds *FsDatastore) Close() error {
 	ds.stopping = true
 	ds.cond.Broadcast()
 	ds.mu.Unlock()
+	if ds.rquit != nil {
+		close(ds.rquit)
+	}
+	close(ds.wquit)
+	ds.rwg.Wait()
+	ds.rquit = nil
 	<-ds.quit
 	ds.mu.Lock()
 
@@ -113,11 +164,9 @@ func (ds *FsDatastore) Close() error {
 	}
 	ds.wg.Wait()
 
-	if err := ds.saveTails(); err != nil {
+	// The tails are kept in the WAL
+	if err := ds.wal.close(); err != nil {
 		log.Println("FsDatastore.Close:", err)
-		if err := os.Remove(ds.tailFile()); err != nil {
-			log.Println("FsDatastore.Close:", err)
-		}
 	}
 	ds.running = false
 	ds.streams = nil
@@ -125,17 +174,41 @@ func (ds *FsDatastore) Close() error {
 	return nil
 }
 
+// Insert logs the record to the WAL and adds it to the tail of its stream.
+// The record is durable once Sync returns.
 func (ds *FsDatastore) Insert(name string, r Record) error {
 	st := ds.getStream(name)
-	defer st.Unlock()
-
 	if st == nil {
 		return Error("Datastore not running")
 	}
+	defer st.Unlock()
+
+	seq := ds.wal.current()
+	if err := ds.wal.append(name, r); err != nil {
+		return err
+	}
+	if len(st.tail) == 0 {
+		atomic.StoreInt64(&st.walSeq, seq)
+	}
 	st.tail = append(st.tail, fsDsRecord{Ts: r.Ts, Value: r.Value})
 	return nil
 }
 
+// Sync writes the buffered WAL records and syncs them unless NoSync is
+// set, so that they survive a crash of the process.
+func (ds *FsDatastore) Sync() error {
+	return ds.wal.flush(ds.NoSync)
+}
+
+// Resolution returns the interval between two records in seconds, set by
+// Interval (60 by default).
+func (ds *FsDatastore) Resolution() int64 {
+	if ds.Interval <= 0 {
+		return 60
+	}
+	return ds.Interval
+}
+
 func (ds *FsDatastore) Query(name string, from, until int64) ([]Record, error) {
 	s, err := ds.takeSnapshot(name)
 	if err != nil {
@@ -143,76 +216,29 @@ func (ds *FsDatastore) Query(name string, from, until int64) ([]Record, error) {
 	}
 	defer s.close()
 
-	nEntries := s.isize / fsDsISize
-	if nEntries == 0 {
-		return []Record{}, nil
-	}
-
+	res := s.res
 	if from < 0 {
-		from -= from % 60
-	} else if from%60 != 0 {
-		from -= from%60 - 60
+		from -= from % res
+	} else if from%res != 0 {
+		from -= from%res - res
 	}
 	if until > 0 {
-		until -= until % 60
-	} else if until%60 != 0 {
-		until -= until%60 + 60
+		until -= until % res
+	} else if until%res != 0 {
+		until -= until%res + res
 	}
 
-	n, err := s.findIdx(from)
+	result, err := s.query(from, until)
 	if err != nil {
 		return nil, err
 	}
-	if n == -1 {
-		n = 0
-	}
-
-	result := make([]Record, 0)
-	var ts, pos, nts, npos int64
-
-	if ts, pos, err = s.readIdxEntry(n); err != nil {
-		return nil, err
-	}
-
-	for ; n < nEntries && ts <= until; n, ts, pos = n+1, nts, npos {
-		if n != nEntries-1 {
-			if nts, npos, err = s.readIdxEntry(n + 1); err != nil {
-				return nil, err
-			}
-		} else {
-			npos = s.dsize
-		}
-
-		f, u := (from-ts)/60, (until-ts)/60
-		if f < 0 {
-			f = 0
-		}
-		if maxu := (npos-pos)/fsDsDSize - 1; u > maxu {
-			u = maxu
-		}
-		if f > u {
-			continue
-		}
-
-		if _, err = s.dat.Seek(pos+f*fsDsDSize, os.SEEK_SET); err != nil {
-			return nil, err
-		}
-		data := make([]float64, u-f+1)
-		if err := binary.Read(s.dat, binary.LittleEndian, data); err != nil {
-			return nil, err
-		}
-		for i, val := range data {
-			rec := Record{Ts: ts + (f+int64(i))*60, Value: val}
-			result = append(result, rec)
-		}
-	}
 
 	last := s.lastWr
 	for _, r := range s.tail {
-		if r.Ts%60 != 0 || last >= r.Ts {
+		if r.Ts%res != 0 || last >= r.Ts {
 			continue
 		}
-		if r.Ts >= from || r.Ts <= until {
+		if r.Ts >= from && r.Ts <= until {
 			result = append(result, Record{Ts: r.Ts, Value: r.Value})
 		}
 		last = r.Ts
@@ -222,16 +248,30 @@ func (ds *FsDatastore) Query(name string, from, until int64) ([]Record, error) {
 }
 
 func (ds *FsDatastore) LatestBefore(name string, ts int64) (Record, error) {
+	r, err := ds.latestBefore(name, ts)
+	if err != ErrNoData || isTierName(name) {
+		return r, err
+	}
+	for _, res := range ds.tiers(name)[1:] {
+		if r, err = ds.latestBefore(ds.tierName(name, res), ts); err != ErrNoData {
+			break
+		}
+	}
+	return r, err
+}
+
+func (ds *FsDatastore) latestBefore(name string, ts int64) (Record, error) {
 	s, err := ds.takeSnapshot(name)
 	if err != nil {
 		return Record{}, err
 	}
 	defer s.close()
 
+	res := s.res
 	if ts > 0 {
-		ts -= ts % 60
-	} else if ts%60 != 0 {
-		ts -= ts%60 + 60
+		ts -= ts % res
+	} else if ts%res != 0 {
+		ts -= ts%res + res
 	}
 
 	if n := s.findTail(ts); n != -1 {
@@ -246,30 +286,16 @@ func (ds *FsDatastore) LatestBefore(name string, ts int64) (Record, error) {
 		return Record{}, ErrNoData
 	}
 
-	t, pos, err := s.readIdxEntry(n)
+	recs, err := s.readBlock(n)
 	if err != nil {
 		return Record{}, err
 	}
-
-	var lastPos int64
-	if n == s.isize/fsDsISize-1 {
-		lastPos = s.dsize - fsDsDSize
-	} else {
-		_, p, err := s.readIdxEntry(n + 1)
-		if err != nil {
-			return Record{}, err
+	for i := len(recs) - 1; i >= 0; i-- {
+		if recs[i].Ts <= ts {
+			return Record{Ts: recs[i].Ts, Value: recs[i].Value}, nil
 		}
-		lastPos = p - fsDsDSize
-	}
-
-	if _, err := s.dat.Seek(lastPos, os.SEEK_SET); err != nil {
-		return Record{}, err
 	}
-	var val float64
-	if err := binary.Read(s.dat, binary.LittleEndian, &val); err != nil {
-		return Record{}, err
-	}
-	return Record{Ts: t + 60*((lastPos-pos)/fsDsDSize), Value: val}, nil
+	return Record{}, ErrNoData
 }
 
 func (ds *FsDatastore) ListNames(pattern string) ([]string, error) {
@@ -289,6 +315,200 @@ func (ds *FsDatastore) ListNames(pattern string) ([]string, error) {
 	return r, nil
 }
 
+// Delete removes the streams matching pattern, as matched by ListNames,
+// and the sketches matching it, together with their rolled up tiers, and
+// returns their names.
+func (ds *FsDatastore) Delete(pattern string) ([]string, error) {
+	ds.rmu.Lock()
+	defer ds.rmu.Unlock()
+
+	names, err := ds.ListNames(pattern)
+	if err != nil {
+		return nil, err
+	}
+	tiers, err := ds.tierNames(names)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+	for i, name := range names {
+		if err := ds.delete(name, tiers[name]); err != nil {
+			return names[:i], err
+		}
+	}
+	sketches, err := ds.deleteSketches(pattern)
+	return append(names, sketches...), err
+}
+
+func (ds *FsDatastore) delete(name string, tiers []string) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if !ds.running {
+		return Error("Datastore not running")
+	}
+
+	for _, n := range append(tiers, name) {
+		st := ds.streams[n]
+		if st == nil {
+			st = &fsDsStream{name: n, res: ds.streamRes(n), ds: ds}
+		}
+		st.Lock()
+		err := st.remove()
+		ds.dropStream(st)
+		st.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	delete(ds.names, name)
+	return nil
+}
+
+// Rename renames the streams and sketches of a series, together with
+// their rolled up tiers. All of them are renamed in a single WAL record, so
+// that replaying it completes the renaming after a crash.
+func (ds *FsDatastore) Rename(oldSeries, newSeries string) error {
+	if err := checkSeriesName(newSeries); err != nil {
+		return err
+	}
+	ds.rmu.Lock()
+	defer ds.rmu.Unlock()
+	tiers, err := ds.tierNames(nil)
+	if err != nil {
+		return err
+	}
+	all, err := ds.sketchNames()
+	if err != nil {
+		return err
+	}
+	var sketches []string
+	for _, name := range all {
+		switch seriesOf(name) {
+		case oldSeries:
+			sketches = append(sketches, name)
+		case newSeries:
+			return Error("Series exists: " + newSeries)
+		}
+	}
+
+	ds.mu.Lock()
+	if !ds.running {
+		ds.mu.Unlock()
+		return Error("Datastore not running")
+	}
+	var streams []string
+	for name := range ds.names {
+		switch seriesOf(name) {
+		case oldSeries:
+			streams = append(streams, name)
+			streams = append(streams, tiers[name]...)
+		case newSeries:
+			ds.mu.Unlock()
+			return Error("Series exists: " + newSeries)
+		}
+	}
+	if len(streams) == 0 && len(sketches) == 0 {
+		ds.mu.Unlock()
+		return Error("No such series: " + oldSeries)
+	}
+
+	// Replaying the WAL completes the renames after a crash
+	var op []string
+	for _, name := range append(streams, sketches...) {
+		op = append(op, name, newSeries+name[len(oldSeries):])
+	}
+	err = ds.wal.log(fsDsWalRename, strings.Join(op, "\x00"), Record{})
+	if err == nil {
+		err = ds.wal.flush(ds.NoSync)
+	}
+	for _, name := range streams {
+		if err != nil {
+			break
+		}
+		to := newSeries + name[len(oldSeries):]
+		src := ds.streams[name]
+		if src == nil {
+			src = &fsDsStream{name: name, res: ds.streamRes(name), ds: ds}
+		}
+		if _, ok := ds.streams[to]; !ok {
+			ds.createStream(to, nil)
+		}
+		dst := ds.streams[to]
+		src.Lock()
+		dst.Lock()
+		err = src.moveTo(dst)
+		ds.dropStream(src)
+		dst.Unlock()
+		src.Unlock()
+		if _, ok := ds.names[name]; ok && err == nil {
+			delete(ds.names, name)
+			ds.names[to] = 1
+		}
+	}
+	ds.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ds.smu.Lock()
+	defer ds.smu.Unlock()
+	for _, name := range sketches {
+		if err := os.Rename(ds.sketchPath(name), ds.sketchPath(newSeries+name[len(oldSeries):])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tierNames returns the names of the rolled up streams of each of names,
+// including those of retention policies no longer in use.
+func (ds *FsDatastore) tierNames(names []string) (map[string][]string, error) {
+	files, err := ioutil.ReadDir(ds.Dir)
+	if err != nil {
+		return nil, err
+	}
+	all := make(map[string]bool)
+	for _, fi := range files {
+		fn := fi.Name()
+		if strings.HasSuffix(fn, ".bix") || strings.HasSuffix(fn, ".idx") {
+			all[fn[:len(fn)-4]] = true
+		}
+	}
+	ds.mu.Lock()
+	for name := range ds.streams {
+		all[name] = true
+	}
+	ds.mu.Unlock()
+
+	r := make(map[string][]string)
+	for name := range all {
+		if i := strings.LastIndex(name, "@"); i != -1 && isTierName(name) {
+			base := name[:i]
+			r[base] = append(r[base], name)
+		}
+	}
+	return r, nil
+}
+
+// dropStream removes st from the streams and the queue of the writer, so
+// the next use of its name starts afresh.
+func (ds *FsDatastore) dropStream(st *fsDsStream) {
+	if ds.streams[st.name] != st {
+		return
+	}
+	delete(ds.streams, st.name)
+	for i, q := range ds.queue {
+		if q == st {
+			l := len(ds.queue)
+			ds.queue[i] = ds.queue[l-1]
+			ds.queue[l-1] = nil
+			ds.queue = ds.queue[:l-1]
+			break
+		}
+	}
+}
+
 func (ds *FsDatastore) getStream(name string) *fsDsStream {
 	ds.mu.Lock()
 	defer ds.mu.Unlock()
@@ -321,6 +541,7 @@ func (ds *FsDatastore) takeSnapshot(name string) (*fsDsSnapshot, error) {
 func (ds *FsDatastore) createStream(name string, tail []fsDsRecord) {
 	st := &fsDsStream{
 		name: name,
+		res:  ds.streamRes(name),
 		tail: tail,
 		ds:   ds,
 	}
@@ -330,7 +551,9 @@ func (ds *FsDatastore) createStream(name string, tail []fsDsRecord) {
 		ds.cond.Broadcast()
 	}
 
-	ds.names[name] = 1
+	if !isTierName(name) {
+		ds.names[name] = 1
+	}
 }
 
 func (ds *FsDatastore) write() {
@@ -365,170 +588,243 @@ func (ds *FsDatastore) write() {
 		} else {
 			ds.mu.Unlock()
 			if err := st.flushTail(); err != nil {
+				// The tail and its WAL segments are kept to try again
 				st.valid = false
+				st.Unlock()
 				log.Println("FsDatastore.write:", err)
+				time.Sleep(fsDsRetryDelay)
+				continue
 			}
 			if cap(st.tail) > 3*len(st.tail) {
 				st.tail = make([]fsDsRecord, 0, 2*len(st.tail))
 			} else {
 				st.tail = st.tail[:0]
 			}
+			atomic.StoreInt64(&st.walSeq, 0)
 			st.Unlock()
 		}
 	}
 }
 
-func (ds *FsDatastore) tailFile() string {
-	return ds.Dir + string(os.PathSeparator) + "tail_data"
+func (ds *FsDatastore) resolutionFile() string {
+	return ds.Dir + string(os.PathSeparator) + "resolution"
 }
 
-func (ds *FsDatastore) saveTails() error {
-	f, err := os.Create(ds.tailFile())
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	wr, le := bufio.NewWriter(f), binary.LittleEndian
-
-	if err = binary.Write(wr, le, uint64(len(ds.streams))); err != nil {
-		return err
-	}
-
-	var (
-		n  string
-		st *fsDsStream
-	)
-	i := 0
-	for n, st = range ds.streams {
-		i++
-		name := []byte(n)
-		if err = binary.Write(wr, le, uint64(len(name))); err != nil {
-			return err
-		}
-		if err = binary.Write(wr, le, uint64(len(st.tail))); err != nil {
-			return err
-		}
-		if err = binary.Write(wr, le, name); err != nil {
-			return err
-		}
-		if err = binary.Write(wr, le, st.tail); err != nil {
-			return err
+// checkResolution makes sure the data directory is used with the
+// resolution it was created with. Directories without a resolution file
+// were written with the original resolution of 60 seconds.
+func (ds *FsDatastore) checkResolution() error {
+	ds.res = ds.Resolution()
+	buff, err := ioutil.ReadFile(ds.resolutionFile())
+	if os.IsNotExist(err) {
+		if len(ds.names) != 0 && ds.res != 60 {
+			return Error("Data directory uses a resolution of 60 seconds")
 		}
+		return ioutil.WriteFile(ds.resolutionFile(), []byte(strconv.FormatInt(ds.res, 10)+"\n"), 0666)
+	} else if err != nil {
+		return err
 	}
 
-	if err = wr.Flush(); err != nil {
-		return err
+	res, err := strconv.ParseInt(strings.TrimSpace(string(buff)), 10, 64)
+	if err != nil {
+		return Error("Invalid resolution file")
 	}
-	if err = f.Sync(); err != nil {
-		return err
+	if res != ds.res {
+		return Error("Data directory uses a resolution of " + strconv.FormatInt(res, 10) + " seconds")
 	}
 	return nil
 }
 
+func (ds *FsDatastore) tailFile() string {
+	return ds.Dir + string(os.PathSeparator) + "tail_data"
+}
+
 func (ds *FsDatastore) loadNames() error {
 	dir := strings.Replace(ds.Dir, "\\", "\\\\", -1)
 	dir = strings.Replace(ds.Dir, "*", "\\*", -1)
 	dir = strings.Replace(ds.Dir, "?", "\\?", -1)
 	dir = strings.Replace(ds.Dir, "[", "\\[", -1)
 
-	files, err := filepath.Glob(dir + string(os.PathSeparator) + "*:*.idx")
+	files, err := filepath.Glob(dir + string(os.PathSeparator) + "*:*.bix")
+	if err != nil {
+		return err
+	}
+	legacy, err := filepath.Glob(dir + string(os.PathSeparator) + "*:*.idx")
 	if err != nil {
 		return err
 	}
+	files = append(files, legacy...)
 
 	ds.names = make(map[string]int)
 
 	for _, fn := range files {
 		fn = filepath.Base(fn)
 		fn = fn[0 : len(fn)-4]
-		ds.names[fn] = 1
+		if !isTierName(fn) {
+			ds.names[fn] = 1
+		}
 	}
 
 	return nil
 }
 
+// loadTails moves the tails saved by versions without a WAL to the WAL.
 func (ds *FsDatastore) loadTails() error {
-	f, err := os.Open(ds.tailFile())
+	tails, err := readTailFile(ds.tailFile())
 	if os.IsNotExist(err) {
 		return nil
 	} else if err != nil {
 		return err
 	}
+
+	for _, t := range tails {
+		for _, r := range t.tail {
+			if err := ds.wal.append(t.name, Record{Ts: r.Ts, Value: r.Value}); err != nil {
+				return err
+			}
+		}
+		st, ok := ds.streams[t.name]
+		if !ok {
+			ds.createStream(t.name, nil)
+			st = ds.streams[t.name]
+		}
+		if len(st.tail) == 0 {
+			atomic.StoreInt64(&st.walSeq, ds.wal.current())
+		}
+		st.tail = append(st.tail, t.tail...)
+	}
+	return os.Remove(ds.tailFile())
+}
+
+type fsDsTail struct {
+	name string
+	tail []fsDsRecord
+}
+
+// readTailFile reads a tail file. On error, the tails read before the
+// damaged one are returned with it.
+func readTailFile(fn string) ([]fsDsTail, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
 	defer f.Close()
 	rd, le := bufio.NewReader(f), binary.LittleEndian
 
 	var ntails int64
 	if err = binary.Read(rd, le, &ntails); err != nil {
-		return err
+		return nil, err
 	}
 
+	var r []fsDsTail
 	for i := int64(0); i < ntails; i++ {
 		var lname, ltail int64
 		if err = binary.Read(rd, le, &lname); err != nil {
-			return err
+			return r, err
 		}
 		if err = binary.Read(rd, le, &ltail); err != nil {
-			return err
+			return r, err
+		}
+		if lname < 0 || lname > fsDsWalSegment || ltail < 0 || ltail > fsDsWalSegment {
+			return r, Error("Invalid tail file")
 		}
 		name := make([]byte, lname)
 		if err = binary.Read(rd, le, name); err != nil {
-			return err
+			return r, err
 		}
 		tail := make([]fsDsRecord, ltail)
 		if err = binary.Read(rd, le, tail); err != nil {
-			return err
+			return r, err
 		}
-		strName := string(name)
-		ds.createStream(strName, tail)
+		r = append(r, fsDsTail{string(name), tail})
 	}
-	return nil
+	return r, nil
 }
 
+// flushTail appends the tail to the open block, sealing it whenever it
+// reaches fsDsBlockRecords records. Sealed blocks are only modified by
+// records older than the last one written, see backfill.
 func (st *fsDsStream) flushTail() error {
-	if err := st.openFiles(); err != nil {
+	if err := st.openFiles(true); err != nil {
 		return err
 	}
 	defer st.closeFiles()
 
-	dbuff, ibuff := new(bytes.Buffer), new(bytes.Buffer)
-	dsize, isize, lastWr := st.dsize, st.isize, st.lastWr
-
+	open, lastWr, res := st.open, st.lastWr, st.res
+	var past []fsDsRecord
 	for _, r := range st.tail {
-		if r.Ts%60 != 0 {
-			log.Println("fsDsStream.writeTail: Timestamp not divisible by 60")
+		if r.Ts%res != 0 {
+			log.Println("fsDsStream.writeTail: Timestamp not divisible by", res)
 			continue
 		} else if lastWr >= r.Ts {
-			log.Println("fsDsStream.writeTail: Timestamp in the past:", st.name)
+			past = append(past, r)
 			continue
 		}
+		open = append(open, r)
+		lastWr = r.Ts
+	}
+	if len(open) > len(st.open) {
+		if err := st.writeOpen(open, lastWr); err != nil {
+			return err
+		}
+	}
+	if len(past) > 0 {
+		return st.backfill(past)
+	}
+	return nil
+}
 
-		le := binary.LittleEndian
-		binary.Write(dbuff, le, r.Value)
-		dsize += fsDsDSize
-		lastWr += 60
-
-		if r.Ts > lastWr {
-			binary.Write(ibuff, le, []int64{r.Ts, dsize - fsDsDSize})
-			isize += fsDsISize
-			lastWr = r.Ts
+func (st *fsDsStream) writeOpen(open []fsDsRecord, lastWr int64) error {
+	res := st.res
+	dbuff, ibuff := new(bytes.Buffer), new(bytes.Buffer)
+	sealed, pos, indexed := st.sealed, st.sealed, len(st.open) > 0
+	for len(open) > 0 {
+		n := len(open)
+		if n > fsDsBlockRecords {
+			n = fsDsBlockRecords
+		}
+		if !indexed {
+			binary.Write(ibuff, binary.LittleEndian, []int64{open[0].Ts, pos})
+		}
+		block := encodeBlock(open[:n], res)
+		dbuff.Write(block)
+		pos += int64(len(block))
+		if n < fsDsBlockRecords {
+			break
 		}
+		sealed, open, indexed = pos, open[n:], false
 	}
 
-	if _, err := st.dat.Seek(0, os.SEEK_END); err != nil {
-		return err
+	// The encoding of records only appends bits, so the records of the
+	// open block stay readable under its old header while the rest is
+	// written. The header follows once the data is on disk, a torn write
+	// loses the new records only.
+	data, head := dbuff.Bytes(), 0
+	if len(st.open) > 0 && st.dsize > st.sealed+fsDsBlockHeader {
+		head = int(st.dsize-st.sealed) - 1
 	}
-	if _, err := st.idx.Seek(0, os.SEEK_END); err != nil {
+	if _, err := st.dat.WriteAt(data[head:], st.sealed+int64(head)); err != nil {
 		return err
 	}
-
-	if _, err := dbuff.WriteTo(st.dat); err != nil {
+	if err := st.dat.Truncate(pos); err != nil {
 		return err
 	}
-	if _, err := ibuff.WriteTo(st.idx); err != nil {
+	if head > 0 {
+		if !st.ds.NoSync {
+			if err := st.dat.Sync(); err != nil {
+				return err
+			}
+		}
+		if _, err := st.dat.WriteAt(data[:fsDsBlockHeader], st.sealed); err != nil {
+			return err
+		}
+	}
+	if _, err := st.idx.WriteAt(ibuff.Bytes(), st.isize); err != nil {
 		return err
 	}
 
-	st.dsize, st.isize, st.lastWr = dsize, isize, lastWr
+	st.dsize, st.isize, st.lastWr = pos, st.isize+int64(ibuff.Len()), lastWr
+	st.sealed, st.open = sealed, append([]fsDsRecord(nil), open...)
 	return nil
 }
 
@@ -536,12 +832,35 @@ func (st *fsDsStream) path() string {
 	return st.ds.Dir + string(os.PathSeparator) + st.name
 }
 
-func (st *fsDsStream) openFiles() error {
-	dat, err := os.OpenFile(st.path()+".dat", os.O_CREATE|os.O_RDWR, 0666)
-	if err != nil {
+// openFiles opens the files of the stream. Unless create is set, missing
+// files are left closed and the stream is empty, so reading a series
+// which doesn't exist doesn't create it.
+func (st *fsDsStream) openFiles(create bool) error {
+	if !st.valid {
+		if err := st.recoverSwap(); err != nil {
+			return err
+		}
+	}
+	if err := st.migrate(); err != nil {
+		return err
+	}
+
+	flag := os.O_RDWR
+	if create {
+		flag |= os.O_CREATE
+	}
+	dat, err := os.OpenFile(st.path()+".blk", flag, 0666)
+	if os.IsNotExist(err) && !create {
+		if !st.valid {
+			st.dsize, st.isize, st.sealed, st.open = 0, 0, 0, nil
+			st.lastWr = -1<<63 - (-1<<63)%st.res
+			st.valid = true
+		}
+		return nil
+	} else if err != nil {
 		return err
 	}
-	idx, err := os.OpenFile(st.path()+".idx", os.O_CREATE|os.O_RDWR, 0666)
+	idx, err := os.OpenFile(st.path()+".bix", flag, 0666)
 	if err != nil {
 		dat.Close()
 		return err
@@ -549,40 +868,433 @@ func (st *fsDsStream) openFiles() error {
 	st.dat, st.idx = dat, idx
 
 	if !st.valid {
-		di, err := dat.Stat()
-		if err != nil {
+		if err := st.load(); err != nil {
 			st.closeFiles()
 			return err
 		}
-		ii, err := idx.Stat()
+		st.valid = true
+	}
+
+	return nil
+}
+
+// load reads the sizes of the files and the open block, which is the last
+// block if it has fewer than fsDsBlockRecords records.
+func (st *fsDsStream) load() error {
+	di, err := st.dat.Stat()
+	if err != nil {
+		return err
+	}
+	ii, err := st.idx.Stat()
+	if err != nil {
+		return err
+	}
+	st.dsize, st.isize = di.Size(), ii.Size()
+	if st.isize%fsDsISize != 0 {
+		return Error("Invalid file size: " + st.name)
+	}
+
+	st.lastWr = -1<<63 - (-1<<63)%st.res
+	st.sealed, st.open = 0, nil
+	if st.isize == 0 {
+		if st.dsize != 0 {
+			return Error("Invalid file size: " + st.name)
+		}
+		return nil
+	}
+
+	d := make([]byte, fsDsISize)
+	if _, err := st.idx.ReadAt(d, st.isize-fsDsISize); err != nil {
+		return err
+	}
+	pos := int64(binary.LittleEndian.Uint64(d[8:]))
+	recs, err := readBlockAt(st.dat, pos, st.dsize, st.res)
+	if err != nil {
+		if recs = st.salvage(pos); len(recs) == 0 {
+			return Error(err.Error() + ": " + st.name)
+		}
+		log.Println("fsDsStream.load: Recovered", len(recs), "records of the last block of", st.name+":", err)
+	}
+	// Anything after the last block is left by a torn write
+	st.dsize = pos + int64(len(encodeBlock(recs, st.res)))
+	st.lastWr = recs[len(recs)-1].Ts
+	if len(recs) < fsDsBlockRecords {
+		st.sealed, st.open = pos, recs
+	} else {
+		st.sealed = st.dsize
+	}
+	return nil
+}
+
+// salvage decodes what is left of the last block at pos after a torn
+// write.
+func (st *fsDsStream) salvage(pos int64) []fsDsRecord {
+	if pos < 0 || pos+fsDsBlockHeader > st.dsize {
+		return nil
+	}
+	data := make([]byte, st.dsize-pos)
+	if _, err := st.dat.ReadAt(data, pos); err != nil {
+		return nil
+	}
+	recs, _ := decodeRecords(data, st.res)
+	return recs
+}
+
+// readBlockAt decodes the block at pos, which must end before limit.
+func readBlockAt(f *os.File, pos, limit, res int64) ([]fsDsRecord, error) {
+	header := make([]byte, fsDsBlockHeader)
+	if pos < 0 || pos+fsDsBlockHeader > limit {
+		return nil, Error("Invalid block position")
+	}
+	if _, err := f.ReadAt(header, pos); err != nil {
+		return nil, err
+	}
+	size := blockSize(header)
+	if pos+size > limit {
+		return nil, Error("Invalid block size")
+	}
+	data := make([]byte, size)
+	if _, err := f.ReadAt(data, pos); err != nil {
+		return nil, err
+	}
+	return decodeBlock(data, res)
+}
+
+// view returns a snapshot of the open files of st, which is only valid
+// while st is locked.
+func (st *fsDsStream) view() *fsDsSnapshot {
+	return &fsDsSnapshot{
+		ds:     st.ds,
+		res:    st.res,
+		dat:    st.dat,
+		idx:    st.idx,
+		lastWr: st.lastWr,
+		isize:  st.isize,
+		sealed: st.sealed,
+		open:   st.open,
+	}
+}
+
+// records returns every record in the files.
+func (st *fsDsStream) records() ([]fsDsRecord, error) {
+	recs, err := st.view().query(-1<<63, 1<<63-1)
+	if err != nil {
+		return nil, err
+	}
+	r := make([]fsDsRecord, len(recs))
+	for i, rec := range recs {
+		r[i] = fsDsRecord{Ts: rec.Ts, Value: rec.Value}
+	}
+	return r, nil
+}
+
+// backfill merges records at or before lastWr into the files, replacing
+// the records with the same timestamps. The blocks from the first one
+// affected on are rewritten.
+func (st *fsDsStream) backfill(recs []fsDsRecord) error {
+	sort.Stable(fsDsRecords(recs))
+	s := st.view()
+	k, err := s.findIdx(recs[0].Ts)
+	if err != nil {
+		return err
+	}
+	if k == -1 {
+		k = 0
+	}
+
+	var old []fsDsRecord
+	for n := k; n < s.isize/fsDsISize; n++ {
+		b, err := s.readBlock(n)
 		if err != nil {
-			st.closeFiles()
 			return err
 		}
-		st.dsize, st.isize = di.Size(), ii.Size()
-		if st.isize%fsDsISize != 0 || st.dsize%fsDsDSize != 0 {
-			st.closeFiles()
-			return Error("Invalid file size: " + st.name)
+		old = append(old, b...)
+	}
+	if err := st.rewriteFrom(k, mergeRecords(old, recs)); err != nil {
+		return err
+	}
+	st.ds.markBackfill(st.name, recs[0].Ts)
+	return nil
+}
+
+// mergeRecords merges two sorted lists of records. Records of b replace
+// those of a with the same timestamp, and later records of b earlier ones.
+func mergeRecords(a, b []fsDsRecord) []fsDsRecord {
+	r := make([]fsDsRecord, 0, len(a)+len(b))
+	for i, j := 0, 0; i < len(a) || j < len(b); {
+		switch {
+		case j+1 < len(b) && b[j+1].Ts == b[j].Ts:
+			j++
+		case j == len(b) || (i < len(a) && a[i].Ts < b[j].Ts):
+			r = append(r, a[i])
+			i++
+		case i == len(a) || b[j].Ts < a[i].Ts:
+			r = append(r, b[j])
+			j++
+		default:
+			r = append(r, b[j])
+			i, j = i+1, j+1
 		}
+	}
+	return r
+}
 
-		if st.isize == 0 {
-			st.lastWr = -1<<63 - (-1<<63)%60
-		} else {
-			if _, err := st.idx.Seek(st.isize-fsDsISize, os.SEEK_SET); err != nil {
-				st.closeFiles()
+type fsDsRecords []fsDsRecord
+
+func (s fsDsRecords) Len() int           { return len(s) }
+func (s fsDsRecords) Less(i, j int) bool { return s[i].Ts < s[j].Ts }
+func (s fsDsRecords) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// rewrite replaces the files with blocks holding recs. The new files are
+// renamed into place, so open snapshots remain valid.
+func (st *fsDsStream) rewrite(recs []fsDsRecord) error {
+	return st.rewriteFrom(0, recs)
+}
+
+// rewriteFrom replaces the blocks from the kth one on with blocks holding
+// recs. The blocks before it are copied from the open files.
+func (st *fsDsStream) rewriteFrom(k int64, recs []fsDsRecord) error {
+	dat, idx, err := st.createTmp()
+	if err != nil {
+		return err
+	}
+	defer dat.Close()
+	defer idx.Close()
+
+	var pos int64
+	if k > 0 {
+		if _, pos, err = st.view().readIdxEntry(k); err != nil {
+			return err
+		}
+		if _, err := io.Copy(dat, io.NewSectionReader(st.dat, 0, pos)); err != nil {
+			return err
+		}
+		if _, err := io.Copy(idx, io.NewSectionReader(st.idx, 0, k*fsDsISize)); err != nil {
+			return err
+		}
+	}
+	if _, err := writeBlocks(dat, idx, recs, pos, st.res); err != nil {
+		return err
+	}
+	return st.swapTmp(dat, idx)
+}
+
+// rewriteTo replaces the blocks before the kth one with blocks holding
+// recs. The blocks from it on are copied from the open files, only their
+// positions in the index change.
+func (st *fsDsStream) rewriteTo(k int64, recs []fsDsRecord) error {
+	dat, idx, err := st.createTmp()
+	if err != nil {
+		return err
+	}
+	defer dat.Close()
+	defer idx.Close()
+
+	pos, err := writeBlocks(dat, idx, recs, 0, st.res)
+	if err != nil {
+		return err
+	}
+	s := st.view()
+	if n := s.isize / fsDsISize; k < n {
+		_, from, err := s.readIdxEntry(k)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(dat, io.NewSectionReader(st.dat, from, st.dsize-from)); err != nil {
+			return err
+		}
+		iw := bufio.NewWriter(idx)
+		for ; k < n; k++ {
+			ts, p, err := s.readIdxEntry(k)
+			if err != nil {
 				return err
 			}
-			d := []int64{0, 0}
-			if err := binary.Read(st.idx, binary.LittleEndian, d); err != nil {
-				st.closeFiles()
+			if err := binary.Write(iw, binary.LittleEndian, []int64{ts, p - from + pos}); err != nil {
 				return err
 			}
-			ts, pos := d[0], d[1]
-			st.lastWr = ts + 60*((st.dsize-pos)/fsDsDSize-1)
 		}
-		st.valid = true
+		if err := iw.Flush(); err != nil {
+			return err
+		}
+	}
+	return st.swapTmp(dat, idx)
+}
+
+// writeBlocks writes blocks holding recs starting at pos to dat and their
+// index entries to idx, and returns the position after them.
+func writeBlocks(dat, idx io.Writer, recs []fsDsRecord, pos, res int64) (int64, error) {
+	dw, iw := bufio.NewWriter(dat), bufio.NewWriter(idx)
+	for len(recs) > 0 {
+		n := len(recs)
+		if n > fsDsBlockRecords {
+			n = fsDsBlockRecords
+		}
+		block := encodeBlock(recs[:n], res)
+		if _, err := dw.Write(block); err != nil {
+			return 0, err
+		}
+		if err := binary.Write(iw, binary.LittleEndian, []int64{recs[0].Ts, pos}); err != nil {
+			return 0, err
+		}
+		pos += int64(len(block))
+		recs = recs[n:]
+	}
+	if err := dw.Flush(); err != nil {
+		return 0, err
+	}
+	return pos, iw.Flush()
+}
+
+func (st *fsDsStream) createTmp() (dat, idx *os.File, err error) {
+	if dat, err = os.Create(st.path() + ".blk.tmp"); err != nil {
+		return nil, nil, err
+	}
+	if idx, err = os.Create(st.path() + ".bix.tmp"); err != nil {
+		dat.Close()
+		return nil, nil, err
+	}
+	return dat, idx, nil
+}
+
+// swapTmp renames the complete new files of a rewrite into place.
+func (st *fsDsStream) swapTmp(dat, idx *os.File) error {
+	if !st.ds.NoSync {
+		if err := dat.Sync(); err != nil {
+			return err
+		}
+		if err := idx.Sync(); err != nil {
+			return err
+		}
+	}
+
+	st.valid = false
+	f, err := os.Create(st.path() + fsDsSwapExt)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return st.finishSwap()
+}
+
+// The new files of a rewrite are renamed into place one after the other.
+// The swap marker is created once both are complete, so a crash in
+// between is finished by the next openFiles, while new files without the
+// marker are removed.
+const fsDsSwapExt = ".swap"
+
+func (st *fsDsStream) finishSwap() error {
+	for _, ext := range []string{".blk", ".bix"} {
+		if err := os.Rename(st.path()+ext+".tmp", st.path()+ext); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Remove(st.path() + fsDsSwapExt)
+}
+
+// recoverSwap completes or discards a rewrite interrupted by a crash.
+func (st *fsDsStream) recoverSwap() error {
+	if _, err := os.Stat(st.path() + fsDsSwapExt); err == nil {
+		log.Println("Completing an interrupted rewrite of", st.name)
+		return st.finishSwap()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for _, ext := range []string{".blk", ".bix"} {
+		if err := os.Remove(st.path() + ext + ".tmp"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrate converts the files of the original format, which stored every
+// record as an uncompressed float, to blocks.
+func (st *fsDsStream) migrate() error {
+	if _, err := os.Stat(st.path() + ".idx"); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	idx, err := ioutil.ReadFile(st.path() + ".idx")
+	if err != nil {
+		return err
+	}
+	dat, err := ioutil.ReadFile(st.path() + ".dat")
+	if err != nil {
+		return err
+	}
+	if len(idx)%fsDsISize != 0 || len(dat)%8 != 0 {
+		return Error("Invalid file size: " + st.name)
+	}
+
+	le := binary.LittleEndian
+	var recs []fsDsRecord
+	for k := 0; k < len(idx); k += fsDsISize {
+		ts, pos, end := int64(le.Uint64(idx[k:])), int64(le.Uint64(idx[k+8:])), int64(len(dat))
+		if k+fsDsISize < len(idx) {
+			end = int64(le.Uint64(idx[k+fsDsISize+8:]))
+		}
+		if ts%st.res != 0 || pos%8 != 0 || pos > end || end > int64(len(dat)) {
+			return Error("Invalid index data: " + st.name)
+		}
+		for ; pos < end; pos, ts = pos+8, ts+st.res {
+			recs = append(recs, fsDsRecord{Ts: ts, Value: math.Float64frombits(le.Uint64(dat[pos:]))})
+		}
 	}
 
+	if err := st.rewrite(recs); err != nil {
+		return err
+	}
+	if err := os.Remove(st.path() + ".dat"); err != nil {
+		return err
+	}
+	return os.Remove(st.path() + ".idx")
+}
+
+var fsDsExts = []string{".blk", ".bix", ".dat", ".idx"}
+
+// remove deletes the files and the tail of the stream.
+func (st *fsDsStream) remove() error {
+	if err := st.ds.wal.log(fsDsWalDelete, st.name, Record{}); err != nil {
+		return err
+	}
+	if err := st.ds.wal.flush(st.ds.NoSync); err != nil {
+		return err
+	}
+	st.tail, st.valid = nil, false
+	atomic.StoreInt64(&st.walSeq, 0)
+	for _, ext := range fsDsExts {
+		if err := os.Remove(st.path() + ext); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveTo moves the files and the tail of the stream to dst, replacing any
+// files of dst. The renaming must have been logged to the WAL.
+func (st *fsDsStream) moveTo(dst *fsDsStream) error {
+	st.valid, dst.valid = false, false
+	for _, ext := range fsDsExts {
+		if err := os.Remove(dst.path() + ext); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, ext := range fsDsExts {
+		if err := os.Rename(st.path()+ext, dst.path()+ext); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if len(st.tail) > 0 {
+		if len(dst.tail) == 0 {
+			atomic.StoreInt64(&dst.walSeq, atomic.LoadInt64(&st.walSeq))
+		}
+		dst.tail = append(dst.tail, st.tail...)
+	}
+	st.tail = nil
+	atomic.StoreInt64(&st.walSeq, 0)
 	return nil
 }
 
@@ -608,19 +1320,21 @@ func (st *fsDsStream) closeFiles() {
 }
 
 func (st *fsDsStream) takeSnapshot() (*fsDsSnapshot, error) {
-	if err := st.openFiles(); err != nil {
+	if err := st.openFiles(false); err != nil {
 		return nil, err
 	}
 	s := &fsDsSnapshot{
 		ds:     st.ds,
+		res:    st.res,
 		tail:   append([]fsDsRecord(nil), st.tail...),
 		dat:    st.dat,
 		idx:    st.idx,
 		lastWr: st.lastWr,
-		dsize:  st.dsize,
 		isize:  st.isize,
+		sealed: st.sealed,
+		open:   append([]fsDsRecord(nil), st.open...),
 	}
-	st.dat, st.dat = nil, nil
+	st.dat, st.idx = nil, nil
 	st.ds.wg.Add(1)
 	return s, nil
 }
@@ -677,10 +1391,56 @@ func (s *fsDsSnapshot) findIdx(ts int64) (int64, error) {
 	return i, nil
 }
 
+func (s *fsDsSnapshot) query(from, until int64) ([]Record, error) {
+	result := make([]Record, 0)
+	nEntries := s.isize / fsDsISize
+
+	n, err := s.findIdx(from)
+	if err != nil {
+		return nil, err
+	}
+	if n == -1 {
+		n = 0
+	}
+
+	for ; n < nEntries; n++ {
+		ts, _, err := s.readIdxEntry(n)
+		if err != nil {
+			return nil, err
+		}
+		if ts > until {
+			break
+		}
+		recs, err := s.readBlock(n)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range recs {
+			if r.Ts >= from && r.Ts <= until {
+				result = append(result, Record{Ts: r.Ts, Value: r.Value})
+			}
+		}
+	}
+	return result, nil
+}
+
+// readBlock returns the records of the nth block. The open block is read
+// from memory, as it may be rewritten while the snapshot is in use.
+func (s *fsDsSnapshot) readBlock(n int64) ([]fsDsRecord, error) {
+	_, pos, err := s.readIdxEntry(n)
+	if err != nil {
+		return nil, err
+	}
+	if pos == s.sealed {
+		return s.open, nil
+	}
+	return readBlockAt(s.dat, pos, s.sealed, s.res)
+}
+
 func (s *fsDsSnapshot) findTail(ts int64) int64 {
 	last, k := s.lastWr, -1
 	for i, r := range s.tail {
-		if r.Ts%60 != 0 || last >= r.Ts {
+		if r.Ts%s.res != 0 || last >= r.Ts {
 			continue
 		}
 		if r.Ts <= ts {
@@ -694,15 +1454,13 @@ func (s *fsDsSnapshot) findTail(ts int64) int64 {
 }
 
 func (s *fsDsSnapshot) readIdxEntry(n int64) (ts int64, pos int64, err error) {
-	if _, err := s.idx.Seek(n*fsDsISize, os.SEEK_SET); err != nil {
-		return 0, 0, err
-	}
-	d := []int64{0, 0}
-	if err := binary.Read(s.idx, binary.LittleEndian, d); err != nil {
+	d := make([]byte, fsDsISize)
+	if _, err := s.idx.ReadAt(d, n*fsDsISize); err != nil {
 		return 0, 0, err
 	}
-	if d[0] % 60 != 0 || d[1]%fsDsDSize != 0 {
+	ts, pos = int64(binary.LittleEndian.Uint64(d)), int64(binary.LittleEndian.Uint64(d[8:]))
+	if ts%s.res != 0 || pos < 0 || pos > s.sealed {
 		return 0, 0, Error("Invalid index data")
 	}
-	return d[0], d[1], nil
+	return ts, pos, nil
 }
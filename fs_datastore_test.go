@@ -0,0 +1,387 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFsDatastoreRewriteRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rewrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds := &FsDatastore{Dir: dir, NoSync: true, res: 60}
+	old, recs := []fsDsRecord{{60, 1}, {120, 2}}, []fsDsRecord{{60, 3}, {120, 4}, {180, 5}}
+	for _, marker := range []bool{true, false} {
+		st := &fsDsStream{ds: ds, name: "a:gauge", res: 60}
+		if err := st.rewrite(old); err != nil {
+			t.Fatal(err)
+		}
+
+		// Crash after renaming the first file of a rewrite
+		tmp := &fsDsStream{ds: ds, name: "b:gauge", res: 60}
+		if err := tmp.rewrite(recs); err != nil {
+			t.Fatal(err)
+		}
+		os.Rename(tmp.path()+".bix", st.path()+".bix.tmp")
+		if marker {
+			os.Rename(tmp.path()+".blk", st.path()+".blk")
+			ioutil.WriteFile(st.path()+fsDsSwapExt, nil, 0666)
+		} else {
+			os.Rename(tmp.path()+".blk", st.path()+".blk.tmp")
+		}
+
+		st = &fsDsStream{ds: ds, name: "a:gauge", res: 60}
+		if err := st.openFiles(false); err != nil {
+			t.Fatal(err)
+		}
+		r, err := st.records()
+		st.closeFiles()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := old
+		if marker {
+			expected = recs
+		}
+		if !reflect.DeepEqual(r, expected) {
+			t.Error("Marker", marker, "recovered", r)
+		}
+		if files, _ := ioutil.ReadDir(dir); len(files) != 2 {
+			t.Error("Marker", marker, "left", len(files), "files")
+		}
+	}
+}
+
+func testRecords(from, n int) []fsDsRecord {
+	recs := make([]fsDsRecord, n)
+	for i := range recs {
+		recs[i] = fsDsRecord{Ts: int64(from+i) * 60, Value: float64((from + i) % 7)}
+	}
+	return recs
+}
+
+func TestFsDatastoreTruncate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "truncate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds := &FsDatastore{Dir: dir, NoSync: true, res: 60}
+	recs := testRecords(1, 3*fsDsBlockRecords+10)
+	var testCases = []struct {
+		ts     int64
+		blocks int64
+	}{
+		{0, 4},
+		{60, 4},
+		{fsDsBlockRecords * 60, 3},
+		{(fsDsBlockRecords + 5) * 60, 3},
+		{(3*fsDsBlockRecords + 2) * 60, 1},
+		{(3*fsDsBlockRecords + 10) * 60, 0},
+	}
+	for _, tc := range testCases {
+		st := &fsDsStream{ds: ds, name: "a:gauge", res: 60}
+		if err := st.rewrite(nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.openFiles(true); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.writeOpen(recs, recs[len(recs)-1].Ts); err != nil {
+			t.Fatal(err)
+		}
+		err := st.truncate(tc.ts)
+		if err == nil {
+			err = st.openFiles(false)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := st.records()
+		st.closeFiles()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := int(tc.ts / 60)
+		if len(r) != len(recs)-n || (len(r) > 0 && !reflect.DeepEqual(r, recs[n:])) {
+			t.Error("Truncating at", tc.ts, "left", len(r), "records")
+		}
+		if blocks := st.isize / fsDsISize; blocks != tc.blocks {
+			t.Error("Truncating at", tc.ts, "left", blocks, "blocks")
+		}
+	}
+}
+
+func TestFsDatastoreTornWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds := &FsDatastore{Dir: dir, NoSync: true, res: 60}
+	recs := testRecords(1, 20)
+	for i, torn := range []string{"header", "data", "garbage"} {
+		st := &fsDsStream{ds: ds, name: "a:gauge", res: 60}
+		if err := st.rewrite(nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.openFiles(true); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.writeOpen(recs[:10], recs[9].Ts); err != nil {
+			t.Fatal(err)
+		}
+		header := make([]byte, fsDsBlockHeader)
+		st.dat.ReadAt(header, 0)
+		if err := st.writeOpen(recs, recs[19].Ts); err != nil {
+			t.Fatal(err)
+		}
+		expected := recs
+		switch torn {
+		case "header":
+			// The data of the new records was written, the header not
+			st.dat.WriteAt(header, 0)
+			expected = recs[:10]
+		case "data":
+			// The header was written, the end of the data not
+			st.dat.Truncate(st.dsize - 3)
+		case "garbage":
+			// Blocks written after the last index entry
+			st.dat.WriteAt(make([]byte, 100), st.dsize)
+		}
+		st.closeFiles()
+
+		st = &fsDsStream{ds: ds, name: "a:gauge", res: 60}
+		if err := st.openFiles(false); err != nil {
+			t.Fatal(torn, err)
+		}
+		r, err := st.records()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if torn == "data" {
+			if len(r) < 10 || len(r) >= 20 || !reflect.DeepEqual(r, recs[:len(r)]) {
+				t.Error("Torn", torn, "recovered", r)
+			}
+			expected = r
+		} else if !reflect.DeepEqual(r, expected) {
+			t.Error("Torn", torn, "recovered", r)
+		}
+
+		// Writing continues after the recovered records
+		more := append(append([]fsDsRecord(nil), expected...), testRecords(30+i, 5)...)
+		if err := st.writeOpen(more, more[len(more)-1].Ts); err != nil {
+			t.Fatal(err)
+		}
+		st.closeFiles()
+		st = &fsDsStream{ds: ds, name: "a:gauge", res: 60}
+		if err := st.openFiles(false); err != nil {
+			t.Fatal(torn, err)
+		}
+		r, err = st.records()
+		st.closeFiles()
+		if err != nil || !reflect.DeepEqual(r, more) {
+			t.Error("Torn", torn, "continued with", r, err)
+		}
+	}
+}
+
+func TestFsDatastoreWriteRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ds := &FsDatastore{Dir: dir, NoSync: true}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	// The files can't be opened while the directory is in the way
+	if err := os.Mkdir(dir+"/a:gauge.blk", 0777); err != nil {
+		t.Fatal(err)
+	}
+	ds.Insert("a:gauge", Record{Ts: 60, Value: 1})
+	time.Sleep(3 * fsDsRetryDelay)
+	st := ds.getStream("a:gauge")
+	n, seq := len(st.tail), atomic.LoadInt64(&st.walSeq)
+	st.Unlock()
+	if n != 1 || seq == 0 {
+		t.Fatal("Tail of", n, "records kept in WAL segment", seq)
+	}
+
+	os.Remove(dir + "/a:gauge.blk")
+	waitFlushed(t, ds)
+	st = &fsDsStream{ds: ds, name: "a:gauge", res: 60}
+	if err := st.openFiles(false); err != nil {
+		t.Fatal(err)
+	}
+	defer st.closeFiles()
+	if r, err := st.records(); err != nil || !reflect.DeepEqual(r, []fsDsRecord{{60, 1}}) {
+		t.Error("Written", r, err)
+	}
+}
+
+func TestMergeRecords(t *testing.T) {
+	a := []fsDsRecord{{60, 1}, {120, 2}}
+	var testCases = []struct {
+		a, b, r []fsDsRecord
+	}{
+		{a, []fsDsRecord{{120, 3}}, []fsDsRecord{{60, 1}, {120, 3}}},
+		{a, []fsDsRecord{{60, 5}, {60, 6}}, []fsDsRecord{{60, 6}, {120, 2}}},
+		{a, []fsDsRecord{{0, 9}, {180, 3}}, []fsDsRecord{{0, 9}, {60, 1}, {120, 2}, {180, 3}}},
+		{nil, []fsDsRecord{{60, 1}, {60, 2}}, []fsDsRecord{{60, 2}}},
+		{a, nil, a},
+	}
+	for _, tc := range testCases {
+		if r := mergeRecords(tc.a, tc.b); !reflect.DeepEqual(r, tc.r) {
+			t.Error("Merging", tc.a, tc.b, "returned", r)
+		}
+	}
+}
+
+func TestFsDatastoreBackfill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backfill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds := &FsDatastore{Dir: dir, NoSync: true, res: 60}
+	st := &fsDsStream{ds: ds, name: "a:gauge", res: 60}
+	recs := testRecords(1, 2*fsDsBlockRecords+10)
+	if err := st.rewrite(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.openFiles(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.writeOpen(recs, recs[len(recs)-1].Ts); err != nil {
+		t.Fatal(err)
+	}
+	past := []fsDsRecord{{fsDsBlockRecords * 60, 9}, {0, 4}, {120, 8}}
+	if err := st.backfill(past); err != nil {
+		t.Fatal(err)
+	}
+	st.closeFiles()
+
+	expected := append([]fsDsRecord{{0, 4}}, recs...)
+	expected[2].Value, expected[fsDsBlockRecords].Value = 8, 9
+	st = &fsDsStream{ds: ds, name: "a:gauge", res: 60}
+	if err := st.openFiles(false); err != nil {
+		t.Fatal(err)
+	}
+	defer st.closeFiles()
+	if r, err := st.records(); err != nil || !reflect.DeepEqual(r, expected) {
+		t.Error("Backfilled", len(r), "records:", err)
+	}
+
+	// Only records missing from the files or with another value are
+	// replayed, the last one of a timestamp counting
+	wal := []fsDsRecord{{60, 1}, {120, 5}, {180, 3}, {180, 7}, {120, 8}, {recs[len(recs)-1].Ts + 60, 6}}
+	r, err := st.unflushed(wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []fsDsRecord{{180, 7}, {recs[len(recs)-1].Ts + 60, 6}}; !reflect.DeepEqual(r, expected) {
+		t.Error("Unflushed", r)
+	}
+}
+
+func TestFsDatastoreRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ds := &FsDatastore{Dir: dir, NoSync: true}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	// New names must be series with canonical tags
+	for _, name := range []string{"", "b:gauge", "b#", "b#x:1,a:2", "b#a:2,a:1", "b/c"} {
+		if err := ds.Rename("a", name); err == nil || !strings.HasPrefix(err.Error(), "Invalid series name") {
+			t.Error("Renamed to", name, err)
+		}
+	}
+
+	// Half of the records are still in the tail while renaming
+	for ts := int64(60); ts <= 6000; ts += 60 {
+		ds.Insert("a:gauge", Record{Ts: ts, Value: 1})
+		ds.Insert("c:gauge", Record{Ts: ts, Value: 2})
+	}
+	waitFlushed(t, ds)
+	s, err := ds.takeSnapshot("c:gauge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	for ts := int64(6060); ts <= 12000; ts += 60 {
+		ds.Insert("a:gauge", Record{Ts: ts, Value: 1})
+	}
+	if err := ds.Rename("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Rename("c", "b"); err == nil {
+		t.Error("Renamed to an existing series")
+	}
+	if names, err := ds.Delete("c:*"); err != nil || !reflect.DeepEqual(names, []string{"c:gauge"}) {
+		t.Error("Deleted", names, err)
+	}
+	waitFlushed(t, ds)
+	if names, _ := ds.ListNames("*"); !reflect.DeepEqual(names, []string{"b:gauge"}) {
+		t.Error("ListNames returned", names)
+	}
+
+	var testCases = []struct {
+		name string
+		n    int
+	}{
+		{"a:gauge", 0},
+		{"b:gauge", 200},
+		{"c:gauge", 0},
+	}
+	for _, tc := range testCases {
+		if recs, err := ds.Query(tc.name, 0, 12000); err != nil || len(recs) != tc.n {
+			t.Error(tc.name, "has", len(recs), "records:", err)
+		}
+	}
+
+	// A snapshot taken before keeps reading the deleted files
+	if recs, err := s.query(0, 12000); err != nil || len(recs) != 100 {
+		t.Error("Snapshot returned", len(recs), "records:", err)
+	}
+
+	// All channels and sketches of a series are renamed together
+	for _, ch := range []string{"timer-min", "timer-max"} {
+		ds.Insert("t#host:a:"+ch, Record{Ts: 60, Value: 1})
+	}
+	ds.InsertSketch("t#host:a:timer-digest", Sketch{Ts: 60, Data: []byte{1}})
+	if err := ds.Rename("t#host:a", "b"); err == nil {
+		t.Error("Renamed to an existing series")
+	}
+	if err := ds.Rename("t#host:a", "u#env:x,host:a"); err != nil {
+		t.Fatal(err)
+	}
+	names, _ := ds.ListNames("[tu]*")
+	if sort.Strings(names); !reflect.DeepEqual(names, []string{"u#env:x,host:a:timer-max", "u#env:x,host:a:timer-min"}) {
+		t.Error("ListNames returned", names)
+	}
+	if sk, err := ds.QuerySketches("u#env:x,host:a:timer-digest", 0, 60, 60); err != nil || len(sk) != 1 {
+		t.Error("Sketches renamed:", sk, err)
+	}
+}
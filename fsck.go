@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// fsckMain runs the fsck subcommand and returns the exit status: 0 if the
+// data directory is consistent, 1 if problems were found and 2 if the
+// check failed.
+func fsckMain(args []string) int {
+	var dataDir string
+	var repair bool
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	fs.StringVar(&dataDir, "data", "", "  Data directory (must not be in use)")
+	fs.BoolVar(&repair, "repair", false, "Rebuild damaged series and truncate damaged files")
+	fs.Parse(args)
+
+	if len(dataDir) == 0 {
+		os.Stderr.Write([]byte("No data directory specified\n"))
+		return 2
+	}
+	n, err := fsck(dataDir, repair, os.Stdout)
+	if err != nil {
+		os.Stderr.Write([]byte(err.Error() + "\n"))
+		return 2
+	}
+	fmt.Println(n, "problems found")
+	if n > 0 {
+		return 1
+	}
+	return 0
+}
+
+type fsckChecker struct {
+	ds       *FsDatastore
+	repair   bool
+	out      io.Writer
+	problems int
+}
+
+// fsck checks the files of a data directory which is not in use and
+// writes every problem found to out. With repair set, damaged series are
+// rebuilt from the records which can still be read, and damaged WAL
+// segments, tail and live log files are truncated or removed. It returns
+// the number of problems found.
+func fsck(dir string, repair bool, out io.Writer) (int, error) {
+	c := &fsckChecker{ds: &FsDatastore{Dir: dir}, repair: repair, out: out}
+	if err := c.readResolution(); err != nil {
+		return 0, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	streams := make(map[string]bool)
+	var names []string
+	for _, fi := range files {
+		fn := fi.Name()
+		switch {
+		case strings.HasSuffix(fn, fsDsSwapExt):
+			st := &fsDsStream{ds: c.ds, name: fn[:len(fn)-len(fsDsSwapExt)]}
+			c.problem(st.name, Error("Interrupted rewrite"))
+			if c.repair {
+				c.fix(st.name, st.finishSwap())
+			}
+		case strings.HasSuffix(fn, ".tmp"):
+			// The files of an interrupted rewrite are renamed into place
+			name := strings.TrimSuffix(strings.TrimSuffix(fn[:len(fn)-4], ".blk"), ".bix")
+			if _, err := os.Stat(dir + string(os.PathSeparator) + name + fsDsSwapExt); err == nil {
+				continue
+			}
+			c.problem(fn, Error("Leftover temporary file"))
+			if c.repair {
+				c.fix(fn, os.Remove(dir+string(os.PathSeparator)+fn))
+			}
+		case strings.HasPrefix(fn, "wal."):
+			// Checked below
+		case strings.HasSuffix(fn, fsDsSketchExt):
+			c.checkSketch(fn)
+		case strings.Contains(fn, ":"):
+			for _, ext := range fsDsExts {
+				if strings.HasSuffix(fn, ext) && !streams[fn[:len(fn)-4]] {
+					streams[fn[:len(fn)-4]] = true
+					names = append(names, fn[:len(fn)-4])
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c.checkStream(name)
+	}
+
+	if err := c.checkWal(); err != nil {
+		return c.problems, err
+	}
+	c.checkTails()
+	c.checkLiveLog()
+	return c.problems, nil
+}
+
+func (c *fsckChecker) problem(what string, err error) {
+	c.problems++
+	fmt.Fprintln(c.out, what+":", err)
+}
+
+// fix reports the outcome of a repair.
+func (c *fsckChecker) fix(what string, err error) {
+	if !c.repair {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(c.out, what+": repair failed:", err)
+	} else {
+		fmt.Fprintln(c.out, what+": repaired")
+	}
+}
+
+func (c *fsckChecker) readResolution() error {
+	c.ds.res = 60
+	buff, err := ioutil.ReadFile(c.ds.resolutionFile())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	res, err := strconv.ParseInt(strings.TrimSpace(string(buff)), 10, 64)
+	if err != nil || res <= 0 {
+		return Error("Invalid resolution file")
+	}
+	c.ds.res = res
+	return nil
+}
+
+// checkStream validates the files of a stream. A damaged stream is
+// rewritten with the records which can be read.
+func (c *fsckChecker) checkStream(name string) {
+	st := &fsDsStream{ds: c.ds, name: name, res: c.ds.streamRes(name)}
+	_, err := os.Stat(st.path() + ".idx")
+	legacy := err == nil
+
+	var recs []fsDsRecord
+	if legacy {
+		recs, err = c.readLegacy(st)
+	} else {
+		recs, err = c.readBlocks(st)
+	}
+	if err == nil {
+		return
+	}
+	c.problem(name, err)
+	if !c.repair {
+		return
+	}
+
+	err = st.rewrite(recs)
+	for _, ext := range []string{".dat", ".idx"} {
+		if err == nil && legacy {
+			if err = os.Remove(st.path() + ext); os.IsNotExist(err) {
+				err = nil
+			}
+		}
+	}
+	c.fix(name, err)
+	if err == nil {
+		fmt.Fprintln(c.out, name+":", len(recs), "records kept")
+	}
+}
+
+// readBlocks reads the records of the blocks in order, skipping damaged
+// blocks if the index tells where the next one starts. The first problem
+// found is returned along with the records.
+func (c *fsckChecker) readBlocks(st *fsDsStream) ([]fsDsRecord, error) {
+	var problem error
+	report := func(err error) {
+		if problem == nil {
+			problem = err
+		}
+	}
+	dat, err := ioutil.ReadFile(st.path() + ".blk")
+	if err != nil {
+		report(err)
+	}
+	idx, err := ioutil.ReadFile(st.path() + ".bix")
+	if err != nil {
+		report(err)
+	}
+	if len(idx)%fsDsISize != 0 {
+		report(Error("Invalid index size"))
+		idx = idx[:len(idx)-len(idx)%fsDsISize]
+	}
+
+	le := binary.LittleEndian
+	var index []int64
+	for k := 0; k < len(idx); k += fsDsISize {
+		index = append(index, int64(le.Uint64(idx[k:])), int64(le.Uint64(idx[k+8:])))
+	}
+
+	var recs []fsDsRecord
+	var blocks []int64
+	last := int64(math.MinInt64)
+	for pos := int64(0); pos < int64(len(dat)); {
+		var b []fsDsRecord
+		var err error = Error("Block truncated")
+		if pos+fsDsBlockHeader <= int64(len(dat)) {
+			if end := pos + blockSize(dat[pos:]); end <= int64(len(dat)) {
+				b, err = decodeBlock(dat[pos:end], st.res)
+			}
+		}
+		if err != nil {
+			report(Error("Damaged block at " + strconv.FormatInt(pos, 10) + ": " + err.Error()))
+			next := int64(-1)
+			for k := 1; k < len(index); k += 2 {
+				if index[k] > pos {
+					next = index[k]
+					break
+				}
+			}
+			if next == -1 {
+				// Keep what load recovers of a torn last block
+				if len(blocks) == len(index)-2 && index[len(index)-1] == pos {
+					b, _ = decodeRecords(dat[pos:], st.res)
+				}
+				for _, r := range b {
+					if r.Ts%st.res == 0 && r.Ts > last {
+						recs = append(recs, r)
+						last = r.Ts
+					}
+				}
+				if len(b) > 0 {
+					blocks = append(blocks, b[0].Ts, pos)
+				}
+				break
+			}
+			pos = next
+			continue
+		}
+
+		blocks = append(blocks, b[0].Ts, pos)
+		for _, r := range b {
+			if r.Ts%st.res != 0 || r.Ts <= last {
+				report(Error("Record out of order: " + strconv.FormatInt(r.Ts, 10)))
+				continue
+			}
+			recs = append(recs, r)
+			last = r.Ts
+		}
+		pos += blockSize(dat[pos:])
+	}
+
+	if len(blocks) != len(index) {
+		report(Error("Index doesn't match the blocks"))
+	} else {
+		for i := range blocks {
+			if blocks[i] != index[i] {
+				report(Error("Index doesn't match the blocks"))
+				break
+			}
+		}
+	}
+	return recs, problem
+}
+
+// readLegacy reads the records of the original file format, skipping
+// invalid index entries.
+func (c *fsckChecker) readLegacy(st *fsDsStream) ([]fsDsRecord, error) {
+	var problem error
+	report := func(err error) {
+		if problem == nil {
+			problem = err
+		}
+	}
+	idx, err := ioutil.ReadFile(st.path() + ".idx")
+	if err != nil {
+		report(err)
+	}
+	dat, err := ioutil.ReadFile(st.path() + ".dat")
+	if err != nil {
+		report(err)
+	}
+	if len(idx)%fsDsISize != 0 || len(dat)%8 != 0 {
+		report(Error("Invalid file size"))
+		idx, dat = idx[:len(idx)-len(idx)%fsDsISize], dat[:len(dat)-len(dat)%8]
+	}
+
+	le := binary.LittleEndian
+	var recs []fsDsRecord
+	last := int64(math.MinInt64)
+	for k := 0; k < len(idx); k += fsDsISize {
+		ts, pos, end := int64(le.Uint64(idx[k:])), int64(le.Uint64(idx[k+8:])), int64(len(dat))
+		if k+fsDsISize < len(idx) {
+			end = int64(le.Uint64(idx[k+fsDsISize+8:]))
+		}
+		if ts%st.res != 0 || pos < 0 || pos%8 != 0 || pos > end || end > int64(len(dat)) {
+			report(Error("Invalid index data at entry " + strconv.Itoa(k/fsDsISize)))
+			continue
+		}
+		for ; pos < end; pos, ts = pos+8, ts+st.res {
+			if ts <= last {
+				report(Error("Record out of order: " + strconv.FormatInt(ts, 10)))
+				continue
+			}
+			recs = append(recs, fsDsRecord{Ts: ts, Value: math.Float64frombits(le.Uint64(dat[pos:]))})
+			last = ts
+		}
+	}
+	return recs, problem
+}
+
+// checkSketch rewrites a sketch file whose last sketch is cut short or
+// whose sketches are out of order with the valid ones, and removes an
+// unreadable one.
+func (c *fsckChecker) checkSketch(fn string) {
+	path := c.ds.Dir + string(os.PathSeparator) + fn
+	sf, err := openSketchFile(path, os.O_RDONLY)
+	if err != nil {
+		c.problem(fn, err)
+		if c.repair {
+			c.fix(fn, os.Remove(path))
+		}
+		return
+	}
+	defer sf.close()
+	fi, err := sf.f.Stat()
+	if err != nil {
+		c.problem(fn, err)
+		return
+	}
+	all, err := sf.read(0, math.MaxInt64)
+	if err != nil {
+		c.problem(fn, err)
+		return
+	}
+
+	var problem error
+	if fi.Size() != sf.offset(sf.n) {
+		problem = Error("Sketch truncated")
+	}
+	res, kept := c.ds.streamRes(fn[:len(fn)-len(fsDsSketchExt)]), all[:0]
+	for _, s := range all {
+		if s.Ts%res != 0 || len(kept) > 0 && s.Ts <= kept[len(kept)-1].Ts {
+			problem = Error("Sketch out of order: " + strconv.FormatInt(s.Ts, 10))
+			continue
+		}
+		kept = append(kept, s)
+	}
+	if problem != nil {
+		c.problem(fn, problem)
+		if c.repair {
+			c.fix(fn, writeSketchFile(path, sf.size, kept, true))
+		}
+	}
+}
+
+// checkWal truncates damaged WAL segments after their last valid record.
+func (c *fsckChecker) checkWal() error {
+	w := &fsDsWal{dir: c.ds.Dir}
+	segs, err := w.segments()
+	if err != nil {
+		return err
+	}
+	for _, seq := range segs {
+		size, err := w.read(seq, func(uint32, string, fsDsRecord) {})
+		if err == errWalDamaged {
+			fn := "wal." + strconv.FormatInt(seq, 10)
+			c.problem(fn, err)
+			if c.repair {
+				c.fix(fn, os.Truncate(w.path(seq), size))
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTails rewrites a damaged tail file with the tails which can be
+// read.
+func (c *fsckChecker) checkTails() {
+	tails, err := readTailFile(c.ds.tailFile())
+	if err == nil || os.IsNotExist(err) {
+		return
+	}
+	c.problem("tail_data", err)
+	if c.repair {
+		c.fix("tail_data", writeTailFile(c.ds.tailFile(), tails))
+	}
+}
+
+func writeTailFile(fn string, tails []fsDsTail) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w, le := bufio.NewWriter(f), binary.LittleEndian
+
+	binary.Write(w, le, int64(len(tails)))
+	for _, t := range tails {
+		binary.Write(w, le, int64(len(t.name)))
+		binary.Write(w, le, int64(len(t.tail)))
+		w.WriteString(t.name)
+		binary.Write(w, le, t.tail)
+	}
+	return w.Flush()
+}
+
+// checkLiveLog removes an unreadable live log and drops the invalid
+// entries of a readable one.
+func (c *fsckChecker) checkLiveLog() {
+	fn := c.ds.Dir + string(os.PathSeparator) + "live_log"
+	lld := new(LiveLogData)
+	err := lld.ReadFrom(fn)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		c.problem("live_log", err)
+		if c.repair {
+			c.fix("live_log", os.Remove(fn))
+		}
+		return
+	}
+
+	entries := lld.entries[:0]
+	for _, e := range lld.entries {
+		if err := e.check(); err != nil {
+			c.problem("live_log", Error(err.Error()+": "+string(e.name)))
+		} else {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) < len(lld.entries) && c.repair {
+		lld.entries = entries
+		c.fix("live_log", lld.WriteTo(fn))
+	}
+}
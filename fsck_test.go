@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFsck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var recs []fsDsRecord
+	for ts := int64(60); ts <= 3*fsDsBlockRecords*60; ts += 60 {
+		recs = append(recs, fsDsRecord{Ts: ts, Value: float64(ts % 7)})
+	}
+	ds := &FsDatastore{Dir: dir, NoSync: true, res: 60}
+	for _, name := range []string{"a:gauge", "b:gauge"} {
+		st := &fsDsStream{ds: ds, name: name, res: 60}
+		if err := st.rewrite(recs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// c has a torn last block
+	c := &fsDsStream{ds: ds, name: "c:gauge", res: 60}
+	if err := c.rewrite(recs[:fsDsBlockRecords+10]); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(c.path() + ".blk"); err != nil || os.Truncate(c.path()+".blk", fi.Size()-3) != nil {
+		t.Fatal("Truncating c failed")
+	}
+
+	// Damage the second block of a and the index of b
+	idx, err := ioutil.ReadFile(dir + "/a:gauge.bix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := int64(binary.LittleEndian.Uint64(idx[fsDsISize+8:]))
+	f, err := os.OpenFile(dir+"/a:gauge.blk", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, pos+fsDsBlockHeader+8)
+	f.Close()
+	if err := os.Truncate(dir+"/b:gauge.bix", 20); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range []int{3, 3, 0} {
+		n, err := fsck(dir, i == 1, ioutil.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != expected {
+			t.Fatal("Run", i, "found", n, "problems, expected", expected)
+		}
+	}
+
+	st := &fsDsStream{ds: ds, name: "a:gauge", res: 60}
+	if err := st.openFiles(false); err != nil {
+		t.Fatal(err)
+	}
+	defer st.closeFiles()
+	r, err := st.records()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != len(recs)-fsDsBlockRecords || r[fsDsBlockRecords] != recs[2*fsDsBlockRecords] {
+		t.Error("Unexpected records after repair:", len(r))
+	}
+
+	if err := c.openFiles(false); err != nil {
+		t.Fatal(err)
+	}
+	defer c.closeFiles()
+	if r, err = c.records(); err != nil {
+		t.Fatal(err)
+	}
+	if len(r) <= fsDsBlockRecords || len(r) >= fsDsBlockRecords+10 || r[len(r)-1] != recs[len(r)-1] {
+		t.Error("Unexpected records of the torn block after repair:", len(r))
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// QueryFunc is a function applied to the archive data of a query, like
+// "movingAverage(900)". Functions are chained in a pipeline separated by
+// "|", e.g. "rate|movingAverage(900)", and applied to each channel.
+type QueryFunc struct {
+	Name string
+	Args []float64
+}
+
+type queryFunc struct {
+	minArgs, maxArgs int
+	// lead returns the number of values before the first output value
+	// the function needs.
+	lead func(args []float64, gran int64) (int64, error)
+	// apply returns the output of a channel, lead values shorter than
+	// the input.
+	apply func(in, args []float64, gran int64) []float64
+}
+
+var queryFuncs = map[string]queryFunc{
+	// derivative returns the difference to the previous value
+	"derivative": {0, 0, constLead(1), func(in, args []float64, gran int64) []float64 {
+		out := make([]float64, len(in)-1)
+		for i := range out {
+			out[i] = in[i+1] - in[i]
+		}
+		return out
+	}},
+	// rate divides by the granularity, which turns counters into values
+	// per second
+	"rate": {0, 0, constLead(0), func(in, args []float64, gran int64) []float64 {
+		return mapValues(in, func(v float64) float64 { return v / float64(gran) })
+	}},
+	// movingAverage returns the average of the values in the preceding
+	// window of seconds, ignoring missing values
+	"movingAverage": {1, 1, windowLead, func(in, args []float64, gran int64) []float64 {
+		n := int(args[0]) / int(gran)
+		out := make([]float64, len(in)-n+1)
+		for i := range out {
+			var sum, cnt float64
+			for _, v := range in[i : i+n] {
+				if !math.IsNaN(v) {
+					sum += v
+					cnt++
+				}
+			}
+			out[i] = sum / cnt
+		}
+		return out
+	}},
+	// cumulativeSum returns the sum of the values so far, ignoring missing
+	// values
+	"cumulativeSum": {0, 0, constLead(0), func(in, args []float64, gran int64) []float64 {
+		out, sum := make([]float64, len(in)), 0.0
+		for i, v := range in {
+			if !math.IsNaN(v) {
+				sum += v
+			}
+			out[i] = sum
+		}
+		return out
+	}},
+	"scale": {1, 1, constLead(0), func(in, args []float64, gran int64) []float64 {
+		return mapValues(in, func(v float64) float64 { return v * args[0] })
+	}},
+	"offset": {1, 1, constLead(0), func(in, args []float64, gran int64) []float64 {
+		return mapValues(in, func(v float64) float64 { return v + args[0] })
+	}},
+	// fillGaps replaces missing values with the given value, or else with
+	// the previous value
+	"fillGaps": {0, 1, constLead(0), func(in, args []float64, gran int64) []float64 {
+		out, last := make([]float64, len(in)), math.NaN()
+		for i, v := range in {
+			if !math.IsNaN(v) {
+				last = v
+			} else if len(args) > 0 {
+				v = args[0]
+			} else {
+				v = last
+			}
+			out[i] = v
+		}
+		return out
+	}},
+	// timeShift returns the values of the given number of seconds earlier.
+	// It is applied to the query by LogFunctions.
+	"timeShift": {1, 1, shiftLead, func(in, args []float64, gran int64) []float64 {
+		return in
+	}},
+}
+
+func constLead(n int64) func([]float64, int64) (int64, error) {
+	return func([]float64, int64) (int64, error) { return n, nil }
+}
+
+func windowLead(args []float64, gran int64) (int64, error) {
+	w := int64(args[0])
+	if float64(w) != args[0] || w <= 0 || w%gran != 0 {
+		return 0, Error("Window must be a positive multiple of the granularity")
+	}
+	return w/gran - 1, nil
+}
+
+func shiftLead(args []float64, gran int64) (int64, error) {
+	s := int64(args[0])
+	if float64(s) != args[0] || s%gran != 0 {
+		return 0, Error("Time shift must be a multiple of the granularity")
+	}
+	return 0, nil
+}
+
+func mapValues(in []float64, f func(float64) float64) []float64 {
+	out := make([]float64, len(in))
+	for i, v := range in {
+		out[i] = f(v)
+	}
+	return out
+}
+
+// ParseFunctions parses a pipeline of functions, e.g.
+// "rate|movingAverage(900)".
+func ParseFunctions(s string) ([]QueryFunc, error) {
+	var r []QueryFunc
+	if strings.TrimSpace(s) == "" {
+		return r, nil
+	}
+	for _, f := range strings.Split(s, "|") {
+		f = strings.TrimSpace(f)
+		fn := QueryFunc{Name: f}
+		if i := strings.IndexByte(f, '('); i != -1 {
+			if !strings.HasSuffix(f, ")") {
+				return nil, Error("Invalid function: " + f)
+			}
+			fn.Name = strings.TrimSpace(f[:i])
+			if args := strings.TrimSpace(f[i+1 : len(f)-1]); args != "" {
+				for _, a := range strings.Split(args, ",") {
+					v, err := strconv.ParseFloat(strings.TrimSpace(a), 64)
+					if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+						return nil, Error("Invalid argument of " + fn.Name + ": " + a)
+					}
+					fn.Args = append(fn.Args, v)
+				}
+			}
+		}
+		def, ok := queryFuncs[fn.Name]
+		if !ok {
+			return nil, Error("No such function: " + fn.Name)
+		}
+		if len(fn.Args) < def.minArgs || len(fn.Args) > def.maxArgs {
+			return nil, Error("Wrong number of arguments: " + fn.Name)
+		}
+		r = append(r, fn)
+	}
+	return r, nil
+}
+
+// LogFunctions returns the archive data like Log, with the functions
+// applied in order. The data the functions need before from is queried
+// too.
+func (srv *Server) LogFunctions(name, tags string, chs []string, from, length, gran int64, fns []QueryFunc) ([][]float64, error) {
+	if gran < 1 {
+		return nil, Error("Granularity must be positive")
+	}
+	var lead, shift int64
+	for _, fn := range fns {
+		def, ok := queryFuncs[fn.Name]
+		if !ok {
+			return nil, Error("No such function: " + fn.Name)
+		}
+		l, err := def.lead(fn.Args, gran)
+		if err != nil {
+			return nil, err
+		}
+		if fn.Name == "timeShift" {
+			shift += int64(fn.Args[0])
+		}
+		lead += l
+	}
+
+	data, err := srv.Log(name, tags, chs, from-shift-lead*gran, length+lead, gran)
+	if err != nil || len(fns) == 0 {
+		return data, err
+	}
+	if int64(len(data)) <= lead {
+		return [][]float64{}, nil
+	}
+
+	cols := make([][]float64, len(chs))
+	for c := range cols {
+		cols[c] = make([]float64, len(data))
+		for i, values := range data {
+			cols[c][i] = values[c]
+		}
+	}
+	for _, fn := range fns {
+		for c := range cols {
+			cols[c] = queryFuncs[fn.Name].apply(cols[c], fn.Args, gran)
+		}
+	}
+
+	output := make([][]float64, len(data)-int(lead))
+	for i := range output {
+		output[i] = make([]float64, len(cols))
+		for c, col := range cols {
+			output[i][c] = col[i]
+		}
+	}
+	return output, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseFunctions(t *testing.T) {
+	var testCases = []struct {
+		s   string
+		fns []QueryFunc
+		ok  bool
+	}{
+		{"", nil, true},
+		{"rate", []QueryFunc{{"rate", nil}}, true},
+		{"rate | movingAverage(900)", []QueryFunc{{"rate", nil}, {"movingAverage", []float64{900}}}, true},
+		{"fillGaps()|scale(-0.5)", []QueryFunc{{"fillGaps", nil}, {"scale", []float64{-0.5}}}, true},
+		{"movingAverage", nil, false},
+		{"scale(1,2)", nil, false},
+		{"offset(x)", nil, false},
+		{"offset(1", nil, false},
+		{"rate|", nil, false},
+		{"sum", nil, false},
+	}
+
+	for _, tc := range testCases {
+		fns, err := ParseFunctions(tc.s)
+		if (err == nil) != tc.ok || !reflect.DeepEqual(fns, tc.fns) {
+			t.Error("Incorrect result:", tc.s)
+			t.Error("Expected:", tc.fns, tc.ok)
+			t.Error("Returned:", fns, err)
+		}
+	}
+}
+
+func TestLogFunctions(t *testing.T) {
+	ds := &MemDatastore{Interval: 1}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	srv := &Server{Ds: ds}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	from := time.Now().Unix() - 60
+	for ts := from - 10; ts < from+10; ts++ {
+		if ts != from+2 {
+			ds.Insert("foo:avg", Record{Ts: ts + 1, Value: float64(ts - from)})
+			ds.Insert("foo:avg-cnt", Record{Ts: ts + 1, Value: 1})
+		}
+	}
+
+	nan := math.NaN()
+	var testCases = []struct {
+		fns    string
+		result []float64
+	}{
+		{"", []float64{0, 1, nan, 3}},
+		{"derivative", []float64{1, 1, nan, nan}},
+		{"movingAverage(3)", []float64{-1, 0, 0.5, 2}},
+		{"cumulativeSum", []float64{0, 1, 1, 4}},
+		{"scale(2)|offset(1)", []float64{1, 3, nan, 7}},
+		{"fillGaps", []float64{0, 1, 1, 3}},
+		{"fillGaps(0)", []float64{0, 1, 0, 3}},
+		{"timeShift(5)", []float64{-5, -4, -3, -2}},
+		{"timeShift(5)|derivative", []float64{1, 1, 1, 1}},
+	}
+
+	for _, tc := range testCases {
+		fns, err := ParseFunctions(tc.fns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := srv.LogFunctions("foo", "", []string{"avg"}, from, 4, 1, fns)
+		if err != nil {
+			t.Fatal(tc.fns, err)
+		}
+		if len(data) != len(tc.result) {
+			t.Fatal(tc.fns, "returned", data)
+		}
+		for i, values := range data {
+			v := values[0]
+			if v != tc.result[i] && !(math.IsNaN(v) && math.IsNaN(tc.result[i])) {
+				t.Error(tc.fns, "returned", data)
+				break
+			}
+		}
+	}
+
+	if r := queryFuncs["rate"].apply([]float64{4, nan}, nil, 2); r[0] != 2 || !math.IsNaN(r[1]) {
+		t.Error("rate returned", r)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+// Blocks are stored with a header of the first timestamp, the number of
+// records and the size of the payload, followed by the records compressed
+// as described in "Gorilla: A Fast, Scalable, In-Memory Time Series
+// Database": delta-of-delta timestamps (in units of the resolution) and
+// XORed float values.
+const fsDsBlockHeader = 16
+
+type bitWriter struct {
+	buf  []byte
+	free uint
+}
+
+func (w *bitWriter) write(v uint64, n uint) {
+	for n > 0 {
+		if w.free == 0 {
+			w.buf = append(w.buf, 0)
+			w.free = 8
+		}
+		k := n
+		if k > w.free {
+			k = w.free
+		}
+		chunk := byte(v>>(n-k)) & byte(1<<k-1)
+		w.buf[len(w.buf)-1] |= chunk << (w.free - k)
+		w.free -= k
+		n -= k
+	}
+}
+
+type bitReader struct {
+	buf []byte
+	pos uint
+}
+
+func (r *bitReader) read(n uint) (uint64, error) {
+	if r.pos+n > uint(len(r.buf))*8 {
+		return 0, Error("Block data truncated")
+	}
+	var v uint64
+	for n > 0 {
+		b := r.buf[r.pos/8]
+		avail := 8 - r.pos%8
+		k := n
+		if k > avail {
+			k = avail
+		}
+		chunk := (b >> (avail - k)) & byte(1<<k-1)
+		v = v<<k | uint64(chunk)
+		r.pos += k
+		n -= k
+	}
+	return v, nil
+}
+
+var dodBuckets = []struct {
+	prefix, plen, bits uint
+}{
+	{0x2, 2, 7},
+	{0x6, 3, 9},
+	{0xe, 4, 12},
+	{0xf, 4, 64},
+}
+
+func encodeBlock(recs []fsDsRecord, res int64) []byte {
+	w := &bitWriter{}
+	w.write(math.Float64bits(recs[0].Value), 64)
+
+	var prevDelta int64
+	prevBits, prevLead, prevTrail := math.Float64bits(recs[0].Value), uint(65), uint(0)
+	for i := 1; i < len(recs); i++ {
+		delta := (recs[i].Ts - recs[i-1].Ts) / res
+		dod := delta - prevDelta
+		prevDelta = delta
+		if dod == 0 {
+			w.write(0, 1)
+		} else {
+			for _, b := range dodBuckets {
+				if b.bits == 64 || (dod >= -1<<(b.bits-1) && dod < 1<<(b.bits-1)) {
+					w.write(uint64(b.prefix), b.plen)
+					w.write(uint64(dod), b.bits)
+					break
+				}
+			}
+		}
+
+		vbits := math.Float64bits(recs[i].Value)
+		xor := vbits ^ prevBits
+		prevBits = vbits
+		if xor == 0 {
+			w.write(0, 1)
+			continue
+		}
+		lead, trail := uint(bits.LeadingZeros64(xor)), uint(bits.TrailingZeros64(xor))
+		if lead > 31 {
+			lead = 31
+		}
+		if prevLead <= lead && prevTrail <= trail {
+			w.write(0x2, 2)
+			w.write(xor>>prevTrail, 64-prevLead-prevTrail)
+		} else {
+			sig := 64 - lead - trail
+			w.write(0x3, 2)
+			w.write(uint64(lead), 5)
+			w.write(uint64(sig&63), 6)
+			w.write(xor>>trail, sig)
+			prevLead, prevTrail = lead, trail
+		}
+	}
+
+	data := make([]byte, fsDsBlockHeader, fsDsBlockHeader+len(w.buf))
+	binary.LittleEndian.PutUint64(data[0:], uint64(recs[0].Ts))
+	binary.LittleEndian.PutUint32(data[8:], uint32(len(recs)))
+	binary.LittleEndian.PutUint32(data[12:], uint32(len(w.buf)))
+	return append(data, w.buf...)
+}
+
+// blockSize returns the size of the block starting with header.
+func blockSize(header []byte) int64 {
+	return fsDsBlockHeader + int64(binary.LittleEndian.Uint32(header[12:]))
+}
+
+func decodeBlock(data []byte, res int64) ([]fsDsRecord, error) {
+	if len(data) < fsDsBlockHeader || int64(len(data)) != blockSize(data) {
+		return nil, Error("Invalid block size")
+	}
+	n := binary.LittleEndian.Uint32(data[8:])
+	if n > 0 && uint64(n-1)*2 > uint64(len(data)-fsDsBlockHeader)*8 {
+		return nil, Error("Invalid block data")
+	}
+	recs, err := decodeRecords(data, res)
+	if err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+// decodeRecords decodes the records of the block in data, which may be
+// cut short. The records decoded before an error are returned with it.
+func decodeRecords(data []byte, res int64) ([]fsDsRecord, error) {
+	if len(data) < fsDsBlockHeader {
+		return nil, Error("Invalid block size")
+	}
+	ts := int64(binary.LittleEndian.Uint64(data[0:]))
+	n := binary.LittleEndian.Uint32(data[8:])
+	if n == 0 {
+		return nil, Error("Empty block")
+	}
+	r := &bitReader{buf: data[fsDsBlockHeader:]}
+	if size := blockSize(data) - fsDsBlockHeader; size < int64(len(r.buf)) {
+		r.buf = r.buf[:size]
+	}
+
+	vbits, err := r.read(64)
+	if err != nil {
+		return nil, err
+	}
+	// Every record but the first takes at least two bits
+	if max := uint64(len(r.buf))*4 + 1; uint64(n) > max {
+		n = uint32(max)
+	}
+	recs := make([]fsDsRecord, 1, n)
+	recs[0] = fsDsRecord{Ts: ts, Value: math.Float64frombits(vbits)}
+
+	var delta int64
+	var lead, trail uint
+	for i := uint32(1); i < n; i++ {
+		var dod int64
+		for plen := uint(0); plen < 4; plen++ {
+			b, err := r.read(1)
+			if err != nil {
+				return recs, err
+			}
+			if b == 0 {
+				if plen > 0 {
+					nbits := dodBuckets[plen-1].bits
+					v, err := r.read(nbits)
+					if err != nil {
+						return recs, err
+					}
+					dod = int64(v<<(64-nbits)) >> (64 - nbits)
+				}
+				break
+			}
+			if plen == 3 {
+				v, err := r.read(64)
+				if err != nil {
+					return recs, err
+				}
+				dod = int64(v)
+			}
+		}
+		delta += dod
+		ts += delta * res
+
+		b, err := r.read(1)
+		if err != nil {
+			return recs, err
+		}
+		if b == 1 {
+			if b, err = r.read(1); err != nil {
+				return recs, err
+			}
+			if b == 1 {
+				l, err := r.read(5)
+				if err != nil {
+					return recs, err
+				}
+				sig, err := r.read(6)
+				if err != nil {
+					return recs, err
+				}
+				if sig == 0 {
+					sig = 64
+				}
+				if uint(l)+uint(sig) > 64 {
+					return recs, Error("Invalid block data")
+				}
+				lead, trail = uint(l), 64-uint(l)-uint(sig)
+			}
+			xor, err := r.read(64 - lead - trail)
+			if err != nil {
+				return recs, err
+			}
+			vbits ^= xor << trail
+		}
+		recs = append(recs, fsDsRecord{Ts: ts, Value: math.Float64frombits(vbits)})
+	}
+	return recs, nil
+}
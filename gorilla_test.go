@@ -0,0 +1,60 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestGorillaBlock(t *testing.T) {
+	var testCases = [][]fsDsRecord{
+		{{60, 1}},
+		{{60, 1}, {120, 1}, {180, 1}, {240, 2}},
+		{{-120, 0}, {-60, math.NaN()}, {0, math.Inf(1)}, {60, -0.5}},
+		{{60, 1.5}, {600, 1.5}, {660, 3.25}, {60 * 100000, 1e300}, {60*100000 + 60, -1e-300}},
+		{{60, 0}, {120, math.Float64frombits(1)}, {180, math.Float64frombits(1 << 63)}},
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	var long []fsDsRecord
+	for i, ts := 0, int64(0); i < 1000; i++ {
+		ts += 60 * (1 + rnd.Int63n(3))
+		if rnd.Intn(10) == 0 {
+			ts += 60 * rnd.Int63n(1<<20)
+		}
+		long = append(long, fsDsRecord{ts, math.Floor(rnd.NormFloat64()*100) / 8})
+	}
+	testCases = append(testCases, long)
+
+	for _, recs := range testCases {
+		data := encodeBlock(recs, 60)
+		r, err := decodeBlock(data, 60)
+		if err != nil {
+			t.Error("Failed to decode:", recs, err)
+			continue
+		}
+		if len(r) != len(recs) {
+			t.Error("Incorrect length:", len(r), len(recs))
+			continue
+		}
+		for i := range r {
+			if r[i].Ts != recs[i].Ts || math.Float64bits(r[i].Value) != math.Float64bits(recs[i].Value) {
+				t.Error("Incorrect record:", i, r[i], recs[i])
+				break
+			}
+		}
+	}
+
+	gauge := make([]fsDsRecord, 240)
+	for i := range gauge {
+		gauge[i] = fsDsRecord{int64(i+1) * 60, 42}
+	}
+	if n := len(encodeBlock(gauge, 60)); n > fsDsBlockHeader+8+64 {
+		t.Error("Constant series not compressed:", n)
+	}
+
+	data := encodeBlock(long, 60)
+	if _, err := decodeBlock(data[:len(data)-1], 60); err == nil {
+		t.Error("Truncated block should have failed")
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The Graphite render API maps the archive onto the Graphite metric tree:
+// the path of a channel is the metric name followed by the channel, with
+// dots in the channel replaced by underscores, e.g. "web.requests.counter"
+// or "web.latency.hist-0_5". Tagged series are rendered with the Graphite
+// tag syntax, e.g. "web.requests.counter;host=a", but are not listed by
+// /metrics/find.
+
+type graphitePath struct {
+	path    string
+	metric  string
+	tags    string
+	channel string
+}
+
+type graphitePaths []graphitePath
+
+func (s graphitePaths) Len() int           { return len(s) }
+func (s graphitePaths) Less(i, j int) bool { return s[i].path < s[j].path }
+func (s graphitePaths) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type graphiteSeries struct {
+	Target     string          `json:"target"`
+	Datapoints []graphitePoint `json:"datapoints"`
+}
+
+// graphitePoint is encoded as [value, timestamp].
+type graphitePoint struct {
+	value float64
+	ts    int64
+}
+
+func (p graphitePoint) MarshalJSON() ([]byte, error) {
+	v, _ := jsonFloat(p.value).MarshalJSON()
+	return []byte("[" + string(v) + "," + strconv.FormatInt(p.ts, 10) + "]"), nil
+}
+
+type graphiteNode struct {
+	Text          string   `json:"text"`
+	Id            string   `json:"id"`
+	Leaf          int      `json:"leaf"`
+	Expandable    int      `json:"expandable"`
+	AllowChildren int      `json:"allowChildren"`
+	Context       struct{} `json:"context"`
+}
+
+// serveGraphiteRender returns the data of the targets in the JSON format
+// of Graphite. Of the Graphite functions, alias, aliasByNode, sumSeries
+// and the query functions are supported; the granularity is the archive
+// resolution, or coarser to return at most maxDataPoints values. At most
+// GraphiteMaxSeries series may be selected.
+func (ha *HttpApi) serveGraphiteRender(rw http.ResponseWriter, rq *http.Request) {
+	form, err := ha.graphiteForm(rw, rq)
+	if err != nil {
+		ha.sendJSONError(err, rw)
+		return
+	}
+	if f := form.Get("format"); f != "" && f != "json" {
+		ha.sendJSONError(Error("Unsupported format: "+f), rw)
+		return
+	}
+
+	now := time.Now().Unix()
+	from, err := parseGraphiteTime(form.Get("from"), "-24h", now)
+	if err != nil {
+		ha.sendJSONError(err, rw)
+		return
+	}
+	until, err := parseGraphiteTime(form.Get("until"), "now", now)
+	if err != nil {
+		ha.sendJSONError(err, rw)
+		return
+	}
+	if until <= from {
+		ha.sendJSONError(Error("Empty time range"), rw)
+		return
+	}
+
+	_, gran := ha.Server.Resolutions()
+	if mdp, err := strconv.ParseInt(form.Get("maxDataPoints"), 10, 64); err == nil && mdp > 0 {
+		if n := (until - from + mdp - 1) / mdp; n > gran {
+			gran = (n + gran - 1) / gran * gran
+		}
+	}
+	from -= from % gran
+	length := (until - from + gran - 1) / gran
+
+	result := make([]graphiteSeries, 0)
+	ev := &graphiteEval{ha: ha, gran: gran}
+	for _, target := range form["target"] {
+		e, err := parseGraphiteTarget(target)
+		if err != nil {
+			ha.sendJSONError(err, rw)
+			return
+		}
+		series, err := ev.eval(e, from, length)
+		if err != nil {
+			ha.sendJSONError(err, rw)
+			return
+		}
+		for _, r := range series {
+			s := graphiteSeries{Target: r.name, Datapoints: make([]graphitePoint, len(r.values))}
+			for i, v := range r.values {
+				s.Datapoints[i] = graphitePoint{v, from + int64(i)*gran}
+			}
+			result = append(result, s)
+		}
+	}
+	ha.sendJSON(result, rw)
+}
+
+// serveGraphiteFind lists the nodes of the metric tree matching query.
+func (ha *HttpApi) serveGraphiteFind(rw http.ResponseWriter, rq *http.Request) {
+	form, err := ha.graphiteForm(rw, rq)
+	if err != nil {
+		ha.sendJSONError(err, rw)
+		return
+	}
+	query := form.Get("query")
+	if query == "" {
+		ha.sendJSONError(Error("No query"), rw)
+		return
+	}
+	if strings.Contains(query, ";") {
+		ha.sendJSONError(Error("Tags are not supported by find"), rw)
+		return
+	}
+
+	paths, err := ha.graphitePaths(query, true)
+	if err != nil {
+		ha.sendJSONError(err, rw)
+		return
+	}
+	n := len(strings.Split(query, "."))
+	nodes, index := make([]graphiteNode, 0), make(map[string]int)
+	for _, p := range paths {
+		segs := strings.Split(p.path, ".")
+		id := strings.Join(segs[:n], ".")
+		k, ok := index[id]
+		if !ok {
+			k = len(nodes)
+			index[id] = k
+			nodes = append(nodes, graphiteNode{Text: segs[n-1], Id: id})
+		}
+		if len(segs) == n {
+			nodes[k].Leaf = 1
+		} else {
+			nodes[k].Expandable, nodes[k].AllowChildren = 1, 1
+		}
+	}
+	ha.sendJSON(nodes, rw)
+}
+
+func (ha *HttpApi) graphiteForm(rw http.ResponseWriter, rq *http.Request) (url.Values, error) {
+	if rq.Method == "POST" {
+		rq.Body = http.MaxBytesReader(rw, rq.Body, HttpMaxBodySize)
+	}
+	if err := rq.ParseForm(); err != nil {
+		return nil, Error("Invalid form data")
+	}
+	return rq.Form, nil
+}
+
+// graphitePaths returns the paths of the output channels matching target,
+// a path pattern optionally followed by tags, sorted by path. With prefix
+// set, the pattern only has to match the beginning of the path.
+func (ha *HttpApi) graphitePaths(target string, prefix bool) ([]graphitePath, error) {
+	s := strings.Split(target, ";")
+	pattern := s[0]
+	if strings.ContainsAny(pattern, "()") {
+		return nil, Error("Unsupported target: " + target)
+	}
+	for i, tag := range s[1:] {
+		s[i+1] = strings.Replace(tag, "=", ":", 1)
+	}
+	tags, err := ParseTags(strings.Join(s[1:], ","))
+	if err != nil {
+		return nil, err
+	}
+
+	// The literal beginning of the pattern up to its last dot, which may be
+	// the one before the channel, is the beginning of the metric name
+	literal := pattern
+	if i := strings.IndexAny(pattern, "*?[{"); i != -1 {
+		literal = pattern[:i]
+	}
+	if i := strings.LastIndex(literal, "."); i != -1 {
+		literal = literal[:i]
+	}
+	names, err := ha.Server.Ds.ListNames(escapePattern(ha.Server.Prefix+literal) + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	want := strings.Split(pattern, ".")
+	var r []graphitePath
+	for _, name := range names {
+		name = name[len(ha.Server.Prefix):]
+		i := strings.LastIndex(name, ":")
+		if i == -1 {
+			continue
+		}
+		series, ch := name[:i], name[i+1:]
+		if _, ok := channelType(ch); !ok {
+			continue
+		}
+		metric, t := splitSeriesName(series)
+		if t != tags {
+			continue
+		}
+		path := metric + "." + strings.Replace(ch, ".", "_", -1)
+		segs := strings.Split(path, ".")
+		if len(segs) < len(want) || (!prefix && len(segs) != len(want)) {
+			continue
+		}
+		if !matchGraphitePath(segs[:len(want)], want) {
+			continue
+		}
+		if len(t) > 0 {
+			for _, tag := range strings.Split(t, ",") {
+				path += ";" + strings.Replace(tag, ":", "=", 1)
+			}
+		}
+		r = append(r, graphitePath{path, metric, t, ch})
+	}
+	sort.Sort(graphitePaths(r))
+	return r, nil
+}
+
+// escapePattern quotes the characters of s which are special in the
+// patterns of ListNames.
+func escapePattern(s string) string {
+	var r []byte
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte("*?[\\", s[i]) != -1 {
+			r = append(r, '\\')
+		}
+		r = append(r, s[i])
+	}
+	return string(r)
+}
+
+func matchGraphitePath(segs, pattern []string) bool {
+	for i, seg := range segs {
+		if !matchGraphiteSegment(seg, pattern[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchGraphiteSegment matches a segment of a path against a segment of a
+// Graphite pattern, which may contain wildcards, character classes and
+// lists of alternatives in braces.
+func matchGraphiteSegment(seg, pattern string) bool {
+	i := strings.IndexByte(pattern, '{')
+	j := strings.IndexByte(pattern, '}')
+	if i != -1 && j > i {
+		for _, alt := range strings.Split(pattern[i+1:j], ",") {
+			if matchGraphiteSegment(seg, pattern[:i]+alt+pattern[j+1:]) {
+				return true
+			}
+		}
+		return false
+	}
+	m, err := filepath.Match(pattern, seg)
+	return err == nil && m
+}
+
+var graphiteUnits = []struct {
+	suffix string
+	mul    int64
+}{
+	{"seconds", 1},
+	{"second", 1},
+	{"sec", 1},
+	{"s", 1},
+	{"minutes", 60},
+	{"minute", 60},
+	{"min", 60},
+	{"hours", 3600},
+	{"hour", 3600},
+	{"h", 3600},
+	{"days", 86400},
+	{"day", 86400},
+	{"d", 86400},
+	{"weeks", 7 * 86400},
+	{"week", 7 * 86400},
+	{"w", 7 * 86400},
+	{"months", 30 * 86400},
+	{"month", 30 * 86400},
+	{"mon", 30 * 86400},
+	{"years", 365 * 86400},
+	{"year", 365 * 86400},
+	{"y", 365 * 86400},
+}
+
+// parseGraphiteTime parses the from and until parameters of the render
+// API: "now", a Unix timestamp or an offset from now such as "-6h" or
+// "now-30min". An empty string is replaced by def.
+func parseGraphiteTime(s, def string, now int64) (int64, error) {
+	if s == "" {
+		s = def
+	}
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ts, nil
+	}
+	s = strings.TrimPrefix(s, "now")
+	if s == "" {
+		return now, nil
+	}
+
+	sign := int64(1)
+	if s[0] == '-' {
+		sign = -1
+	} else if s[0] != '+' {
+		return 0, Error("Invalid time: " + s)
+	}
+	for _, u := range graphiteUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			n, err := strconv.ParseInt(s[1:len(s)-len(u.suffix)], 10, 64)
+			if err != nil || n < 0 {
+				continue
+			}
+			return now + sign*n*u.mul, nil
+		}
+	}
+	return 0, Error("Invalid time: " + s)
+}
@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestParseGraphiteTime(t *testing.T) {
+	var testCases = []struct {
+		s  string
+		ts int64
+		ok bool
+	}{
+		{"", 1000000 - 86400, true},
+		{"now", 1000000, true},
+		{"1400000000", 1400000000, true},
+		{"-30s", 1000000 - 30, true},
+		{"-5min", 1000000 - 300, true},
+		{"now-2h", 1000000 - 7200, true},
+		{"-1d", 1000000 - 86400, true},
+		{"-2weeks", 1000000 - 14*86400, true},
+		{"-1mon", 1000000 - 30*86400, true},
+		{"+1y", 1000000 + 365*86400, true},
+		{"-1x", 0, false},
+		{"1h", 0, false},
+		{"yesterday", 0, false},
+	}
+
+	for _, tc := range testCases {
+		ts, err := parseGraphiteTime(tc.s, "-24h", 1000000)
+		if (err == nil) != tc.ok || ts != tc.ts {
+			t.Error("Incorrect result:", tc.s)
+			t.Error("Expected:", tc.ts, tc.ok)
+			t.Error("Returned:", ts, err)
+		}
+	}
+}
+
+func TestMatchGraphiteSegment(t *testing.T) {
+	var testCases = []struct {
+		seg, pattern string
+		match        bool
+	}{
+		{"counter", "counter", true},
+		{"counter", "count", false},
+		{"counter", "c*", true},
+		{"counter", "c?unter", true},
+		{"counter", "[a-c]ounter", true},
+		{"counter", "{gauge,counter}", true},
+		{"counter", "{gauge,avg}", false},
+		{"avg-cnt", "avg{,-cnt}", true},
+		{"avg", "avg{,-cnt}", true},
+		{"avg", "[", false},
+	}
+
+	for _, tc := range testCases {
+		if matchGraphiteSegment(tc.seg, tc.pattern) != tc.match {
+			t.Error("Incorrect result:", tc.seg, tc.pattern)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+const GraphiteLineMaxSize = 4096
+
+type GraphiteType struct {
+	Pattern string
+	Type    MetricType
+}
+
+type GraphiteInjector struct {
+	Addr   string
+	Server *Server
+	Types  []GraphiteType
+	ls     lineServer
+}
+
+// ParseGraphiteTypes parses a comma separated list of pattern=type pairs,
+// e.g. "*.requests=c,*.latency=ms".
+func ParseGraphiteTypes(s string) ([]GraphiteType, error) {
+	var r []GraphiteType
+	for _, rule := range strings.Split(s, ",") {
+		kv := strings.SplitN(rule, "=", 2)
+		if len(kv) != 2 {
+			return nil, Error("Invalid type rule: " + rule)
+		}
+		typ := parseMetricType([]byte(kv[1]))
+		if typ == MetricType(-1) || typ == Set {
+			return nil, Error("Invalid metric type: " + kv[1])
+		}
+		if err := CheckMetricName(kv[0]); err != nil {
+			return nil, err
+		}
+		r = append(r, GraphiteType{Pattern: kv[0], Type: typ})
+	}
+	return r, nil
+}
+
+func (gi *GraphiteInjector) Start() error {
+	gi.ls.network, gi.ls.addr = "tcp", gi.Addr
+	gi.ls.maxLine, gi.ls.handle = GraphiteLineMaxSize, gi.inject
+	return gi.ls.start()
+}
+
+func (gi *GraphiteInjector) Stop() error {
+	return gi.ls.stop()
+}
+
+func (gi *GraphiteInjector) inject(line []byte) {
+	if len(strings.TrimSpace(string(line))) == 0 {
+		return
+	}
+	metric, ts, err := ParseGraphite(line)
+	if err != nil {
+		log.Println("GraphiteInjector.ParseGraphite:", err)
+		return
+	}
+	for _, gt := range gi.Types {
+		if MatchMetricName(metric.Name, gt.Pattern) {
+			metric.Type = gt.Type
+			break
+		}
+	}
+	if err := gi.Server.InjectAt(metric, ts); err != nil {
+		log.Println("Server.InjectAt:", err)
+	}
+}
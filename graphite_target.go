@@ -0,0 +1,284 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// GraphiteMaxSeries limits the series a render request may select.
+const GraphiteMaxSeries = 1000
+
+// graphiteExpr is a parsed render target: a path, a function call, a
+// number or a quoted string. text is the expression as written.
+type graphiteExpr struct {
+	text  string
+	fn    string
+	args  []graphiteExpr
+	isStr bool
+	isNum bool
+	num   float64
+}
+
+// parseGraphiteTarget parses a render target, e.g.
+// "alias(sumSeries(web.*.requests.counter),'requests')".
+func parseGraphiteTarget(s string) (graphiteExpr, error) {
+	p := &graphiteParser{s: s}
+	e, err := p.expr()
+	if err == nil && p.skip() < len(s) {
+		err = Error("Unexpected " + s[p.i:])
+	}
+	if err != nil {
+		return graphiteExpr{}, Error("Invalid target: " + s + ": " + err.Error())
+	}
+	return e, nil
+}
+
+type graphiteParser struct {
+	s string
+	i int
+}
+
+func (p *graphiteParser) skip() int {
+	for p.i < len(p.s) && p.s[p.i] == ' ' {
+		p.i++
+	}
+	return p.i
+}
+
+func (p *graphiteParser) expr() (graphiteExpr, error) {
+	start := p.skip()
+	if start == len(p.s) {
+		return graphiteExpr{}, Error("Missing expression")
+	}
+	if q := p.s[start]; q == '\'' || q == '"' {
+		end := strings.IndexByte(p.s[start+1:], q)
+		if end == -1 {
+			return graphiteExpr{}, Error("Unterminated string")
+		}
+		p.i = start + end + 2
+		return graphiteExpr{text: p.s[start:p.i], isStr: true}, nil
+	}
+
+	// Commas within braces are part of a path
+	depth := 0
+	for ; p.i < len(p.s); p.i++ {
+		c := p.s[p.i]
+		if c == '{' {
+			depth++
+		} else if c == '}' {
+			depth--
+		} else if depth == 0 && strings.IndexByte("(), ", c) != -1 {
+			break
+		}
+	}
+	e := graphiteExpr{text: p.s[start:p.i]}
+	if e.text == "" {
+		return graphiteExpr{}, Error("Missing expression")
+	}
+	if p.skip() == len(p.s) || p.s[p.i] != '(' {
+		if v, err := strconv.ParseFloat(e.text, 64); err == nil && !math.IsNaN(v) && !math.IsInf(v, 0) {
+			e.isNum, e.num = true, v
+		}
+		return e, nil
+	}
+
+	e.fn = e.text
+	p.i++
+	if p.skip() < len(p.s) && p.s[p.i] != ')' {
+		for {
+			arg, err := p.expr()
+			if err != nil {
+				return graphiteExpr{}, err
+			}
+			e.args = append(e.args, arg)
+			if p.skip() == len(p.s) || p.s[p.i] != ',' {
+				break
+			}
+			p.i++
+		}
+	}
+	if p.i == len(p.s) || p.s[p.i] != ')' {
+		return graphiteExpr{}, Error("Missing ) after " + e.fn)
+	}
+	p.i++
+	e.text = p.s[start:p.i]
+	return e, nil
+}
+
+// graphiteResult is a rendered series. path is that of the channel it is
+// computed from, used by aliasByNode.
+type graphiteResult struct {
+	name   string
+	path   string
+	values []float64
+}
+
+// graphiteEval renders targets, counting the series selected.
+type graphiteEval struct {
+	ha     *HttpApi
+	gran   int64
+	series int
+}
+
+// eval renders e from from on, with length values at most.
+func (ev *graphiteEval) eval(e graphiteExpr, from, length int64) ([]graphiteResult, error) {
+	if e.isStr || e.isNum {
+		return nil, Error("Not a series: " + e.text)
+	}
+	if e.fn == "" {
+		return ev.evalPath(e.text, from, length)
+	}
+
+	switch e.fn {
+	case "alias":
+		if len(e.args) != 2 || !e.args[1].isStr {
+			return nil, Error("Usage: alias(series, 'name')")
+		}
+		r, err := ev.eval(e.args[0], from, length)
+		for i := range r {
+			r[i].name = e.args[1].text[1 : len(e.args[1].text)-1]
+		}
+		return r, err
+	case "aliasByNode":
+		if len(e.args) < 2 {
+			return nil, Error("Usage: aliasByNode(series, node, ...)")
+		}
+		for _, a := range e.args[1:] {
+			if !a.isNum || a.num != math.Trunc(a.num) {
+				return nil, Error("Invalid node: " + a.text)
+			}
+		}
+		r, err := ev.eval(e.args[0], from, length)
+		for i := range r {
+			nodes := strings.Split(strings.SplitN(r[i].path, ";", 2)[0], ".")
+			var alias []string
+			for _, a := range e.args[1:] {
+				n := int(a.num)
+				if n < 0 {
+					n += len(nodes)
+				}
+				if n >= 0 && n < len(nodes) {
+					alias = append(alias, nodes[n])
+				}
+			}
+			r[i].name = strings.Join(alias, ".")
+		}
+		return r, err
+	case "sumSeries":
+		var all []graphiteResult
+		for _, a := range e.args {
+			r, err := ev.eval(a, from, length)
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, r...)
+		}
+		if len(all) == 0 {
+			return nil, nil
+		}
+		sum := graphiteResult{name: e.text, path: all[0].path}
+		for _, r := range all {
+			for i, v := range r.values {
+				if i == len(sum.values) {
+					sum.values = append(sum.values, math.NaN())
+				}
+				if math.IsNaN(sum.values[i]) {
+					sum.values[i] = v
+				} else if !math.IsNaN(v) {
+					sum.values[i] += v
+				}
+			}
+		}
+		return []graphiteResult{sum}, nil
+	}
+	return ev.evalFunction(e, from, length)
+}
+
+// evalFunction applies one of the query functions, e.g.
+// "movingAverage(web.latency.timer-avg,'10min')". As in Graphite, windows
+// are numbers of values or durations and time shifts durations into the
+// past.
+func (ev *graphiteEval) evalFunction(e graphiteExpr, from, length int64) ([]graphiteResult, error) {
+	def, ok := queryFuncs[e.fn]
+	if !ok {
+		return nil, Error("Unsupported function: " + e.fn)
+	}
+	if len(e.args) == 0 {
+		return nil, Error("Missing series: " + e.fn)
+	}
+	var args []float64
+	for _, a := range e.args[1:] {
+		v := a.num
+		switch {
+		case a.isNum && e.fn == "movingAverage":
+			v *= float64(ev.gran)
+		case a.isStr && (e.fn == "movingAverage" || e.fn == "timeShift"):
+			d := strings.Trim(a.text[1:len(a.text)-1], " ")
+			if !strings.HasPrefix(d, "+") && !strings.HasPrefix(d, "-") {
+				d = "-" + d
+			}
+			ts, err := parseGraphiteTime(d, "", 0)
+			if err != nil {
+				return nil, err
+			}
+			if v = float64(-ts); e.fn == "movingAverage" && v < 0 {
+				v = -v
+			}
+		case !a.isNum:
+			return nil, Error("Invalid argument of " + e.fn + ": " + a.text)
+		}
+		args = append(args, v)
+	}
+	if len(args) < def.minArgs || len(args) > def.maxArgs {
+		return nil, Error("Wrong number of arguments: " + e.fn)
+	}
+	lead, err := def.lead(args, ev.gran)
+	if err != nil {
+		return nil, err
+	}
+	var shift int64
+	if e.fn == "timeShift" {
+		shift = int64(args[0])
+	}
+
+	r, err := ev.eval(e.args[0], from-shift-lead*ev.gran, length+lead)
+	if err != nil {
+		return nil, err
+	}
+	for i := range r {
+		if int64(len(r[i].values)) <= lead {
+			r[i].values = nil
+		} else {
+			r[i].values = def.apply(r[i].values, args, ev.gran)
+		}
+		r[i].name = e.fn + "(" + r[i].name
+		for _, a := range e.args[1:] {
+			r[i].name += "," + a.text
+		}
+		r[i].name += ")"
+	}
+	return r, nil
+}
+
+func (ev *graphiteEval) evalPath(pattern string, from, length int64) ([]graphiteResult, error) {
+	paths, err := ev.ha.graphitePaths(pattern, false)
+	if err != nil {
+		return nil, err
+	}
+	if ev.series += len(paths); ev.series > GraphiteMaxSeries {
+		return nil, Error("More than " + strconv.Itoa(GraphiteMaxSeries) + " series selected")
+	}
+	r := make([]graphiteResult, len(paths))
+	for i, p := range paths {
+		data, err := ev.ha.Server.Log(p.metric, p.tags, []string{p.channel}, from, length, ev.gran)
+		if err != nil {
+			return nil, err
+		}
+		r[i] = graphiteResult{name: p.path, path: p.path, values: make([]float64, len(data))}
+		for j, values := range data {
+			r[i].values[j] = values[0]
+		}
+	}
+	return r, nil
+}
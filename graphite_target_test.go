@@ -0,0 +1,145 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseGraphiteTarget(t *testing.T) {
+	var testCases = []struct {
+		s    string
+		fn   string
+		args []string
+		ok   bool
+	}{
+		{"web.*.requests.counter", "", nil, true},
+		{"web.{a,b}.requests.counter;dc=eu", "", nil, true},
+		{"alias(web.a.counter, 'a (web)')", "alias", []string{"web.a.counter", "'a (web)'"}, true},
+		{"sumSeries(web.{a,b}.counter,scale(web.c.counter,2))", "sumSeries",
+			[]string{"web.{a,b}.counter", "scale(web.c.counter,2)"}, true},
+		{"aliasByNode( web.*.counter , 1, -1 )", "aliasByNode", []string{"web.*.counter", "1", "-1"}, true},
+		{"rate()", "rate", nil, true},
+		{"alias(web.a.counter, 'a'", "", nil, false},
+		{"alias(web.a.counter, 'a)", "", nil, false},
+		{"alias(web.a.counter,)", "", nil, false},
+		{"web.a.counter)", "", nil, false},
+		{"", "", nil, false},
+	}
+
+	for _, tc := range testCases {
+		e, err := parseGraphiteTarget(tc.s)
+		var args []string
+		for _, a := range e.args {
+			args = append(args, a.text)
+		}
+		if (err == nil) != tc.ok || e.fn != tc.fn || !reflect.DeepEqual(args, tc.args) {
+			t.Error("Incorrect result:", tc.s)
+			t.Error("Expected:", tc.fn, tc.args, tc.ok)
+			t.Error("Returned:", e.fn, args, err)
+		}
+	}
+}
+
+func TestGraphiteEval(t *testing.T) {
+	ds := &MemDatastore{Interval: 1}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	srv := &Server{Ds: ds}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+	ha := &HttpApi{Server: srv}
+
+	from := time.Now().Unix() - 60
+	for i := int64(1); i <= 4; i++ {
+		ds.Insert("web.a:gauge", Record{Ts: from + i, Value: float64(i)})
+		ds.Insert("web.b:gauge", Record{Ts: from + i, Value: float64(10 * i)})
+	}
+	ds.Insert("web.c:gauge", Record{Ts: from + 2, Value: 100})
+
+	// Gauges are 0 before their first value and keep their last one
+	var testCases = []struct {
+		target string
+		names  []string
+		values [][]float64
+	}{
+		{"web.{a,b}.gauge", []string{"web.a.gauge", "web.b.gauge"}, [][]float64{{1, 2, 3, 4}, {10, 20, 30, 40}}},
+		{"alias(web.a.gauge,'a')", []string{"a"}, [][]float64{{1, 2, 3, 4}}},
+		{"aliasByNode(web.*.gauge,1)", []string{"a", "b", "c"}, [][]float64{{1, 2, 3, 4}, {10, 20, 30, 40}, {0, 100, 100, 100}}},
+		{"aliasByNode(web.a.gauge,-1,0)", []string{"gauge.web"}, [][]float64{{1, 2, 3, 4}}},
+		{"sumSeries(web.*.gauge)", []string{"sumSeries(web.*.gauge)"}, [][]float64{{11, 122, 133, 144}}},
+		{"scale(web.a.gauge,2)", []string{"scale(web.a.gauge,2)"}, [][]float64{{2, 4, 6, 8}}},
+		{"derivative(web.a.gauge)", []string{"derivative(web.a.gauge)"}, [][]float64{{1, 1, 1, 1}}},
+		{"movingAverage(web.a.gauge,2)", []string{"movingAverage(web.a.gauge,2)"}, [][]float64{{0.5, 1.5, 2.5, 3.5}}},
+		{"timeShift(web.a.gauge,'-1s')", []string{"timeShift(web.a.gauge,'-1s')"}, [][]float64{{0, 1, 2, 3}}},
+		{"timeShift(web.a.gauge,'+1s')", []string{"timeShift(web.a.gauge,'+1s')"}, [][]float64{{2, 3, 4, 4}}},
+		{"alias(sumSeries(web.a.gauge,scale(web.b.gauge,-1)),'diff')", []string{"diff"}, [][]float64{{-9, -18, -27, -36}}},
+	}
+	for _, tc := range testCases {
+		e, err := parseGraphiteTarget(tc.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ev := &graphiteEval{ha: ha, gran: 1}
+		r, err := ev.eval(e, from, 4)
+		var names []string
+		var values [][]float64
+		for _, s := range r {
+			names = append(names, s.name)
+			values = append(values, s.values)
+		}
+		if err != nil || !reflect.DeepEqual(names, tc.names) || !equalValues(values, tc.values) {
+			t.Error("Incorrect result:", tc.target)
+			t.Error("Expected:", tc.names, tc.values)
+			t.Error("Returned:", names, values, err)
+		}
+	}
+
+	for _, target := range []string{"highestMax(web.a.gauge,1)", "alias(web.a.gauge)", "scale(web.a.gauge,x)",
+		"movingAverage(web.a.gauge,'1x')", "sumSeries(web.a.gauge,2)"} {
+		e, err := parseGraphiteTarget(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := (&graphiteEval{ha: ha, gran: 1}).eval(e, from, 4); err == nil {
+			t.Error("No error:", target)
+		}
+	}
+
+	// The series selected by all targets count against the limit
+	for i := 0; i < GraphiteMaxSeries; i++ {
+		ds.Insert("many"+strconv.Itoa(i)+":gauge", Record{Ts: from + 1, Value: 1})
+	}
+	e, _ := parseGraphiteTarget("sumSeries(many*.gauge)")
+	if _, err := (&graphiteEval{ha: ha, gran: 1}).eval(e, from, 4); err != nil {
+		t.Error(err)
+	}
+	ev := &graphiteEval{ha: ha, gran: 1}
+	ev.eval(e, from, 4)
+	if _, err := ev.eval(e, from, 4); err == nil {
+		t.Error("No error above", GraphiteMaxSeries, "series")
+	}
+}
+
+func equalValues(a, b [][]float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if len(a[i]) != len(b[i]) {
+			return false
+		}
+		for j, v := range a[i] {
+			if v != b[i][j] && !(math.IsNaN(v) && math.IsNaN(b[i][j])) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// With a precision of 8 bits the sketch has 256 registers and the
+// standard error of the estimate is 1.04/sqrt(256), about 6.5%.
+const (
+	hllPrecision = 8
+	hllRegisters = 1 << hllPrecision
+	hllMaxRank   = 64 - hllPrecision + 1
+)
+
+type hyperLogLog struct {
+	regs [hllRegisters]uint8
+}
+
+func hllHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+
+	// FNV mixes the high bits poorly, finish with the MurmurHash3 mixer
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (hll *hyperLogLog) add(s string) {
+	x := hllHash(s)
+	i := x >> (64 - hllPrecision)
+	rank := uint8(1)
+	for x <<= hllPrecision; rank < hllMaxRank && x&(1<<63) == 0; x <<= 1 {
+		rank++
+	}
+	if rank > hll.regs[i] {
+		hll.regs[i] = rank
+	}
+}
+
+func (hll *hyperLogLog) merge(other *hyperLogLog) {
+	for i, r := range other.regs {
+		if r > hll.regs[i] {
+			hll.regs[i] = r
+		}
+	}
+}
+
+func (hll *hyperLogLog) reset() {
+	hll.regs = [hllRegisters]uint8{}
+}
+
+func (hll *hyperLogLog) estimate() float64 {
+	const m = float64(hllRegisters)
+
+	sum, zeros := 0.0, 0
+	for _, r := range hll.regs {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	if zeros == hllRegisters {
+		return 0
+	}
+
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros != 0 {
+		// Small range correction (linear counting)
+		e = m * math.Log(m/float64(zeros))
+	}
+	return math.Floor(e + 0.5)
+}
+
+// marshal returns the registers, the form the sketch is archived in.
+func (hll *hyperLogLog) marshal() []byte {
+	return append([]byte(nil), hll.regs[:]...)
+}
+
+// mergeMarshaled merges marshaled registers and reports whether they were
+// valid.
+func (hll *hyperLogLog) mergeMarshaled(b []byte) bool {
+	if len(b) != hllRegisters {
+		return false
+	}
+	for i, r := range b {
+		if r > hll.regs[i] && r <= hllMaxRank {
+			hll.regs[i] = r
+		}
+	}
+	return true
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 100, 1000, 10000, 100000} {
+		var hll hyperLogLog
+		for i := 0; i < n; i++ {
+			hll.add(strconv.Itoa(i))
+			hll.add(strconv.Itoa(i))
+		}
+		if e := hll.estimate(); math.Abs(e-float64(n)) > 0.2*float64(n) {
+			t.Error("Estimate too far off:", n)
+			t.Error("Returned:", e)
+		}
+	}
+}
+
+func TestHyperLogLogMarshaled(t *testing.T) {
+	var a, b, c hyperLogLog
+	for i := 0; i < 5000; i++ {
+		s := strconv.Itoa(i)
+		if i < 3000 {
+			a.add(s)
+		}
+		if i >= 2000 {
+			b.add(s)
+		}
+	}
+
+	c.mergeMarshaled(a.marshal())
+	if c != a {
+		t.Error("Marshaling is lossy")
+	}
+	c.mergeMarshaled(b.marshal())
+	a.merge(&b)
+	if c != a {
+		t.Error("Merging marshaled data differs from merging sketches")
+	}
+}
@@ -4,6 +4,10 @@ import (
 	"bufio"
 	"bytes"
 	"code.google.com/p/go.net/websocket"
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
 	"log"
 	"net"
 	"net/http"
@@ -13,14 +17,24 @@ import (
 	"time"
 )
 
+const (
+	HttpMaxBodySize = 16 << 20
+	HttpMaxLineSize = 64 * 1024
+)
+
+const errLineTooLong = Error("Line too long")
+
 type HttpApi struct {
-	Addr     string
-	Server   *Server
-	mu       sync.Mutex
-	running  bool
-	listener *net.TCPListener
-	httpSrv  http.Server
-	wg       sync.WaitGroup
+	Addr   string
+	Server *Server
+	// AdminToken must be sent as a bearer token with requests which
+	// modify the archive. They are refused if it is empty.
+	AdminToken string
+	mu         sync.Mutex
+	running    bool
+	listener   *net.TCPListener
+	httpSrv    http.Server
+	wg         sync.WaitGroup
 }
 
 func (ha *HttpApi) Start() error {
@@ -83,20 +97,60 @@ func (ha *HttpApi) serveHTTP(rw http.ResponseWriter, rq *http.Request) {
 	rw.Header().Set("Pragma", "no-cache")
 	rw.Header().Set("Access-Control-Allow-Origin", "*")
 
+	if rq.Method == "OPTIONS" {
+		rw.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+		rw.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Encoding, Authorization")
+		return
+	}
+
+	switch strings.TrimSuffix(rq.URL.Path, "/") {
+	case "/write":
+		ha.serveInfluxWrite(rw, rq)
+		return
+	case "/render":
+		ha.serveGraphiteRender(rw, rq)
+		return
+	case "/metrics/find":
+		ha.serveGraphiteFind(rw, rq)
+		return
+	case "/metrics":
+		ha.servePrometheus(rw, rq)
+		return
+	}
+
 	typ := rq.URL.Query().Get("type")
 	watch := strings.ToLower(rq.Header.Get("Upgrade")) == "websocket"
 
+	var asJSON bool
+	if typ == "live" || typ == "archive" || typ == "list" {
+		var err error
+		if asJSON, err = ha.jsonRequested(rq); err != nil {
+			ha.sendError(err, rw)
+			return
+		}
+	}
+
 	switch {
+	case rq.Method == "POST" && (typ == "" || typ == "inject"):
+		ha.serveInject(rw, rq)
+	case rq.Method == "POST" && typ == "import":
+		ha.serveImport(rw, rq)
+	case rq.Method == "POST" && typ == "delete":
+		ha.serveDelete(rw, rq)
+	case rq.Method == "POST" && typ == "rename":
+		ha.serveRename(rw, rq)
+	case rq.Method == "POST" && typ == "batch":
+		ha.serveBatch(rw, rq)
 	case typ == "live" && watch:
-		ha.serveLiveWatch(rw, rq)
+		ha.serveLiveWatch(rw, rq, asJSON)
 	case typ == "live" && !watch:
-		ha.serveLiveLog(rw, rq)
+		ha.serveLiveLog(rw, rq, asJSON)
 	case typ == "archive" && watch:
-		ha.serveArchiveWatch(rw, rq)
+		ha.serveArchiveWatch(rw, rq, asJSON)
 	case typ == "archive" && !watch:
-		ha.serveArchiveLog(rw, rq)
+		ha.serveArchiveLog(rw, rq, asJSON)
 	case typ == "list":
-		ha.serveList(rw, rq)
+		ha.serveList(rw, rq, asJSON)
 	case typ == "clockSkew":
 		ha.serveClockSkew(rw, rq)
 	default:
@@ -104,67 +158,328 @@ func (ha *HttpApi) serveHTTP(rw http.ResponseWriter, rq *http.Request) {
 	}
 }
 
-func (ha *HttpApi) serveLiveWatch(rw http.ResponseWriter, rq *http.Request) {
-	m, chs := ha.metricAndChannels(rq)
-	watcher, err := ha.Server.LiveWatch(m, chs)
+func (ha *HttpApi) serveLiveWatch(rw http.ResponseWriter, rq *http.Request, asJSON bool) {
+	m, tags, chs := ha.metricAndChannels(rq)
+	watcher, err := ha.Server.LiveWatch(m, tags, chs)
 	if err != nil {
-		ha.sendError(err, rw)
+		ha.sendErrorAs(err, asJSON, rw)
 		return
 	}
-	ha.serveWs(watcher, 1, rw, rq)
+	tick, _ := ha.Server.Resolutions()
+	ha.serveWs(watcher, tick, asJSON, rw, rq)
 }
 
-func (ha *HttpApi) serveLiveLog(rw http.ResponseWriter, rq *http.Request) {
-	m, chs := ha.metricAndChannels(rq)
-	data, ts, err := ha.Server.LiveLog(m, chs)
+func (ha *HttpApi) serveLiveLog(rw http.ResponseWriter, rq *http.Request, asJSON bool) {
+	m, tags, chs := ha.metricAndChannels(rq)
+	data, ts, err := ha.Server.LiveLog(m, tags, chs)
 	if err != nil {
-		ha.sendError(err, rw)
+		ha.sendErrorAs(err, asJSON, rw)
 		return
 	}
-	ha.serveData(ts, data, 1, rw)
+	tick, _ := ha.Server.Resolutions()
+	ha.serveData(ts, data, tick, asJSON, rw, rq)
 }
 
-func (ha *HttpApi) serveArchiveWatch(rw http.ResponseWriter, rq *http.Request) {
-	m, chs := ha.metricAndChannels(rq)
+func (ha *HttpApi) serveArchiveWatch(rw http.ResponseWriter, rq *http.Request, asJSON bool) {
+	m, tags, chs := ha.metricAndChannels(rq)
 	og, err := ha.params(rq, "offset", "granularity")
 	if err != nil {
-		ha.sendError(err, rw)
+		ha.sendErrorAs(err, asJSON, rw)
 		return
 	}
-	watcher, err := ha.Server.Watch(m, chs, og[0], og[1])
+	watcher, err := ha.Server.Watch(m, tags, chs, og[0], og[1])
 	if err != nil {
-		ha.sendError(err, rw)
+		ha.sendErrorAs(err, asJSON, rw)
 		return
 	}
-	ha.serveWs(watcher, og[1], rw, rq)
+	ha.serveWs(watcher, og[1], asJSON, rw, rq)
 }
 
-func (ha *HttpApi) serveArchiveLog(rw http.ResponseWriter, rq *http.Request) {
-	m, chs := ha.metricAndChannels(rq)
+func (ha *HttpApi) serveArchiveLog(rw http.ResponseWriter, rq *http.Request, asJSON bool) {
+	m, tags, chs := ha.metricAndChannels(rq)
 	flg, err := ha.params(rq, "from", "length", "granularity")
 	if err != nil {
-		ha.sendError(err, rw)
+		ha.sendErrorAs(err, asJSON, rw)
+		return
+	}
+	fns, err := ParseFunctions(rq.URL.Query().Get("functions"))
+	if err != nil {
+		ha.sendErrorAs(err, asJSON, rw)
 		return
 	}
-	data, err := ha.Server.Log(m, chs, flg[0], flg[1], flg[2])
+	data, err := ha.Server.LogFunctions(m, tags, chs, flg[0], flg[1], flg[2], fns)
+	if err != nil {
+		ha.sendErrorAs(err, asJSON, rw)
+		return
+	}
+	ha.serveData(flg[0], data, flg[2], asJSON, rw, rq)
+}
+
+func (ha *HttpApi) serveList(rw http.ResponseWriter, rq *http.Request, asJSON bool) {
+	q := rq.URL.Query()
+	tags, err := ParseTags(q.Get("tags"))
+	if err != nil {
+		ha.sendErrorAs(err, asJSON, rw)
+		return
+	}
+	names, err := ha.Server.Ds.ListNames(q.Get("pattern"))
+	if err != nil {
+		ha.sendErrorAs(err, asJSON, rw)
+		return
+	}
+	list := make([]jsonSeries, 0)
+	for _, name := range names {
+		series, ch := name, ""
+		if i := strings.LastIndex(name, ":"); i != -1 {
+			series, ch = name[:i], name[i+1:]
+		}
+		m, t := splitSeriesName(series)
+		if !MatchTags(t, tags) {
+			continue
+		}
+		if asJSON {
+			list = append(list, jsonSeries{Name: name, Metric: m, Tags: t, Channel: ch})
+			continue
+		}
+		rw.Write([]byte(name))
+		rw.Write([]byte("\n"))
+	}
+	if asJSON {
+		ha.sendJSON(list, rw)
+	}
+}
+
+var influxPrecisions = map[string]int64{
+	"":   1,
+	"n":  1,
+	"ns": 1,
+	"u":  1e3,
+	"us": 1e3,
+	"ms": 1e6,
+	"s":  1e9,
+	"m":  60e9,
+	"h":  3600e9,
+}
+
+func (ha *HttpApi) serveInfluxWrite(rw http.ResponseWriter, rq *http.Request) {
+	if rq.Method != "POST" {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	precision, ok := influxPrecisions[rq.URL.Query().Get("precision")]
+	if !ok {
+		ha.sendError(Error("Invalid precision"), rw)
+		return
+	}
+
+	body, err := ha.requestBody(rw, rq)
 	if err != nil {
 		ha.sendError(err, rw)
+		return
+	}
+	defer body.Close()
+
+	var firstErr error
+	err = forEachLine(body, InfluxLineMaxSize, func(n int, line []byte, err error) {
+		if err == nil {
+			err = InjectInflux(ha.Server, line, precision)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = Error("Line " + strconv.Itoa(n) + ": " + err.Error())
+		}
+	})
+	if err != nil && firstErr == nil {
+		firstErr = Error(err.Error())
 	}
-	ha.serveData(flg[0], data, flg[2], rw)
+
+	if firstErr != nil {
+		ha.sendError(firstErr, rw)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
 }
 
-func (ha *HttpApi) serveList(rw http.ResponseWriter, rq *http.Request) {
-	names, err := ha.Server.Ds.ListNames(rq.URL.Query().Get("pattern"))
+func (ha *HttpApi) serveInject(rw http.ResponseWriter, rq *http.Request) {
+	ha.serveLines(rw, rq, func(line []byte) error {
+		metric, err := ParseMetric(line)
+		if err != nil {
+			return err
+		}
+		return ha.Server.Inject(metric)
+	})
+}
+
+// serveImport writes archived records of any number of series, one
+// "name[#tags]:channel timestamp value" per line.
+func (ha *HttpApi) serveImport(rw http.ResponseWriter, rq *http.Request) {
+	if !ha.authorize(rw, rq) {
+		return
+	}
+	ha.serveLines(rw, rq, func(line []byte) error {
+		rec, err := ParseImport(line)
+		if err != nil {
+			return err
+		}
+		return ha.Server.Import(rec)
+	})
+}
+
+// serveLines calls handle for every non-empty line of the body and
+// reports the number of accepted lines, followed by the number and error
+// of each rejected line. The records written are durable before the
+// response is sent.
+func (ha *HttpApi) serveLines(rw http.ResponseWriter, rq *http.Request, handle func([]byte) error) {
+	body, err := ha.requestBody(rw, rq)
 	if err != nil {
 		ha.sendError(err, rw)
 		return
 	}
+	defer body.Close()
+
+	accepted, errs := 0, new(bytes.Buffer)
+	err = forEachLine(body, HttpMaxLineSize, func(n int, line []byte, err error) {
+		line = bytes.TrimSpace(line)
+		if err == nil && len(line) == 0 {
+			return
+		}
+		if err == nil {
+			err = handle(line)
+		}
+		if err != nil {
+			errs.WriteString(strconv.Itoa(n) + "," + err.Error() + "\n")
+		} else {
+			accepted++
+		}
+	})
+	if err != nil {
+		errs.WriteString("0," + err.Error() + "\n")
+	}
+	if accepted > 0 {
+		if err := ha.Server.Sync(); err != nil {
+			log.Println("HttpApi.serveLines:", err)
+			errs.WriteString("0,Internal Server Error\n")
+		}
+	}
+
+	if accepted == 0 && errs.Len() > 0 {
+		rw.WriteHeader(http.StatusBadRequest)
+	}
+	rw.Write([]byte("accepted," + strconv.Itoa(accepted) + "\n"))
+	errs.WriteTo(rw)
+}
+
+// serveDelete removes the archived series matching pattern and lists
+// them. Series still being written to reappear on the next flush.
+func (ha *HttpApi) serveDelete(rw http.ResponseWriter, rq *http.Request) {
+	if !ha.authorize(rw, rq) {
+		return
+	}
+	names, err := ha.Server.Ds.Delete(rq.URL.Query().Get("pattern"))
+	if err != nil && len(names) == 0 {
+		ha.sendError(err, rw)
+		return
+	} else if err != nil {
+		log.Println("Datastore.Delete:", err)
+	}
 	for _, name := range names {
 		rw.Write([]byte(name))
 		rw.Write([]byte("\n"))
 	}
 }
 
+// serveRename renames the archived series from, with all of its channels,
+// to to, which must have canonical tags.
+func (ha *HttpApi) serveRename(rw http.ResponseWriter, rq *http.Request) {
+	if !ha.authorize(rw, rq) {
+		return
+	}
+	q := rq.URL.Query()
+	if err := ha.Server.Ds.Rename(q.Get("from"), q.Get("to")); err != nil {
+		ha.sendError(err, rw)
+	}
+}
+
+// authorize checks the bearer token of an admin request, sending an error
+// if it is missing or wrong.
+func (ha *HttpApi) authorize(rw http.ResponseWriter, rq *http.Request) bool {
+	if ha.AdminToken == "" {
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte("Admin requests disabled"))
+		return false
+	}
+	auth := rq.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(auth[7:]), []byte(ha.AdminToken)) != 1 {
+		rw.Header().Set("WWW-Authenticate", "Bearer")
+		rw.WriteHeader(http.StatusUnauthorized)
+		rw.Write([]byte("Unauthorized"))
+		return false
+	}
+	return true
+}
+
+// forEachLine calls fn with the number and the content of every line of
+// r. Lines longer than maxLine are passed as errLineTooLong instead, and
+// reading goes on with the next line. The error returned is that of r.
+func forEachLine(r io.Reader, maxLine int, fn func(n int, line []byte, err error)) error {
+	rd := bufio.NewReaderSize(r, maxLine)
+	for n, drop := 1, false; ; {
+		line, err := rd.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			if !drop {
+				fn(n, nil, errLineTooLong)
+			}
+			drop = true
+			continue
+		}
+		if len(line) > 0 {
+			if !drop {
+				fn(n, bytes.TrimRight(line, "\r\n"), nil)
+			}
+			n++
+		}
+		drop = false
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// requestBody returns the body of a POST request, decompressing it if
+// necessary. Both the body and its decompressed content are limited to
+// HttpMaxBodySize.
+func (ha *HttpApi) requestBody(rw http.ResponseWriter, rq *http.Request) (io.ReadCloser, error) {
+	body := http.MaxBytesReader(rw, rq.Body, HttpMaxBodySize)
+	if rq.Header.Get("Content-Encoding") != "gzip" {
+		return body, nil
+	}
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, Error("Invalid gzip data")
+	}
+	return &limitedBody{gz, HttpMaxBodySize}, nil
+}
+
+// limitedBody fails reads beyond its first n bytes.
+type limitedBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	if int64(len(p)) > lb.n+1 {
+		p = p[:lb.n+1]
+	}
+	n, err := lb.ReadCloser.Read(p)
+	if int64(n) > lb.n {
+		n, err = int(lb.n), Error("Decompressed request body too large")
+	}
+	lb.n -= int64(n)
+	return n, err
+}
+
 func (ha *HttpApi) serveClockSkew(rw http.ResponseWriter, rq *http.Request) {
 	ts, err := strconv.ParseInt(rq.URL.Query().Get("ts"), 10, 64)
 	if err != nil {
@@ -174,20 +489,34 @@ func (ha *HttpApi) serveClockSkew(rw http.ResponseWriter, rq *http.Request) {
 	rw.Write([]byte(strconv.FormatInt(time.Now().UnixNano()/1e6-ts, 10)))
 }
 
+// sendError sends the message of an Error as a bad request. Other errors
+// are logged and hidden behind an internal server error.
 func (ha *HttpApi) sendError(err error, rw http.ResponseWriter) {
-	if _, ok := err.(Error); ok {
-		rw.WriteHeader(http.StatusBadRequest)
-		rw.Write([]byte(err.Error()))
+	status, msg := errorStatus(err)
+	rw.WriteHeader(status)
+	rw.Write([]byte(msg))
+}
+
+// sendErrorAs sends err as JSON if asJSON is set, as text otherwise.
+func (ha *HttpApi) sendErrorAs(err error, asJSON bool, rw http.ResponseWriter) {
+	if asJSON {
+		ha.sendJSONError(err, rw)
 	} else {
-		log.Println(err)
-		rw.WriteHeader(http.StatusInternalServerError)
-		rw.Write([]byte("Internal Server Error"))
+		ha.sendError(err, rw)
 	}
 }
 
-func (ha *HttpApi) metricAndChannels(rq *http.Request) (string, []string) {
+func errorStatus(err error) (int, string) {
+	if _, ok := err.(Error); ok {
+		return http.StatusBadRequest, err.Error()
+	}
+	log.Println(err)
+	return http.StatusInternalServerError, "Internal Server Error"
+}
+
+func (ha *HttpApi) metricAndChannels(rq *http.Request) (string, string, []string) {
 	q := rq.URL.Query()
-	return q.Get("metric"), strings.Split(q.Get("channels"), ",")
+	return q.Get("metric"), q.Get("tags"), strings.Split(q.Get("channels"), ",")
 }
 
 func (ha *HttpApi) params(rq *http.Request, vars ...string) ([]int64, error) {
@@ -203,11 +532,25 @@ func (ha *HttpApi) params(rq *http.Request, vars ...string) ([]int64, error) {
 	return r, nil
 }
 
-func (ha *HttpApi) serveWs(w *Watcher, n int64, rw http.ResponseWriter, rq *http.Request) {
+func (ha *HttpApi) serveWs(w *Watcher, n int64, asJSON bool, rw http.ResponseWriter, rq *http.Request) {
+	var jd *jsonData
+	if asJSON {
+		jd = ha.newJSONData(rq, n)
+	}
 	websocket.Handler(func(conn *websocket.Conn) {
 		buf := new(bytes.Buffer)
 		for values := range w.C {
-			if err := ha.writeRecord(w.Ts, values, buf); err != nil {
+			var err error
+			if jd != nil {
+				jd.Records = []jsonRecord{newJSONRecord(w.Ts, values)}
+				var data []byte
+				if data, err = json.Marshal(jd); err == nil {
+					buf.Write(data)
+				}
+			} else {
+				err = ha.writeRecord(w.Ts, values, buf)
+			}
+			if err != nil {
 				w.Close()
 				break
 			}
@@ -226,7 +569,18 @@ type byteStringWriter interface {
 	WriteByte(byte) error
 }
 
-func (ha *HttpApi) serveData(ts int64, data [][]float64, n int64, rw http.ResponseWriter) {
+func (ha *HttpApi) serveData(ts int64, data [][]float64, n int64, asJSON bool, rw http.ResponseWriter, rq *http.Request) {
+	if asJSON {
+		jd := ha.newJSONData(rq, n)
+		jd.Records = make([]jsonRecord, len(data))
+		for i, values := range data {
+			jd.Records[i] = newJSONRecord(ts, values)
+			ts += n
+		}
+		ha.sendJSON(jd, rw)
+		return
+	}
+
 	buf := bufio.NewWriter(rw)
 	for _, values := range data {
 		ha.writeRecord(ts, values, buf)
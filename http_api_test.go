@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeInject(t *testing.T) {
+	ds := &MemDatastore{Interval: 1}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	srv := &Server{Ds: ds}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+	ha := &HttpApi{Server: srv}
+
+	var huge bytes.Buffer
+	gz := gzip.NewWriter(&huge)
+	gz.Write(bytes.Repeat([]byte{'\n'}, HttpMaxBodySize+1))
+	gz.Close()
+
+	long := strings.Repeat("x", HttpMaxLineSize+10)
+	var testCases = []struct {
+		path, body string
+		gzip       bool
+		code       int
+		out        string
+	}{
+		{"/", "a:1|c\n\nb:x|c\n" + long + ":1|c\r\nc:1|c", false, 200,
+			"accepted,2\n3,Metric value invalid\n4,Line too long\n"},
+		{"/", long, false, 400, "accepted,0\n1,Line too long\n"},
+		{"/", huge.String(), true, 400, "accepted,0\n0,Decompressed request body too large\n"},
+		{"/write", "cpu value=1\n" + long + "\ncpu value=2", false, 400, "Line 2: Line too long"},
+	}
+
+	for _, tc := range testCases {
+		rq := httptest.NewRequest("POST", tc.path, strings.NewReader(tc.body))
+		if tc.gzip {
+			rq.Header.Set("Content-Encoding", "gzip")
+		}
+		rw := httptest.NewRecorder()
+		ha.serveHTTP(rw, rq)
+		if rw.Code != tc.code || rw.Body.String() != tc.out {
+			t.Error(tc.path, "returned", rw.Code, rw.Body.String())
+		}
+	}
+}
+
+func TestServeImport(t *testing.T) {
+	ds := &MemDatastore{Interval: 1}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	srv := &Server{Ds: ds}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+	ha := &HttpApi{Server: srv, AdminToken: "secret"}
+
+	var testCases = []struct {
+		auth string
+		code int
+		n    int
+	}{
+		{"", 401, 0},
+		{"Bearer other", 401, 0},
+		{"Bearer secret", 200, 1},
+	}
+	for _, tc := range testCases {
+		rq := httptest.NewRequest("POST", "/?type=import", strings.NewReader("a:counter 60 1\n"))
+		if tc.auth != "" {
+			rq.Header.Set("Authorization", tc.auth)
+		}
+		rw := httptest.NewRecorder()
+		ha.serveHTTP(rw, rq)
+		recs, _ := ds.Query("a:counter", 0, 60)
+		if rw.Code != tc.code || len(recs) != tc.n {
+			t.Error(tc.auth, "returned", rw.Code, rw.Body.String(), "imported", recs)
+		}
+	}
+}
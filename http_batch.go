@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	HttpBatchMaxSeries = 1000
+	HttpBatchMaxPoints = 1000000
+	httpBatchWorkers   = 8
+)
+
+// batchQuery selects the series of a batch request, either a single
+// metric or every metric matching a glob pattern which has the given
+// tags. The live log is queried if source is "live", the archive
+// otherwise; functions are only applied to the archive data.
+type batchQuery struct {
+	Source      string   `json:"source"`
+	Metric      string   `json:"metric"`
+	Pattern     string   `json:"pattern"`
+	Tags        string   `json:"tags"`
+	Channels    []string `json:"channels"`
+	From        int64    `json:"from"`
+	Length      int64    `json:"length"`
+	Granularity int64    `json:"granularity"`
+	Functions   string   `json:"functions"`
+}
+
+// batchResult holds the data of a series, or the error of the query with
+// the given index if the series couldn't be queried.
+type batchResult struct {
+	Query int `json:"query"`
+	jsonData
+	Error string `json:"error,omitempty"`
+}
+
+// serveBatch answers a JSON array of queries with the data of every
+// series selected, in the order of the queries. The series are queried
+// concurrently; at most HttpBatchMaxSeries series and HttpBatchMaxPoints
+// values may be requested.
+func (ha *HttpApi) serveBatch(rw http.ResponseWriter, rq *http.Request) {
+	body, err := ha.requestBody(rw, rq)
+	if err != nil {
+		ha.sendJSONError(err, rw)
+		return
+	}
+	defer body.Close()
+
+	var queries []batchQuery
+	if err := json.NewDecoder(body).Decode(&queries); err != nil {
+		ha.sendJSONError(Error("Invalid batch query: "+err.Error()), rw)
+		return
+	}
+	if len(queries) == 0 {
+		ha.sendJSONError(Error("No queries"), rw)
+		return
+	}
+
+	results := make([]batchResult, 0)
+	for i, q := range queries {
+		series, err := ha.batchSeries(q)
+		if err != nil {
+			r := batchResult{Query: i}
+			r.Metric, r.Tags, r.Channels = q.Metric+q.Pattern, q.Tags, q.Channels
+			ha.setBatchError(&r, err)
+			results = append(results, r)
+			continue
+		}
+		for _, s := range series {
+			r := batchResult{Query: i}
+			r.Metric, r.Tags, r.Channels = s[0], s[1], q.Channels
+			results = append(results, r)
+		}
+		if len(results) > HttpBatchMaxSeries {
+			ha.sendJSONError(Error("More than "+strconv.Itoa(HttpBatchMaxSeries)+" series selected"), rw)
+			return
+		}
+	}
+
+	// Only the results without an error are queried, at most
+	// HttpBatchMaxPoints values in all
+	var pending []int
+	var points int64
+	liveSize := ha.Server.LiveSize()
+	for k, r := range results {
+		if r.Error != "" {
+			continue
+		}
+		q := queries[r.Query]
+		n := q.Length
+		if q.Source == "live" {
+			n = liveSize
+		} else if n < 0 {
+			n = 0
+		}
+		if n > HttpBatchMaxPoints {
+			n = HttpBatchMaxPoints + 1
+		}
+		if points += n * int64(len(q.Channels)); points > HttpBatchMaxPoints {
+			ha.sendJSONError(Error("More than "+strconv.Itoa(HttpBatchMaxPoints)+" values requested"), rw)
+			return
+		}
+		pending = append(pending, k)
+	}
+
+	var wg sync.WaitGroup
+	next := make(chan int)
+	for i := 0; i < httpBatchWorkers && i < len(pending); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range next {
+				ha.runBatchQuery(&results[k], queries[results[k].Query])
+			}
+		}()
+	}
+	for _, k := range pending {
+		next <- k
+	}
+	close(next)
+	wg.Wait()
+
+	ha.sendJSON(results, rw)
+}
+
+// batchSeries returns the metric name and canonical tags of every series
+// selected by a query.
+func (ha *HttpApi) batchSeries(q batchQuery) ([][2]string, error) {
+	if q.Source != "" && q.Source != "live" && q.Source != "archive" {
+		return nil, Error("Invalid source: " + q.Source)
+	}
+	if len(q.Channels) == 0 {
+		return nil, Error("No channels specified")
+	}
+	if q.Source == "live" && q.Functions != "" {
+		return nil, Error("Functions are not supported by live queries")
+	}
+	if _, err := ha.Server.metricTypeByChannels(q.Channels); err != nil {
+		return nil, err
+	}
+	tags, err := ParseTags(q.Tags)
+	if err != nil {
+		return nil, err
+	}
+	if q.Pattern == "" {
+		return [][2]string{{q.Metric, tags}}, nil
+	}
+	if q.Metric != "" {
+		return nil, Error("Both metric and pattern specified")
+	}
+	if _, err := filepath.Match(q.Pattern, ""); err != nil {
+		return nil, Error("Invalid pattern: " + q.Pattern)
+	}
+
+	// The pattern is followed by a wildcard to list the tagged series too
+	prefix := ha.Server.Prefix
+	names, err := ha.Server.Ds.ListNames(escapePattern(prefix) + q.Pattern + "*:" + escapePattern(q.Channels[0]))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	var r [][2]string
+	for _, name := range names {
+		series := name[len(prefix) : len(name)-len(q.Channels[0])-1]
+		m, t := splitSeriesName(series)
+		if ok, _ := filepath.Match(q.Pattern, m); ok && MatchTags(t, tags) {
+			r = append(r, [2]string{m, t})
+		}
+	}
+	return r, nil
+}
+
+func (ha *HttpApi) runBatchQuery(r *batchResult, q batchQuery) {
+	var data [][]float64
+	var err error
+	ts, gran := q.From, q.Granularity
+	if q.Source == "live" {
+		gran, _ = ha.Server.Resolutions()
+		data, ts, err = ha.Server.LiveLog(r.Metric, r.Tags, q.Channels)
+	} else {
+		var fns []QueryFunc
+		if fns, err = ParseFunctions(q.Functions); err == nil {
+			data, err = ha.Server.LogFunctions(r.Metric, r.Tags, q.Channels, q.From, q.Length, q.Granularity, fns)
+		}
+	}
+	if err != nil {
+		ha.setBatchError(r, err)
+		return
+	}
+
+	r.Granularity = gran
+	r.Records = make([]jsonRecord, len(data))
+	for i, values := range data {
+		r.Records[i] = newJSONRecord(ts, values)
+		ts += gran
+	}
+}
+
+// setBatchError reports the error of a query like sendError does for a
+// single query, hiding internal errors.
+func (ha *HttpApi) setBatchError(r *batchResult, err error) {
+	if _, ok := err.(Error); ok {
+		r.Error = err.Error()
+	} else {
+		log.Println("HttpApi.serveBatch:", err)
+		r.Error = "Internal Server Error"
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeBatch(t *testing.T) {
+	ds := &MemDatastore{Interval: 1}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	srv := &Server{Ds: ds}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	from := time.Now().Unix() - 60
+	for ts := from + 1; ts <= from+10; ts++ {
+		ds.Insert("web.a:counter", Record{Ts: ts, Value: 1})
+		ds.Insert("web.b#host:x:counter", Record{Ts: ts, Value: 2})
+		ds.Insert("db.c:counter", Record{Ts: ts, Value: 3})
+	}
+
+	f := strconv.FormatInt(from, 10)
+	body := `[
+		{"metric": "db.c", "channels": ["counter"], "from": ` + f + `, "length": 5, "granularity": 2},
+		{"pattern": "web.*", "channels": ["counter"], "from": ` + f + `, "length": 5, "granularity": 2},
+		{"metric": "db.c", "channels": ["nothing"], "from": ` + f + `, "length": 5, "granularity": 2},
+		{"pattern": "web.*", "channels": ["nothing", "counter"], "from": ` + f + `, "length": 5, "granularity": 2}
+	]`
+	rq := httptest.NewRequest("POST", "/?type=batch", strings.NewReader(body))
+	rw := httptest.NewRecorder()
+	ha := &HttpApi{Server: srv}
+	ha.serveHTTP(rw, rq)
+
+	var results []batchResult
+	if err := json.Unmarshal(rw.Body.Bytes(), &results); err != nil {
+		t.Fatal(err, rw.Body.String())
+	}
+	expected := []struct {
+		query        int
+		metric, tags string
+		value        float64
+	}{
+		{0, "db.c", "", 6},
+		{1, "web.a", "", 2},
+		{1, "web.b", "host:x", 4},
+		{2, "db.c", "", 0},
+		{3, "web.*", "", 0},
+	}
+	if len(results) != len(expected) {
+		t.Fatal("Unexpected results:", rw.Body.String())
+	}
+	for i, e := range expected {
+		r := results[i]
+		if r.Query != e.query || r.Metric != e.metric || r.Tags != e.tags {
+			t.Error("Unexpected result", i, r)
+		}
+		if e.value == 0 {
+			if r.Error == "" {
+				t.Error("Error expected for result", i)
+			}
+		} else if r.Error != "" || len(r.Records) != 5 || float64(r.Records[0].Values[0]) != e.value {
+			t.Error("Unexpected data for result", i, r)
+		}
+	}
+
+	// The values of all series count against the limit
+	body = `[{"pattern": "web.*", "channels": ["counter"], "from": ` + f + `, "length": ` +
+		strconv.Itoa(HttpBatchMaxPoints/2+1) + `, "granularity": 2}]`
+	rq = httptest.NewRequest("POST", "/?type=batch", strings.NewReader(body))
+	rw = httptest.NewRecorder()
+	ha.serveHTTP(rw, rq)
+	if rw.Code != 400 {
+		t.Error("Returned", rw.Code, "above", HttpBatchMaxPoints, "values")
+	}
+}
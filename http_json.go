@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const jsonContentType = "application/json"
+
+// jsonData is the JSON format of the data of a metric. Watch streams send
+// one per message, holding a single record.
+type jsonData struct {
+	Metric      string       `json:"metric"`
+	Tags        string       `json:"tags"`
+	Channels    []string     `json:"channels"`
+	Granularity int64        `json:"granularity"`
+	Records     []jsonRecord `json:"records"`
+}
+
+type jsonRecord struct {
+	Ts     int64       `json:"ts"`
+	Values []jsonFloat `json:"values"`
+}
+
+// jsonFloat is encoded as null if it is NaN or infinite, which JSON can't
+// represent.
+type jsonFloat float64
+
+func (f jsonFloat) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return []byte("null"), nil
+	}
+	return strconv.AppendFloat(nil, v, 'g', -1, 64), nil
+}
+
+type jsonSeries struct {
+	Name    string `json:"name"`
+	Metric  string `json:"metric"`
+	Tags    string `json:"tags"`
+	Channel string `json:"channel"`
+}
+
+type jsonError struct {
+	Error jsonErrorBody `json:"error"`
+}
+
+type jsonErrorBody struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// jsonRequested reports whether the response should be JSON, as requested
+// by the format parameter or else the Accept header.
+func (ha *HttpApi) jsonRequested(rq *http.Request) (bool, error) {
+	switch rq.URL.Query().Get("format") {
+	case "json":
+		return true, nil
+	case "csv":
+		return false, nil
+	case "":
+		return strings.Contains(rq.Header.Get("Accept"), jsonContentType), nil
+	}
+	return false, Error("Invalid format")
+}
+
+func (ha *HttpApi) newJSONData(rq *http.Request, n int64) *jsonData {
+	m, tags, chs := ha.metricAndChannels(rq)
+	return &jsonData{Metric: m, Tags: tags, Channels: chs, Granularity: n}
+}
+
+func newJSONRecord(ts int64, values []float64) jsonRecord {
+	r := jsonRecord{Ts: ts, Values: make([]jsonFloat, len(values))}
+	for i, v := range values {
+		r.Values[i] = jsonFloat(v)
+	}
+	return r
+}
+
+func (ha *HttpApi) sendJSON(v interface{}, rw http.ResponseWriter) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		ha.sendJSONError(err, rw)
+		return
+	}
+	rw.Header().Set("Content-Type", jsonContentType)
+	rw.Write(data)
+}
+
+// sendJSONError sends err like sendError does, as a JSON object.
+func (ha *HttpApi) sendJSONError(err error, rw http.ResponseWriter) {
+	status, msg := errorStatus(err)
+	data, _ := json.Marshal(jsonError{jsonErrorBody{status, msg}})
+	rw.Header().Set("Content-Type", jsonContentType)
+	rw.WriteHeader(status)
+	rw.Write(data)
+}
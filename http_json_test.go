@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestJSONRequested(t *testing.T) {
+	var testCases = []struct {
+		url, accept string
+		json, err   bool
+	}{
+		{"/?type=live", "", false, false},
+		{"/?type=live", "text/csv", false, false},
+		{"/?type=live", "application/json, text/plain", true, false},
+		{"/?type=live&format=json", "", true, false},
+		{"/?type=live&format=csv", "application/json", false, false},
+		{"/?type=live&format=xml", "", false, true},
+	}
+
+	ha := &HttpApi{}
+	for _, tc := range testCases {
+		rq := httptest.NewRequest("GET", tc.url, nil)
+		if tc.accept != "" {
+			rq.Header.Set("Accept", tc.accept)
+		}
+		asJSON, err := ha.jsonRequested(rq)
+		if asJSON != tc.json || (err != nil) != tc.err {
+			t.Error("Incorrect result:", tc.url, tc.accept)
+			t.Error("Expected:", tc.json, tc.err)
+			t.Error("Returned:", asJSON, err)
+		}
+	}
+}
+
+func TestJSONRecord(t *testing.T) {
+	data, err := json.Marshal(newJSONRecord(60, []float64{1.5, math.NaN(), math.Inf(1), 1e21}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"ts":60,"values":[1.5,null,null,1e+21]}` {
+		t.Error("Incorrect result:", string(data))
+	}
+}
+
+func TestServeJSON(t *testing.T) {
+	ds := &MemDatastore{Interval: 1}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	srv := &Server{Ds: ds}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+	ha := &HttpApi{Server: srv}
+
+	from := time.Now().Unix() - 60
+	ds.Insert("a:gauge", Record{Ts: from + 1, Value: 1})
+	ds.Insert("a:gauge", Record{Ts: from + 2, Value: 2.5})
+	archive := "/?type=archive&metric=a&channels=gauge&length=2&granularity=1&from="
+	f := strconv.FormatInt(from, 10)
+
+	var testCases = []struct {
+		url, accept string
+		code        int
+		json        bool
+		out         string
+	}{
+		{archive + f + "&format=json", "", 200, true,
+			`{"metric":"a","tags":"","channels":["gauge"],"granularity":1,"records":[{"ts":` + f +
+				`,"values":[1]},{"ts":` + strconv.FormatInt(from+1, 10) + `,"values":[2.5]}]}`},
+		{archive + f, "", 200, false, f + ",1e+00\n" + strconv.FormatInt(from+1, 10) + ",2.5e+00\n"},
+		{"/?type=list&pattern=a:*", jsonContentType, 200, true,
+			`[{"name":"a:gauge","metric":"a","tags":"","channel":"gauge"}]`},
+		{archive + "x", jsonContentType, 400, true, `{"error":{"status":400,"message":"Not an integer: from"}}`},
+		{archive + "x", "", 400, false, "Not an integer: from"},
+		{"/?type=list&format=xml", "", 400, false, "Invalid format"},
+	}
+	for _, tc := range testCases {
+		rq := httptest.NewRequest("GET", tc.url, nil)
+		if tc.accept != "" {
+			rq.Header.Set("Accept", tc.accept)
+		}
+		rw := httptest.NewRecorder()
+		ha.serveHTTP(rw, rq)
+		isJSON := rw.Header().Get("Content-Type") == jsonContentType
+		if rw.Code != tc.code || isJSON != tc.json || rw.Body.String() != tc.out {
+			t.Error(tc.url, "returned", rw.Code, isJSON, rw.Body.String())
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"log"
+)
+
+const InfluxLineMaxSize = 64 * 1024
+
+type InfluxInjector struct {
+	TCPAddr string
+	UDPAddr string
+	Server  *Server
+	ls      lineServer
+	ps      packetServer
+}
+
+func (ii *InfluxInjector) Start() error {
+	if len(ii.TCPAddr) > 0 {
+		ii.ls.network, ii.ls.addr = "tcp", ii.TCPAddr
+		ii.ls.maxLine, ii.ls.handle = InfluxLineMaxSize, ii.injectLine
+		if err := ii.ls.start(); err != nil {
+			return err
+		}
+	}
+	if len(ii.UDPAddr) > 0 {
+		ii.ps.network, ii.ps.addr = "udp", ii.UDPAddr
+		ii.ps.maxSize, ii.ps.handle = InfluxLineMaxSize, ii.injectPacket
+		if err := ii.ps.start(); err != nil {
+			if len(ii.TCPAddr) > 0 {
+				ii.ls.stop()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop stops both listeners and returns the first error.
+func (ii *InfluxInjector) Stop() error {
+	var err error
+	if len(ii.TCPAddr) > 0 {
+		err = ii.ls.stop()
+	}
+	if len(ii.UDPAddr) > 0 {
+		if err2 := ii.ps.stop(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+func (ii *InfluxInjector) injectLine(line []byte) {
+	if err := InjectInflux(ii.Server, line, 1); err != nil {
+		log.Println("InfluxInjector:", err)
+	}
+}
+
+func (ii *InfluxInjector) injectPacket(msg []byte) {
+	for _, line := range bytes.Split(msg, []byte{'\n'}) {
+		ii.injectLine(line)
+	}
+}
+
+// InjectInflux parses a line of the InfluxDB line protocol and injects
+// the resulting metrics. Empty lines and comments are ignored. A metric
+// which cannot be injected does not keep the other fields of the line from
+// being injected, the first error is returned.
+func InjectInflux(srv *Server, line []byte, precision int64) error {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 || line[0] == '#' {
+		return nil
+	}
+	metrics, ts, err := ParseInflux(line, precision)
+	if err != nil {
+		return err
+	}
+	for _, m := range metrics {
+		if ierr := srv.InjectAt(m, ts); ierr != nil && err == nil {
+			err = ierr
+		}
+	}
+	return err
+}
@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestInfluxInjectorStop(t *testing.T) {
+	// The UDP listener is stopped although stopping the TCP one fails
+	ii := &InfluxInjector{TCPAddr: "127.0.0.1:0", UDPAddr: "127.0.0.1:0", Server: &Server{}}
+	if err := ii.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ii.ls.stop()
+	if err := ii.Stop(); err == nil {
+		t.Error("Stop succeeded")
+	}
+	if ii.ps.running {
+		t.Error("UDP listener still running")
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// lineServer accepts stream connections ("tcp" or "unix") and passes
+// every newline terminated line to handle. Lines longer than maxLine are
+// dropped and reported to dropped, if set.
+type lineServer struct {
+	network  string
+	addr     string
+	maxLine  int
+	handle   func([]byte)
+	dropped  func()
+	mu, cmu  sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
+	running  bool
+	wg       sync.WaitGroup
+}
+
+func (ls *lineServer) start() error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if ls.running {
+		return Error("Injector already running")
+	}
+
+	listener, err := net.Listen(ls.network, ls.addr)
+	if err != nil {
+		return err
+	}
+
+	ls.listener, ls.running = listener, true
+	ls.conns = make(map[net.Conn]bool)
+
+	go ls.run()
+	return nil
+}
+
+func (ls *lineServer) stop() error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if !ls.running {
+		return Error("Injector not running")
+	}
+
+	ls.running = false
+	ls.listener.Close()
+	ls.wg.Wait()
+	return nil
+}
+
+func (ls *lineServer) run() {
+	for {
+		conn, err := ls.listener.Accept()
+		if err != nil {
+			log.Println("Listener.Accept:", err)
+			break
+		}
+		ls.cmu.Lock()
+		ls.conns[conn] = true
+		ls.cmu.Unlock()
+		ls.wg.Add(1)
+		go ls.serve(conn)
+	}
+	ls.cmu.Lock()
+	for conn := range ls.conns {
+		conn.Close()
+	}
+	ls.cmu.Unlock()
+}
+
+func (ls *lineServer) serve(conn net.Conn) {
+	rd := bufio.NewReaderSize(conn, ls.maxLine)
+	for drop := false; ; {
+		line, err := rd.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			if !drop && ls.dropped != nil {
+				ls.dropped()
+			}
+			drop = true
+			continue
+		}
+		if len(line) > 0 && !drop {
+			ls.handle(line)
+		}
+		drop = false
+		if err != nil {
+			log.Println("Conn.Read:", err)
+			break
+		}
+	}
+	ls.cmu.Lock()
+	delete(ls.conns, conn)
+	ls.cmu.Unlock()
+	ls.wg.Done()
+}
+
+// packetServer reads datagrams from a "udp" or "unixgram" socket and
+// passes them to handle on a fixed number of worker goroutines. Datagrams
+// longer than maxSize are truncated to their last complete line.
+type packetServer struct {
+	received   uint64 // first for 64-bit alignment
+	truncated  uint64
+	network    string
+	addr       string
+	maxSize    int
+	workers    int
+	readBuffer int
+	handle     func([]byte)
+	mu         sync.Mutex
+	conn       net.PacketConn
+	queue      chan []byte
+	running    bool
+	wg         sync.WaitGroup
+}
+
+func (ps *packetServer) start() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.running {
+		return Error("Injector already running")
+	}
+
+	conn, err := net.ListenPacket(ps.network, ps.addr)
+	if err != nil {
+		return err
+	}
+
+	if ps.readBuffer > 0 {
+		if c, ok := conn.(interface {
+			SetReadBuffer(int) error
+		}); ok {
+			if err := c.SetReadBuffer(ps.readBuffer); err != nil {
+				log.Println("PacketConn.SetReadBuffer:", err)
+			}
+		}
+	}
+
+	workers := ps.workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	ps.conn, ps.running = conn, true
+	ps.queue = make(chan []byte, 4*workers)
+	ps.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go ps.work()
+	}
+
+	go ps.run()
+	return nil
+}
+
+func (ps *packetServer) stop() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if !ps.running {
+		return Error("Injector not running")
+	}
+
+	ps.running = false
+	ps.conn.Close()
+	ps.wg.Wait()
+	return nil
+}
+
+func (ps *packetServer) run() {
+	buff := make([]byte, ps.maxSize+1)
+	for {
+		n, _, err := ps.conn.ReadFrom(buff)
+		if n > 0 {
+			atomic.AddUint64(&ps.received, 1)
+			data := buff[:n]
+			if n > ps.maxSize {
+				atomic.AddUint64(&ps.truncated, 1)
+				data = data[:bytes.LastIndex(data[:ps.maxSize], []byte{'\n'})+1]
+			}
+			if len(data) > 0 {
+				ps.queue <- append([]byte(nil), data...)
+			}
+		}
+		if err != nil {
+			log.Println("PacketConn.ReadFrom:", err)
+			break
+		}
+	}
+	close(ps.queue)
+}
+
+func (ps *packetServer) work() {
+	defer ps.wg.Done()
+	for msg := range ps.queue {
+		ps.handle(msg)
+	}
+}
+
+func (ps *packetServer) counters() (received, truncated uint64) {
+	return atomic.LoadUint64(&ps.received), atomic.LoadUint64(&ps.truncated)
+}
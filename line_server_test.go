@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLineServer(t *testing.T) {
+	var mu sync.Mutex
+	var lines []string
+	drops := 0
+	ls := &lineServer{network: "tcp", addr: "127.0.0.1:0", maxLine: 16}
+	ls.handle = func(line []byte) {
+		mu.Lock()
+		lines = append(lines, string(line))
+		mu.Unlock()
+	}
+	ls.dropped = func() {
+		mu.Lock()
+		drops++
+		mu.Unlock()
+	}
+	if err := ls.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer ls.stop()
+
+	conn, err := net.Dial("tcp", ls.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("a\n" + strings.Repeat("b", 40) + "\nc\nd"))
+	conn.Close()
+
+	expected := []string{"a\n", "c\n", "d"}
+	for i := 0; i < 100; i++ {
+		mu.Lock()
+		done := len(lines) == len(expected)
+		mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(lines, expected) || drops != 1 {
+		t.Error("Handled", lines, "dropped", drops)
+	}
+}
@@ -8,9 +8,15 @@ import (
 	"os"
 )
 
+// Live log files written before the tick became configurable start with
+// the timestamp. Newer files start with liveLogVersion followed by the
+// timestamp, the size and the tick.
+const liveLogVersion = -1
+
 type LiveLogData struct {
 	ts      int64
 	size    uint64
+	tick    int64
 	entries []*liveLogEntry
 }
 
@@ -22,7 +28,7 @@ type liveLogEntry struct {
 }
 
 func saveLiveLogData(srv *Server) *LiveLogData {
-	lld := &LiveLogData{ts: srv.lastTick, size: LiveLogSize}
+	lld := &LiveLogData{ts: srv.lastTick, size: uint64(srv.liveSize), tick: srv.tickIvl}
 	for _, metrics := range srv.metrics {
 		for _, me := range metrics {
 			lld.entries = append(lld.entries, newLiveLogEntry(me))
@@ -32,68 +38,91 @@ func saveLiveLogData(srv *Server) *LiveLogData {
 }
 
 func newLiveLogEntry(me *metricEntry) *liveLogEntry {
-	chs := metricTypes[me.typ].channels
 	lle := &liveLogEntry{
 		typ:  me.typ,
-		name: []byte(me.name),
-		chs:  make([][]byte, len(chs)),
-		data: make([][]float64, len(chs)),
+		name: []byte(me.series()),
 	}
 
-	for i, n := range chs {
-		lle.chs[i] = []byte(n)
-		lle.data[i] = make([]float64, LiveLogSize)
-		n := copy(lle.data[i], me.liveLog[i][me.livePtr:])
-		copy(lle.data[i][n:], me.liveLog[i][:me.livePtr])
+	for i, n := range me.mt.channels {
+		live := me.liveLog[i]
+		data := make([]float64, me.liveSize)
+		k := copy(data, live[me.livePtr:])
+		copy(data[k:], live[:me.livePtr])
+		lle.chs = append(lle.chs, []byte(n))
+		lle.data = append(lle.data, data)
 	}
 
 	return lle
 }
 
 func (lld *LiveLogData) restore(srv *Server) {
+	if lld.tick != srv.tickIvl {
+		log.Println("Ignoring the live log (different tick interval)")
+		return
+	}
 	if srv.lastTick < lld.ts {
 		log.Println("Ignoring the live log (timestamp in the future)")
 		return
 	}
-	offs := (srv.lastTick - int64(LiveLogSize)) - (lld.ts - int64(lld.size))
-	if uint64(offs) >= lld.size {
+	// offs is the index in the saved data of the first slot of the new
+	// live log; the sizes of the two may differ.
+	offs := ((srv.lastTick - srv.liveSize*lld.tick) - (lld.ts - int64(lld.size)*lld.tick)) / lld.tick
+	if offs >= int64(lld.size) {
 		log.Println("Ignoring the live log (too old)")
 		return
 	}
-	if offs < 0 {
-		log.Println("Ignoring the live log (not enough data)")
-		return
-	}
 
 	for _, e := range lld.entries {
-		nameStr := string(e.name)
-		if CheckMetricName(nameStr) != nil {
-			log.Println("Invalid metric name in live log:", nameStr)
-			continue
-		}
-		if e.typ < 0 || e.typ >= NMetricTypes {
-			log.Println("Invalid metric type in live log:", e.typ)
+		if err := e.check(); err != nil {
+			log.Println(err.Error()+" in live log:", string(e.name))
 			continue
 		}
+		series := string(e.name)
+		nameStr, tags := splitSeriesName(series)
 		chsStr := make([]string, len(e.chs))
 		for i, ch := range e.chs {
 			chsStr[i] = string(ch)
 		}
-		if t, err := metricTypeByChannels(chsStr); err != nil || t != e.typ {
-			log.Println("Invalid channel list in live log:", e.typ, nameStr)
-			log.Println(chsStr)
-			continue
-		}
-		me := srv.createMetricEntry(e.typ, nameStr)
-		srv.metrics[e.typ][nameStr] = me
-		me.livePtr = (int64(lld.size) - offs) % LiveLogSize
+		me := srv.createMetricEntry(e.typ, nameStr, tags)
+		srv.metrics[e.typ][series] = me
 		for i, ch := range chsStr {
-			j := getChannelIndex(e.typ, ch)
-			copy(me.liveLog[j][0:], e.data[i][offs:])
+			// Histogram buckets may have changed
+			k := me.mt.channelIndex(ch)
+			if k == -1 {
+				continue
+			}
+			live, data := me.liveLog[k], e.data[i]
+			if offs < 0 {
+				copy(live[-offs:], data)
+			} else {
+				copy(live, data[offs:])
+			}
 		}
 	}
 }
 
+// check validates the series, the metric type and the channels of lle.
+func (lle *liveLogEntry) check() error {
+	nameStr, tags := splitSeriesName(string(lle.name))
+	if CheckMetricName(nameStr) != nil {
+		return Error("Invalid metric name")
+	}
+	if t, err := ParseTags(tags); err != nil || t != tags {
+		return Error("Invalid tags")
+	}
+	if lle.typ < 0 || lle.typ >= NMetricTypes {
+		return Error("Invalid metric type")
+	}
+	chsStr := make([]string, len(lle.chs))
+	for i, ch := range lle.chs {
+		chsStr[i] = string(ch)
+	}
+	if t, err := metricTypeByChannels(chsStr); err != nil || t != lle.typ {
+		return Error("Invalid channel list")
+	}
+	return nil
+}
+
 func (lld *LiveLogData) WriteTo(fn string) error {
 	f, err := os.Create(fn)
 	if err != nil {
@@ -102,6 +131,10 @@ func (lld *LiveLogData) WriteTo(fn string) error {
 	defer f.Close()
 	w, le := bufio.NewWriter(f), binary.LittleEndian
 
+	err = binary.Write(w, le, int64(liveLogVersion))
+	if err != nil {
+		return err
+	}
 	err = binary.Write(w, le, lld.ts)
 	if err != nil {
 		return err
@@ -110,6 +143,10 @@ func (lld *LiveLogData) WriteTo(fn string) error {
 	if err != nil {
 		return err
 	}
+	err = binary.Write(w, le, lld.tick)
+	if err != nil {
+		return err
+	}
 	err = binary.Write(w, le, uint64(len(lld.entries)))
 	for _, lle := range lld.entries {
 		if err := lle.writeTo(w); err != nil {
@@ -135,14 +172,29 @@ func (lld *LiveLogData) ReadFrom(fn string) error {
 		size     uint64
 		nentries uint64
 		ts       int64
+		tick     int64 = 1
 	)
 
 	if err = binary.Read(r, le, &ts); err != nil {
 		return err
 	}
+	version := ts == liveLogVersion
+	if version {
+		if err = binary.Read(r, le, &ts); err != nil {
+			return err
+		}
+	}
 	if err = binary.Read(r, le, &size); err != nil {
 		return err
 	}
+	if version {
+		if err = binary.Read(r, le, &tick); err != nil {
+			return err
+		}
+		if tick <= 0 {
+			return Error("Invalid tick in live log")
+		}
+	}
 	if err = binary.Read(r, le, &nentries); err != nil {
 		return err
 	}
@@ -156,6 +208,7 @@ func (lld *LiveLogData) ReadFrom(fn string) error {
 
 	lld.ts = ts
 	lld.size = size
+	lld.tick = tick
 	lld.entries = entries
 	return nil
 }
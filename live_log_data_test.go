@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLiveLogDataRestore(t *testing.T) {
+	// Ticks 97 to 100
+	lld := &LiveLogData{ts: 100, size: 4, tick: 1, entries: []*liveLogEntry{{
+		typ:  Counter,
+		name: []byte("c"),
+		chs:  [][]byte{[]byte("counter")},
+		data: [][]float64{{1, 2, 3, 4}},
+	}}}
+
+	var testCases = []struct {
+		lastTick, size int64
+		live           []float64
+	}{
+		{101, 2, []float64{4, 0}},
+		{101, 6, []float64{0, 1, 2, 3, 4, 0}},
+		{100, 4, []float64{1, 2, 3, 4}},
+		{104, 4, nil},
+	}
+
+	for _, tc := range testCases {
+		srv := &Server{Ds: &MemDatastore{}, lastTick: tc.lastTick, tickIvl: 1, liveSize: tc.size, types: metricTypes}
+		for i := range srv.metrics {
+			srv.metrics[i] = make(map[string]*metricEntry)
+		}
+		lld.restore(srv)
+		me := srv.metrics[Counter]["c"]
+		if tc.live == nil {
+			if me != nil {
+				t.Error("Restored a live log of size", tc.size, "at", tc.lastTick)
+			}
+		} else if me == nil {
+			t.Error("Ignored a live log of size", tc.size, "at", tc.lastTick)
+		} else if !reflect.DeepEqual(me.liveLog[0], tc.live) {
+			t.Error("Restored a live log of size", tc.size, "at", tc.lastTick, "as", me.liveLog[0])
+		}
+	}
+}
@@ -10,29 +10,106 @@ import (
 )
 
 func main() {
-	var dataDir, apiAddr, udpAddr, tcpAddr string
-	var nosync bool
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		os.Exit(fsckMain(os.Args[2:]))
+	}
+
+	var dataDir, apiAddr, udpAddr, tcpAddr, buckets, percentiles string
+	var graphiteAddr, graphiteTypes, influxTcpAddr, influxUdpAddr string
+	var unixPath, unixStreamPath string
+	var nosync, memory bool
+	var memMaxRecords, memMaxTotal int
+	var tcpMaxLine, udpMaxSize, udpWorkers, udpRcvBuf int
+	var tick, resolution, liveLogSize int64
+	var retention, adminToken string
 
 	flag.StringVar(&dataDir, "data", "", "     Data directory")
 	flag.StringVar(&apiAddr, "api", ":5999", " HTTP query API address")
+	flag.StringVar(&adminToken, "admin-token", "", "Bearer token for importing, deleting and renaming series through the API")
 	flag.StringVar(&udpAddr, "udp", ":6000", " UDP input address")
+	flag.IntVar(&udpMaxSize, "udp-max-size", UdpMsgMaxSize, "Maximum size of a UDP datagram")
+	flag.IntVar(&udpWorkers, "udp-workers", 0, "Number of UDP workers (default: number of CPUs)")
+	flag.IntVar(&udpRcvBuf, "udp-rcvbuf", 0, "UDP socket receive buffer size (default: system default)")
 	flag.StringVar(&tcpAddr, "tcp", ":6000", " TCP input address")
+	flag.IntVar(&tcpMaxLine, "tcp-max-line", TcpMsgMaxSize, "Maximum length of a TCP input line")
+	flag.StringVar(&unixPath, "unix", "", "    Unix datagram socket input path")
+	flag.StringVar(&unixStreamPath, "unix-stream", "", "Unix stream socket input path")
+	flag.StringVar(&graphiteAddr, "graphite", "", " Graphite plaintext input address")
+	flag.StringVar(&graphiteTypes, "graphite-types", "", "Graphite metric types by pattern (e.g. *.count=c,*.time=ms)")
+	flag.StringVar(&influxTcpAddr, "influx-tcp", "", "InfluxDB line protocol TCP input address")
+	flag.StringVar(&influxUdpAddr, "influx-udp", "", "InfluxDB line protocol UDP input address")
+	flag.Int64Var(&tick, "tick", 1, "    Live log resolution in seconds")
+	flag.Int64Var(&liveLogSize, "live-log-size", DefaultLiveLogSize, "Number of ticks kept in the live log")
+	flag.Int64Var(&resolution, "resolution", 60, "Archive resolution in seconds (must not change once data is stored)")
+	flag.StringVar(&retention, "retention", "", "Retention policies (e.g. *=1m:30d,1h:2y;stats.*=1m:7d)")
 	flag.BoolVar(&nosync, "nosync", false, "Don't call sync() after every disk write")
+	flag.BoolVar(&memory, "memory", false, "  Keep the archive in memory only (the data directory is optional)")
+	flag.IntVar(&memMaxRecords, "memory-max-records", 0, "Records kept in memory per series (default: no limit)")
+	flag.IntVar(&memMaxTotal, "memory-max-total", 0, "Records kept in memory in all series, oldest first dropped (default: no limit)")
+	flag.StringVar(&buckets, "buckets", "", "  Histogram bucket upper bounds (comma separated)")
+	flag.StringVar(&percentiles, "percentiles", "", "Timer percentiles (comma separated)")
 	flag.Parse()
 
-	if len(dataDir) == 0 {
+	if len(dataDir) == 0 && !memory {
 		os.Stderr.Write([]byte("No data directory specified\n"))
 		return
 	}
 
+	var bounds []float64
+	if len(buckets) > 0 {
+		var err error
+		if bounds, err = ParseHistogramBuckets(buckets); err != nil {
+			os.Stderr.Write([]byte(err.Error() + "\n"))
+			return
+		}
+	}
+
+	if len(percentiles) > 0 {
+		ps, err := ParsePercentiles(percentiles)
+		if err == nil {
+			err = SetTimerPercentiles(ps)
+		}
+		if err != nil {
+			os.Stderr.Write([]byte(err.Error() + "\n"))
+			return
+		}
+	}
+
+	var gts []GraphiteType
+	if len(graphiteTypes) > 0 {
+		var err error
+		if gts, err = ParseGraphiteTypes(graphiteTypes); err != nil {
+			os.Stderr.Write([]byte(err.Error() + "\n"))
+			return
+		}
+	}
+
+	var rps []RetentionPolicy
+	if len(retention) > 0 {
+		var err error
+		if rps, err = ParseRetention(retention); err != nil {
+			os.Stderr.Write([]byte(err.Error() + "\n"))
+			return
+		}
+		if memory {
+			os.Stderr.Write([]byte("Retention policies are not supported in memory\n"))
+			return
+		}
+	}
+
 	log.Println("StatsD starting...")
 
 	sigint := make(chan os.Signal, 1)
 	signal.Notify(sigint, os.Interrupt)
 
-	ds := &FsDatastore{Dir: dataDir, NoSync: nosync}
+	var ds Datastore
+	if memory {
+		ds = &MemDatastore{Interval: resolution, MaxRecords: memMaxRecords, MaxTotal: memMaxTotal}
+	} else {
+		ds = &FsDatastore{Dir: dataDir, NoSync: nosync, Interval: resolution, Retention: rps}
+	}
 	if err := ds.Open(); err != nil {
-		log.Println("FsDatastore.Open:", err)
+		log.Println("Datastore.Open:", err)
 		return
 	}
 	defer func() {
@@ -41,31 +118,38 @@ func main() {
 	}()
 	log.Println("Datastore opened")
 
-	lld := new(LiveLogData)
+	var lld *LiveLogData
+	var wcs []string
 	lldfn := dataDir + string(os.PathSeparator) + "live_log"
-	if err := lld.ReadFrom(lldfn); err != nil {
-		log.Println("Failed to load the live log:", err)
-		lld = nil
-	} else {
-		log.Println("Live log loaded")
-	}
-
 	wcsfn := dataDir + string(os.PathSeparator) + "wildcards"
-	wcs, err := loadWildcards(wcsfn)
-	if err == nil {
-		log.Println("Wildcards loaded")
-	} else {
-		log.Println("Failed to load wildcards:", err)
+	if len(dataDir) > 0 {
+		lld = new(LiveLogData)
+		if err := lld.ReadFrom(lldfn); err != nil {
+			log.Println("Failed to load the live log:", err)
+			lld = nil
+		} else {
+			log.Println("Live log loaded")
+		}
+
+		var err error
+		if wcs, err = loadWildcards(wcsfn); err == nil {
+			log.Println("Wildcards loaded")
+		} else {
+			log.Println("Failed to load wildcards:", err)
+		}
 	}
 
-	srv := &Server{Ds: ds, AutoWc: true}
+	srv := &Server{Ds: ds, AutoWc: true, TickInterval: tick, LiveLogSize: liveLogSize, HistogramBuckets: bounds}
+	if err := srv.Start(lld, wcs); err != nil {
+		log.Println("Server.Start:", err)
+		return
+	}
 	log.Println("Server started")
-	srv.Start(lld, wcs)
 	lld = nil
 
 	var api *HttpApi
 	if len(apiAddr) > 0 {
-		api = &HttpApi{Addr: apiAddr, Server: srv}
+		api = &HttpApi{Addr: apiAddr, Server: srv, AdminToken: adminToken}
 		if err := api.Start(); err != nil {
 			log.Println("HttpApi.Start:", err)
 		}
@@ -74,7 +158,13 @@ func main() {
 
 	var ui *UDPInjector
 	if len(udpAddr) > 0 {
-		ui = &UDPInjector{Addr: udpAddr, Server: srv}
+		ui = &UDPInjector{
+			Addr:       udpAddr,
+			Server:     srv,
+			MaxMsgSize: udpMaxSize,
+			Workers:    udpWorkers,
+			ReadBuffer: udpRcvBuf,
+		}
 		if err := ui.Start(); err != nil {
 			log.Println("UDPInjector.Start:", err)
 			return
@@ -84,7 +174,7 @@ func main() {
 
 	var ti *TCPInjector
 	if len(tcpAddr) > 0 {
-		ti = &TCPInjector{Addr: tcpAddr, Server: srv}
+		ti = &TCPInjector{Addr: tcpAddr, Server: srv, MaxLineSize: tcpMaxLine}
 		if err := ti.Start(); err != nil {
 			log.Println("TCPInjector.Start:", err)
 			return
@@ -92,6 +182,36 @@ func main() {
 		log.Println("Listening on TCP address", ti.Addr)
 	}
 
+	var xi *UnixInjector
+	if len(unixPath) > 0 || len(unixStreamPath) > 0 {
+		xi = &UnixInjector{Path: unixPath, StreamPath: unixStreamPath, Server: srv}
+		if err := xi.Start(); err != nil {
+			log.Println("UnixInjector.Start:", err)
+			return
+		}
+		log.Println("Listening on Unix sockets", xi.Path, xi.StreamPath)
+	}
+
+	var gi *GraphiteInjector
+	if len(graphiteAddr) > 0 {
+		gi = &GraphiteInjector{Addr: graphiteAddr, Server: srv, Types: gts}
+		if err := gi.Start(); err != nil {
+			log.Println("GraphiteInjector.Start:", err)
+			return
+		}
+		log.Println("Listening for Graphite on TCP address", gi.Addr)
+	}
+
+	var ii *InfluxInjector
+	if len(influxTcpAddr) > 0 || len(influxUdpAddr) > 0 {
+		ii = &InfluxInjector{TCPAddr: influxTcpAddr, UDPAddr: influxUdpAddr, Server: srv}
+		if err := ii.Start(); err != nil {
+			log.Println("InfluxInjector.Start:", err)
+			return
+		}
+		log.Println("Listening for InfluxDB line protocol")
+	}
+
 	<-sigint
 	log.Println("Received SIGTERM, stopping...")
 
@@ -108,21 +228,38 @@ func main() {
 		log.Println("TCP injector stopped")
 	}
 
-	if err := lld.WriteTo(lldfn); err == nil {
-		log.Println("Live log saved")
-	} else {
-		log.Println("Failed to save the live log:", err)
-		if err := os.Remove(lldfn); err != nil {
-			log.Println(err)
-		}
+	if xi != nil {
+		xi.Stop()
+		log.Println("Unix injector stopped")
 	}
 
-	if err := saveWildcards(wcsfn, wcs); err == nil {
-		log.Println("Wildcards saved")
-	} else {
-		log.Println("Failed to save wildcards:", err)
-		if err := os.Remove(wcsfn); err != nil {
-			log.Println(err)
+	if gi != nil {
+		gi.Stop()
+		log.Println("Graphite injector stopped")
+	}
+
+	if ii != nil {
+		ii.Stop()
+		log.Println("InfluxDB injector stopped")
+	}
+
+	if len(dataDir) > 0 {
+		if err := lld.WriteTo(lldfn); err == nil {
+			log.Println("Live log saved")
+		} else {
+			log.Println("Failed to save the live log:", err)
+			if err := os.Remove(lldfn); err != nil {
+				log.Println(err)
+			}
+		}
+
+		if err := saveWildcards(wcsfn, wcs); err == nil {
+			log.Println("Wildcards saved")
+		} else {
+			log.Println("Failed to save wildcards:", err)
+			if err := os.Remove(wcsfn); err != nil {
+				log.Println(err)
+			}
 		}
 	}
 
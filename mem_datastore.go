@@ -0,0 +1,359 @@
+package main
+
+import (
+	"log"
+	"math"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// MemDatastore keeps the archive in memory, so it is lost when the
+// process exits. Its behaviour is the reference for other datastores:
+// timestamps must be divisible by the resolution, and inserting a record
+// with the timestamp of an existing one replaces it.
+//
+// MaxTotal limits the records and sketches of all series together. Once it
+// is exceeded, the oldest of them are dropped until a tenth of the limit is
+// free again.
+type MemDatastore struct {
+	Interval   int64
+	MaxRecords int // kept per series, oldest first dropped; 0 for no limit
+	MaxTotal   int // kept in all series; 0 for no limit
+	mu         sync.RWMutex
+	running    bool
+	series     map[string][]Record
+	sketches   map[string][]Sketch
+	total      int
+}
+
+func (ds *MemDatastore) Open() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if ds.running {
+		return Error("Datastore already running")
+	}
+	if ds.series == nil {
+		ds.series = make(map[string][]Record)
+		ds.sketches = make(map[string][]Sketch)
+	}
+	ds.running = true
+	return nil
+}
+
+// Close stops the datastore. The records are kept until it is opened
+// again.
+func (ds *MemDatastore) Close() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if !ds.running {
+		return Error("Datastore not running")
+	}
+	ds.running = false
+	return nil
+}
+
+// Resolution returns the interval between two records in seconds, set by
+// Interval (60 by default).
+func (ds *MemDatastore) Resolution() int64 {
+	if ds.Interval <= 0 {
+		return 60
+	}
+	return ds.Interval
+}
+
+func (ds *MemDatastore) Insert(name string, r Record) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if !ds.running {
+		return Error("Datastore not running")
+	}
+	if res := ds.Resolution(); r.Ts%res != 0 {
+		log.Println("MemDatastore.Insert: Timestamp not divisible by", res)
+		return nil
+	}
+
+	recs := ds.series[name]
+	n := len(recs)
+	if n == 0 || recs[n-1].Ts < r.Ts {
+		recs = append(recs, r)
+	} else if i := searchRecords(recs, r.Ts); recs[i].Ts == r.Ts {
+		recs[i] = r
+	} else {
+		recs = append(recs, Record{})
+		copy(recs[i+1:], recs[i:])
+		recs[i] = r
+	}
+
+	if max := ds.MaxRecords; max > 0 && len(recs) > max {
+		recs = recs[len(recs)-max:]
+		if cap(recs) > 2*max {
+			recs = append(make([]Record, 0, max+max/2), recs...)
+		}
+	}
+	ds.total += len(recs) - n
+	ds.series[name] = recs
+	ds.evict()
+	return nil
+}
+
+// evict drops the oldest records and sketches of all series once there
+// are more than MaxTotal.
+func (ds *MemDatastore) evict() {
+	max := ds.MaxTotal
+	if max <= 0 || ds.total <= max {
+		return
+	}
+
+	// Find the earliest timestamp up to which dropping leaves enough room
+	lo, hi := int64(math.MaxInt64), int64(math.MinInt64)
+	for _, recs := range ds.series {
+		if len(recs) > 0 {
+			lo, hi = min64(lo, recs[0].Ts), max64(hi, recs[len(recs)-1].Ts)
+		}
+	}
+	for _, s := range ds.sketches {
+		if len(s) > 0 {
+			lo, hi = min64(lo, s[0].Ts), max64(hi, s[len(s)-1].Ts)
+		}
+	}
+	keep := max - max/10
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if ds.total-ds.countUpTo(mid) <= keep {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+
+	for name, recs := range ds.series {
+		i := searchRecords(recs, lo+1)
+		if i == len(recs) {
+			delete(ds.series, name)
+		} else if i > 0 {
+			ds.series[name] = append([]Record(nil), recs[i:]...)
+		}
+		ds.total -= i
+	}
+	for name, s := range ds.sketches {
+		i := searchSketches(s, lo+1)
+		if i == len(s) {
+			delete(ds.sketches, name)
+		} else if i > 0 {
+			ds.sketches[name] = append([]Sketch(nil), s[i:]...)
+		}
+		ds.total -= i
+	}
+}
+
+// countUpTo returns the number of records and sketches at or before ts.
+func (ds *MemDatastore) countUpTo(ts int64) int {
+	n := 0
+	for _, recs := range ds.series {
+		n += searchRecords(recs, ts+1)
+	}
+	for _, s := range ds.sketches {
+		n += searchSketches(s, ts+1)
+	}
+	return n
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// searchRecords returns the index of the first record at or after ts.
+func searchRecords(recs []Record, ts int64) int {
+	return sort.Search(len(recs), func(i int) bool { return recs[i].Ts >= ts })
+}
+
+func searchSketches(s []Sketch, ts int64) int {
+	return sort.Search(len(s), func(i int) bool { return s[i].Ts >= ts })
+}
+
+func (ds *MemDatastore) Query(name string, from, until int64) ([]Record, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	if !ds.running {
+		return []Record{}, Error("Datastore not running")
+	}
+
+	recs := ds.series[name]
+	i, j := searchRecords(recs, from), searchRecords(recs, until)
+	if j < len(recs) && recs[j].Ts == until {
+		j++
+	}
+	if i >= j {
+		return []Record{}, nil
+	}
+	return append([]Record(nil), recs[i:j]...), nil
+}
+
+func (ds *MemDatastore) LatestBefore(name string, ts int64) (Record, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	if !ds.running {
+		return Record{}, Error("Datastore not running")
+	}
+
+	recs := ds.series[name]
+	i := searchRecords(recs, ts)
+	if i < len(recs) && recs[i].Ts == ts {
+		return recs[i], nil
+	}
+	if i == 0 {
+		return Record{}, ErrNoData
+	}
+	return recs[i-1], nil
+}
+
+func (ds *MemDatastore) ListNames(pattern string) ([]string, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	r := make([]string, 0)
+	for name := range ds.series {
+		m, err := filepath.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if m {
+			r = append(r, name)
+		}
+	}
+	return r, nil
+}
+
+func (ds *MemDatastore) Delete(pattern string) ([]string, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if !ds.running {
+		return nil, Error("Datastore not running")
+	}
+
+	var r []string
+	for name := range ds.series {
+		m, err := filepath.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if m {
+			r = append(r, name)
+		}
+	}
+	for name := range ds.sketches {
+		m, err := filepath.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if m {
+			r = append(r, name)
+		}
+	}
+	sort.Strings(r)
+	for _, name := range r {
+		ds.total -= len(ds.series[name]) + len(ds.sketches[name])
+		delete(ds.series, name)
+		delete(ds.sketches, name)
+	}
+	return r, nil
+}
+
+func (ds *MemDatastore) Rename(oldSeries, newSeries string) error {
+	if err := checkSeriesName(newSeries); err != nil {
+		return err
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if !ds.running {
+		return Error("Datastore not running")
+	}
+
+	var names, sketches []string
+	for name := range ds.series {
+		switch seriesOf(name) {
+		case oldSeries:
+			names = append(names, name)
+		case newSeries:
+			return Error("Series exists: " + newSeries)
+		}
+	}
+	for name := range ds.sketches {
+		switch seriesOf(name) {
+		case oldSeries:
+			sketches = append(sketches, name)
+		case newSeries:
+			return Error("Series exists: " + newSeries)
+		}
+	}
+	if len(names) == 0 && len(sketches) == 0 {
+		return Error("No such series: " + oldSeries)
+	}
+	for _, name := range names {
+		ds.series[newSeries+name[len(oldSeries):]] = ds.series[name]
+		delete(ds.series, name)
+	}
+	for _, name := range sketches {
+		ds.sketches[newSeries+name[len(oldSeries):]] = ds.sketches[name]
+		delete(ds.sketches, name)
+	}
+	return nil
+}
+
+// InsertSketch adds a sketch, replacing the one with the same timestamp.
+// Sketches are dropped like records once there are more than MaxRecords.
+func (ds *MemDatastore) InsertSketch(name string, sk Sketch) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if !ds.running {
+		return Error("Datastore not running")
+	}
+	if res := ds.Resolution(); sk.Ts%res != 0 {
+		return Error("Timestamp not divisible by resolution")
+	}
+
+	s := ds.sketches[name]
+	n := len(s)
+	i := searchSketches(s, sk.Ts)
+	if i < len(s) && s[i].Ts == sk.Ts {
+		s[i] = sk
+	} else {
+		s = append(s, Sketch{})
+		copy(s[i+1:], s[i:])
+		s[i] = sk
+	}
+	if max := ds.MaxRecords; max > 0 && len(s) > max {
+		s = append([]Sketch(nil), s[len(s)-max:]...)
+	}
+	ds.total += len(s) - n
+	ds.sketches[name] = s
+	ds.evict()
+	return nil
+}
+
+func (ds *MemDatastore) QuerySketches(name string, from, until, gran int64) ([]Sketch, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	if !ds.running {
+		return nil, Error("Datastore not running")
+	}
+
+	var r []Sketch
+	for _, sk := range ds.sketches[name] {
+		if sk.Ts > from && sk.Ts <= until {
+			r = append(r, sk)
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemDatastore(t *testing.T) {
+	ds := &MemDatastore{Interval: 10, MaxRecords: 5}
+	if err := ds.Insert("a", Record{10, 1}); err == nil {
+		t.Fatal("Insert succeeded before Open")
+	}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	for _, r := range []Record{{30, 3}, {10, 1}, {60, 6}, {20, 2}, {25, 0}, {50, 5}, {20, 4}, {70, 7}} {
+		ds.Insert("a", r)
+	}
+
+	var testCases = []struct {
+		from, until int64
+		ts          []int64
+	}{
+		{0, 100, []int64{20, 30, 50, 60, 70}},
+		{21, 59, []int64{30, 50}},
+		{30, 30, []int64{30}},
+		{31, 49, []int64{}},
+		{80, 100, []int64{}},
+	}
+	for _, tc := range testCases {
+		recs, err := ds.Query("a", tc.from, tc.until)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(recs) != len(tc.ts) {
+			t.Fatal("Query", tc.from, tc.until, "returned", recs)
+		}
+		for i, r := range recs {
+			if r.Ts != tc.ts[i] || r.Value != float64(r.Ts/10) && r.Ts != 20 {
+				t.Fatal("Query", tc.from, tc.until, "returned", recs)
+			}
+		}
+	}
+	if recs, _ := ds.Query("a", 20, 20); recs[0].Value != 4 {
+		t.Error("Record not replaced:", recs)
+	}
+
+	if r, err := ds.LatestBefore("a", 45); err != nil || r.Ts != 30 {
+		t.Error("LatestBefore(45) returned", r, err)
+	}
+	if r, err := ds.LatestBefore("a", 50); err != nil || r.Ts != 50 {
+		t.Error("LatestBefore(50) returned", r, err)
+	}
+	if _, err := ds.LatestBefore("a", 19); err != ErrNoData {
+		t.Error("LatestBefore(19) returned", err)
+	}
+
+	if err := ds.Rename("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := ds.ListNames("*"); len(names) != 1 || names[0] != "b" {
+		t.Error("ListNames returned", names)
+	}
+	if names, _ := ds.Delete("b"); len(names) != 1 {
+		t.Error("Delete returned", names)
+	}
+	if _, err := ds.LatestBefore("b", 100); err != ErrNoData {
+		t.Error("Series not deleted")
+	}
+}
+
+func TestServerLog(t *testing.T) {
+	ds := &MemDatastore{Interval: 1}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	srv := &Server{Ds: ds}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	now := time.Now().Unix()
+	from := now - 60
+	for ts := from + 1; ts <= from+10; ts++ {
+		ds.Insert("foo:counter", Record{Ts: ts, Value: 1})
+	}
+
+	data, err := srv.Log("foo", "", []string{"counter"}, from, 5, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 5 {
+		t.Fatal("Log returned", data)
+	}
+	for _, values := range data {
+		if len(values) != 1 || values[0] != 2 {
+			t.Fatal("Log returned", data)
+		}
+	}
+}
+
+func TestMemDatastoreMaxTotal(t *testing.T) {
+	ds := &MemDatastore{Interval: 10, MaxTotal: 20}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	for ts := int64(10); ts <= 100; ts += 10 {
+		ds.Insert("a", Record{ts, 1})
+		ds.Insert("b", Record{ts + 40, 1})
+	}
+	ds.Insert("a", Record{50, 2})
+	if ds.total != 20 {
+		t.Fatal("Total of", ds.total, "records")
+	}
+
+	// The oldest records and sketches of all series are dropped until
+	// there are 18 left
+	ds.InsertSketch("s", Sketch{Ts: 10})
+	if recs, _ := ds.Query("a", 0, 1000); len(recs) != 8 || recs[0].Ts != 30 {
+		t.Error("Kept", recs)
+	}
+	if recs, _ := ds.Query("b", 0, 1000); len(recs) != 10 {
+		t.Error("Kept", recs)
+	}
+	if s, _ := ds.QuerySketches("s", 0, 1000, 10); len(s) != 0 {
+		t.Error("Kept", s)
+	}
+	if names, _ := ds.ListNames("*"); len(names) != 2 || ds.total != 18 {
+		t.Error("Kept", names, "with", ds.total, "records")
+	}
+
+	if names, _ := ds.Delete("b"); len(names) != 1 || ds.total != 8 {
+		t.Error("Deleted", names, "leaving", ds.total, "records")
+	}
+}
@@ -1,6 +1,11 @@
 package main
 
-import "strconv"
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
 
 func ParseMetric(m []byte) (*Metric, error) {
 	var n int
@@ -13,7 +18,7 @@ func ParseMetric(m []byte) (*Metric, error) {
 		if ch == ':' {
 			n = i
 			break
-		} else if ch < 32 || ch == '/' || ch == '\\' || ch == '"' {
+		} else if ch < 32 || ch == '/' || ch == '\\' || ch == '"' || ch == '#' {
 			return nil, Error("Invalid characters in metric name")
 		}
 	}
@@ -36,10 +41,7 @@ func ParseMetric(m []byte) (*Metric, error) {
 	} else if n == -1 || n == len(m)-1 {
 		return nil, Error("Metric type missing")
 	}
-	value, err := strconv.ParseFloat(string(m[:n]), 64)
-	if err != nil {
-		return nil, Error("Metric value invalid")
-	}
+	rawValue := m[:n]
 
 	n, m = -1, m[n+1:]
 	for i, ch := range m {
@@ -51,8 +53,67 @@ func ParseMetric(m []byte) (*Metric, error) {
 	if n == -1 {
 		n = len(m)
 	}
+	typ := parseMetricType(m[:n])
+	if typ == MetricType(-1) {
+		return nil, Error("Metric type invalid")
+	}
+
+	value, setValue := 0.0, ""
+	if typ == Set {
+		for _, ch := range rawValue {
+			if ch < 32 {
+				return nil, Error("Metric value invalid")
+			}
+		}
+		setValue = string(rawValue)
+	} else {
+		v, err := strconv.ParseFloat(string(rawValue), 64)
+		if err != nil {
+			return nil, Error("Metric value invalid")
+		}
+		value = v
+	}
+
+	sr, tags, hasSr, hasTags := 1.0, "", false, false
+	for n != len(m) {
+		if n == len(m)-1 {
+			return nil, Error("Metric field missing")
+		}
+		m = m[n+1:]
+		n = len(m)
+		for i, ch := range m {
+			if ch == '|' {
+				n = i
+				break
+			}
+		}
+		switch {
+		case m[0] == '@' && !hasSr:
+			s, err := strconv.ParseFloat(string(m[1:n]), 64)
+			if err != nil || s <= 0 {
+				return nil, Error("Sample rate invalid")
+			}
+			sr, hasSr = s, true
+		case m[0] == '#' && !hasTags:
+			if n == 1 {
+				return nil, Error("Tags missing")
+			}
+			t, err := ParseTags(string(m[1:n]))
+			if err != nil {
+				return nil, err
+			}
+			tags, hasTags = t, true
+		default:
+			return nil, Error("Metric field invalid")
+		}
+	}
+
+	return &Metric{string(name), typ, value, sr, tags, setValue}, nil
+}
+
+func parseMetricType(m []byte) MetricType {
 	typ := MetricType(-1)
-	if n == 1 {
+	if len(m) == 1 {
 		switch m[0] {
 		case 'c':
 			typ = Counter
@@ -60,35 +121,277 @@ func ParseMetric(m []byte) (*Metric, error) {
 			typ = Gauge
 		case 'a':
 			typ = Averager
+		case 's':
+			typ = Set
+		case 'h', 'd':
+			typ = Histogram
 		}
-	} else if n == 2 {
+	} else if len(m) == 2 {
 		if m[0] == 'm' && m[1] == 's' {
 			typ = Timer
 		} else if m[0] == 'a' && m[1] == 'c' {
 			typ = Accumulator
 		}
 	}
-	if typ == MetricType(-1) {
-		return nil, Error("Metric type invalid")
+	return typ
+}
+
+// ParseGraphite parses a line of the Graphite plaintext protocol
+// ("path value timestamp"). Graphite tags ("path;tag=value") are turned
+// into tags. The metric is a gauge; the returned timestamp is -1 if the
+// line asks for the current time.
+func ParseGraphite(m []byte) (*Metric, int64, error) {
+	fields := strings.Fields(string(m))
+	if len(fields) != 3 {
+		return nil, 0, Error("Invalid number of fields")
 	}
 
-	sr := 1.0
-	if n != len(m) {
-		if n == len(m)-1 {
-			return nil, Error("Sample rate missing")
+	s := strings.Split(fields[0], ";")
+	name := s[0]
+	if err := CheckMetricName(name); err != nil {
+		return nil, 0, err
+	}
+	for i, tag := range s[1:] {
+		s[i+1] = strings.Replace(tag, "=", ":", 1)
+	}
+	tags, err := ParseTags(strings.Join(s[1:], ","))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return nil, 0, Error("Metric value invalid")
+	}
+
+	ts, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil || math.IsNaN(ts) || ts >= math.MaxInt64 || ts < math.MinInt64 {
+		return nil, 0, Error("Timestamp invalid")
+	}
+	if ts <= 0 {
+		ts = -1
+	}
+
+	return &Metric{name, Gauge, value, 1, tags, ""}, int64(ts), nil
+}
+
+// ParseImport parses a line of the import format,
+// "name[#tags]:channel timestamp value". Tags are canonicalized.
+func ParseImport(m []byte) (*ImportRecord, error) {
+	s := strings.TrimSpace(string(m))
+	i := strings.LastIndexAny(s, " \t")
+	if i == -1 {
+		return nil, Error("Invalid number of fields")
+	}
+	value, s := s[i+1:], strings.TrimSpace(s[:i])
+	i = strings.LastIndexAny(s, " \t")
+	if i == -1 {
+		return nil, Error("Invalid number of fields")
+	}
+	ts, s := s[i+1:], strings.TrimSpace(s[:i])
+
+	i = strings.LastIndex(s, ":")
+	if i == -1 {
+		return nil, Error("Channel missing")
+	}
+	rec := &ImportRecord{Channel: s[i+1:]}
+	if _, ok := channelType(rec.Channel); !ok {
+		return nil, Error("No such channel: " + rec.Channel)
+	}
+	name, tags := splitSeriesName(s[:i])
+	if err := CheckMetricName(name); err != nil {
+		return nil, err
+	}
+	var err error
+	if rec.Tags, err = ParseTags(tags); err != nil {
+		return nil, err
+	}
+	rec.Name = name
+
+	if rec.Ts, err = strconv.ParseInt(ts, 10, 64); err != nil {
+		return nil, Error("Timestamp invalid")
+	}
+	if rec.Value, err = strconv.ParseFloat(value, 64); err != nil {
+		return nil, Error("Value invalid")
+	}
+	return rec, nil
+}
+
+// ParseInflux parses a line of the InfluxDB line protocol into one gauge
+// per numeric or boolean field. Fields are named measurement.field, except
+// "value" which is named after the measurement. The returned timestamp is
+// in seconds (precision is the length of a timestamp unit in nanoseconds),
+// it is -1 if the line has no timestamp.
+func ParseInflux(m []byte, precision int64) ([]*Metric, int64, error) {
+	sections := splitUnescaped(strings.TrimRight(string(m), "\r\n"), ' ', true)
+	if len(sections) < 2 || len(sections) > 3 {
+		return nil, 0, Error("Invalid number of sections")
+	}
+
+	key := splitUnescaped(sections[0], ',', false)
+	measurement := unescapeInflux(key[0])
+	if err := CheckMetricName(measurement); err != nil {
+		return nil, 0, err
+	}
+	tags := make([]string, len(key)-1)
+	for i, tag := range key[1:] {
+		kv := splitUnescaped(tag, '=', false)
+		if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+			return nil, 0, Error("Invalid tag: " + tag)
+		}
+		// Checked before joining, an escaped comma would split the tag
+		tags[i] = unescapeInflux(kv[0]) + ":" + unescapeInflux(kv[1])
+		if err := checkTag(tags[i]); err != nil {
+			return nil, 0, err
+		}
+	}
+	tagStr, err := ParseTags(strings.Join(tags, ","))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ts := int64(-1)
+	if len(sections) == 3 {
+		t, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return nil, 0, Error("Timestamp invalid")
+		}
+		if precision >= 1e9 {
+			ts = t * (precision / 1e9)
+		} else {
+			ts = t / (1e9 / precision)
+		}
+	}
+
+	var metrics []*Metric
+	for _, field := range splitUnescaped(sections[1], ',', true) {
+		kv := splitUnescaped(field, '=', true)
+		if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+			return nil, 0, Error("Invalid field: " + field)
 		}
-		if m[n+1] != '@' {
-			return nil, Error("Sample rate invalid")
+		name, v := measurement, kv[1]
+		if fk := unescapeInflux(kv[0]); fk != "value" {
+			name += "." + fk
 		}
-		s, err := strconv.ParseFloat(string(m[n+2:]), 64)
-		if err != nil || s <= 0 {
-			return nil, Error("Sample rate invalid")
+		if err := CheckMetricName(name); err != nil {
+			return nil, 0, err
 		}
 
-		sr = s
+		var value float64
+		switch {
+		case v[0] == '"':
+			continue
+		case v == "t" || v == "T" || v == "true" || v == "True" || v == "TRUE":
+			value = 1
+		case v == "f" || v == "F" || v == "false" || v == "False" || v == "FALSE":
+			value = 0
+		case v[len(v)-1] == 'i' || v[len(v)-1] == 'u':
+			v = v[:len(v)-1]
+			fallthrough
+		default:
+			if value, err = strconv.ParseFloat(v, 64); err != nil {
+				return nil, 0, Error("Field value invalid: " + field)
+			}
+		}
+		metrics = append(metrics, &Metric{name, Gauge, value, 1, tagStr, ""})
 	}
+	return metrics, ts, nil
+}
 
-	return &Metric{string(name), typ, value, sr}, nil
+func splitUnescaped(s string, sep byte, quotes bool) []string {
+	var r []string
+	quoted, j := false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '"' && quotes:
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			r = append(r, s[j:i])
+			j = i + 1
+		}
+	}
+	return append(r, s[j:])
+}
+
+func unescapeInflux(s string) string {
+	if strings.Index(s, "\\") == -1 {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// ParseTags validates a comma separated list of DogStatsD style tags
+// and returns it in canonical (sorted, deduplicated) form.
+func ParseTags(s string) (string, error) {
+	if len(s) == 0 {
+		return "", nil
+	}
+	tags := strings.Split(s, ",")
+	for _, tag := range tags {
+		if err := checkTag(tag); err != nil {
+			return "", err
+		}
+	}
+	sort.Strings(tags)
+	r := tags[:1]
+	for _, tag := range tags[1:] {
+		if tag != r[len(r)-1] {
+			r = append(r, tag)
+		}
+	}
+	return strings.Join(r, ","), nil
+}
+
+func checkTag(tag string) error {
+	if len(tag) == 0 {
+		return Error("Empty tag")
+	}
+	for _, ch := range tag {
+		if ch < 32 || ch == '/' || ch == '\\' || ch == '"' || ch == '|' || ch == '#' || ch == ',' {
+			return Error("Invalid characters in tag")
+		}
+	}
+	return nil
+}
+
+// MatchTags reports whether every tag of the canonical filter list is
+// present in the canonical tag list.
+func MatchTags(tags, filter string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	have := strings.Split(tags, ",")
+	for _, tag := range strings.Split(filter, ",") {
+		i := sort.SearchStrings(have, tag)
+		if i == len(have) || have[i] != tag {
+			return false
+		}
+	}
+	return true
+}
+
+// SeriesName returns the name identifying a metric with the given tags.
+func SeriesName(name, tags string) string {
+	if len(tags) == 0 {
+		return name
+	}
+	return name + "#" + tags
+}
+
+func splitSeriesName(series string) (string, string) {
+	if i := strings.Index(series, "#"); i != -1 {
+		return series[:i], series[i+1:]
+	}
+	return series, ""
 }
 
 func CheckMetricName(name string) error {
@@ -96,7 +399,7 @@ func CheckMetricName(name string) error {
 		return Error("Empty metric name")
 	}
 	for _, ch := range name {
-		if ch < 32 || ch == '/' || ch == '\\' || ch == '"' || ch == ':' {
+		if ch < 32 || ch == '/' || ch == '\\' || ch == '"' || ch == ':' || ch == '#' {
 			return Error("Invalid characters in metric name")
 		}
 	}
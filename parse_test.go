@@ -38,12 +38,27 @@ func TestParseMetric(t *testing.T) {
 		{"test:1.5||@0.1", nil},
 		{"test:1.5||", nil},
 		{"test:1.5|c|@0", nil},
-		{"test:1.5|c", &Metric{"test", Counter, 1.5, 1.0}},
-		{"test:1.5|c|@0.1", &Metric{"test", Counter, 1.5, 0.1}},
-		{"test:1.5|g", &Metric{"test", Gauge, 1.5, 1.0}},
-		{"test:1.5|a", &Metric{"test", Averager, 1.5, 1.0}},
-		{"test:1.5|ms", &Metric{"test", Timer, 1.5, 1.0}},
-		{"test:1.5|ac", &Metric{"test", Accumulator, 1.5, 1.0}},
+		{"test:1.5|c", &Metric{"test", Counter, 1.5, 1.0, "", ""}},
+		{"test:1.5|c|@0.1", &Metric{"test", Counter, 1.5, 0.1, "", ""}},
+		{"test:1.5|g", &Metric{"test", Gauge, 1.5, 1.0, "", ""}},
+		{"test:1.5|a", &Metric{"test", Averager, 1.5, 1.0, "", ""}},
+		{"test:1.5|ms", &Metric{"test", Timer, 1.5, 1.0, "", ""}},
+		{"test:1.5|ac", &Metric{"test", Accumulator, 1.5, 1.0, "", ""}},
+		{"test:1.5|c|#env:prod", &Metric{"test", Counter, 1.5, 1.0, "env:prod", ""}},
+		{"test:1.5|c|@0.1|#b,a,b", &Metric{"test", Counter, 1.5, 0.1, "a,b", ""}},
+		{"test:1.5|c|#a|@0.1", &Metric{"test", Counter, 1.5, 0.1, "a", ""}},
+		{"test:1.5|c|#", nil},
+		{"test:1.5|c|#a,", nil},
+		{"test:1.5|c|#a/b", nil},
+		{"test:1.5|c|#a|", nil},
+		{"test:1.5|c|#a|#b", nil},
+		{"test:1.5|c|@0.1|@0.1", nil},
+		{"te#st:1.5|c", nil},
+		{"test:1.5|s", &Metric{"test", Set, 0, 1.0, "", "1.5"}},
+		{"test:user42|s|#a", &Metric{"test", Set, 0, 1.0, "a", "user42"}},
+		{"test:user42|c", nil},
+		{"test:1.5|h", &Metric{"test", Histogram, 1.5, 1.0, "", ""}},
+		{"test:1.5|d|@0.5", &Metric{"test", Histogram, 1.5, 0.5, "", ""}},
 		{"test:1.5|x", nil},
 		{"test:1.5|xy", nil},
 		{"test:1.5|xyz", nil},
@@ -78,6 +93,146 @@ func TestParseMetric(t *testing.T) {
 	}
 }
 
+func TestParseGraphite(t *testing.T) {
+	var testCases = []struct {
+		s  string
+		m  *Metric
+		ts int64
+	}{
+		{"", nil, 0},
+		{"test", nil, 0},
+		{"test 1.5", nil, 0},
+		{"test X 1400000000", nil, 0},
+		{"test 1.5 X", nil, 0},
+		{"te/st 1.5 1400000000", nil, 0},
+		{"test 1.5 1400000000 X", nil, 0},
+		{"test;a=b;c 1.5 1400000000", &Metric{"test", Gauge, 1.5, 1.0, "a:b,c", ""}, 1400000000},
+		{"test 1.5 1400000000", &Metric{"test", Gauge, 1.5, 1.0, "", ""}, 1400000000},
+		{"test  1.5\t1400000000.7", &Metric{"test", Gauge, 1.5, 1.0, "", ""}, 1400000000},
+		{"test 1.5 -1", &Metric{"test", Gauge, 1.5, 1.0, "", ""}, -1},
+		{"test 1.5 NaN", nil, 0},
+		{"test 1.5 Inf", nil, 0},
+		{"test 1.5 -Inf", nil, 0},
+		{"test 1.5 1e300", nil, 0},
+		{"test 1.5 9223372036854775808", nil, 0},
+	}
+
+	for _, tc := range testCases {
+		m, ts, err := ParseGraphite([]byte(tc.s))
+		if tc.m == nil {
+			if m != nil {
+				t.Error("Parsing should have failed:", tc.s)
+				t.Error("Returned:", *m)
+			} else if err == nil {
+				t.Error("nil error:", tc.s)
+			}
+		} else {
+			if m == nil {
+				t.Error("Parsing shouldn't have failed:", tc.s)
+				t.Error("Error:", err)
+			} else if *tc.m != *m || tc.ts != ts {
+				t.Error("Incorrect result:", tc.s)
+				t.Error("Expected:", *tc.m, tc.ts)
+				t.Error("Returned:", *m, ts)
+			}
+		}
+		if t.Failed() {
+			return
+		}
+	}
+}
+
+func TestParseImport(t *testing.T) {
+	var testCases = []struct {
+		s string
+		r *ImportRecord
+	}{
+		{"", nil},
+		{"test:gauge 1400000000", nil},
+		{"test 1400000000 1.5", nil},
+		{"test:nope 1400000000 1.5", nil},
+		{"te/st:value 1400000000 1.5", nil},
+		{"test:gauge X 1.5", nil},
+		{"test:gauge 1400000000 X", nil},
+		{"test:gauge 1400000000 1.5", &ImportRecord{"test", "", "gauge", Record{1400000000, 1.5}}},
+		{"test#c,a:b:counter  1400000000\t2", &ImportRecord{"test", "a:b,c", "counter", Record{1400000000, 2}}},
+		{"my test:gauge 1400000000 1.5", &ImportRecord{"my test", "", "gauge", Record{1400000000, 1.5}}},
+	}
+
+	for _, tc := range testCases {
+		r, err := ParseImport([]byte(tc.s))
+		if tc.r == nil {
+			if r != nil {
+				t.Error("Parsing should have failed:", tc.s)
+				t.Error("Returned:", *r)
+			} else if err == nil {
+				t.Error("nil error:", tc.s)
+			}
+		} else {
+			if r == nil {
+				t.Error("Parsing shouldn't have failed:", tc.s)
+				t.Error("Error:", err)
+			} else if *tc.r != *r {
+				t.Error("Incorrect result:", tc.s)
+				t.Error("Expected:", *tc.r)
+				t.Error("Returned:", *r)
+			}
+		}
+		if t.Failed() {
+			return
+		}
+	}
+}
+
+func TestParseInflux(t *testing.T) {
+	var testCases = []struct {
+		s  string
+		ms []Metric
+		ts int64
+	}{
+		{"", nil, 0},
+		{"cpu", nil, 0},
+		{"cpu value=X", nil, 0},
+		{"cpu,host value=1", nil, 0},
+		{"cpu value=1 X", nil, 0},
+		{"cpu value=1 1 X", nil, 0},
+		{"cp/u value=1", nil, 0},
+		{"cpu,host=a\\,b value=1", nil, 0},
+		{"cpu value=1.5", []Metric{{"cpu", Gauge, 1.5, 1, "", ""}}, -1},
+		{"cpu value=2i 1400000000000000000", []Metric{{"cpu", Gauge, 2, 1, "", ""}}, 1400000000},
+		{"cpu,host=a,env=b idle=1,busy=t,s=\"x y\"",
+			[]Metric{{"cpu.idle", Gauge, 1, 1, "env:b,host:a", ""}, {"cpu.busy", Gauge, 1, 1, "env:b,host:a", ""}}, -1},
+		{"c\\ pu,ho\\=st=a\\ b value=1\n",
+			[]Metric{{"c pu", Gauge, 1, 1, "ho=st:a b", ""}}, -1},
+	}
+
+	for _, tc := range testCases {
+		ms, ts, err := ParseInflux([]byte(tc.s), 1)
+		if tc.ms == nil {
+			if err == nil {
+				t.Error("Parsing should have failed:", tc.s)
+			}
+		} else if err != nil {
+			t.Error("Parsing shouldn't have failed:", tc.s)
+			t.Error("Error:", err)
+		} else if len(ms) != len(tc.ms) || ts != tc.ts {
+			t.Error("Incorrect result:", tc.s)
+			t.Error("Returned:", len(ms), ts)
+		} else {
+			for i, m := range ms {
+				if *m != tc.ms[i] {
+					t.Error("Incorrect result:", tc.s)
+					t.Error("Expected:", tc.ms[i])
+					t.Error("Returned:", *m)
+				}
+			}
+		}
+		if t.Failed() {
+			return
+		}
+	}
+}
+
 func TestCheckMetricName(t *testing.T) {
 	var testCases = []struct {
 		s  string
@@ -89,6 +244,7 @@ func TestCheckMetricName(t *testing.T) {
 		{"te\nst", false},
 		{"te:st", false},
 		{"te\"st", false},
+		{"te#st", false},
 		{"test", true},
 	}
 
@@ -109,3 +265,66 @@ func TestCheckMetricName(t *testing.T) {
 		}
 	}
 }
+
+func TestParseTags(t *testing.T) {
+	var testCases = []struct {
+		s, tags string
+		ok      bool
+	}{
+		{"", "", true},
+		{"a", "a", true},
+		{"host:web1,env:prod", "env:prod,host:web1", true},
+		{"b,a,b", "a,b", true},
+		{",", "", false},
+		{"a,,b", "", false},
+		{"a|b", "", false},
+		{"a#b", "", false},
+		{"a/b", "", false},
+	}
+
+	for _, tc := range testCases {
+		tags, err := ParseTags(tc.s)
+		if tc.ok {
+			if err != nil {
+				t.Error("Should have been accepted:", tc.s)
+				t.Error("Error:", err)
+			} else if tags != tc.tags {
+				t.Error("Incorrect result:", tc.s)
+				t.Error("Expected:", tc.tags)
+				t.Error("Returned:", tags)
+			}
+		} else {
+			if err == nil {
+				t.Error("Shouldn't have been accepted:", tc.s)
+			}
+		}
+		if t.Failed() {
+			return
+		}
+	}
+}
+
+func TestMatchTags(t *testing.T) {
+	var testCases = []struct {
+		tags, filter string
+		ok           bool
+	}{
+		{"", "", true},
+		{"a,b", "", true},
+		{"a,b", "a", true},
+		{"a,b", "a,b", true},
+		{"a,b", "c", false},
+		{"a,b", "a,c", false},
+		{"", "a", false},
+	}
+
+	for _, tc := range testCases {
+		if MatchTags(tc.tags, tc.filter) != tc.ok {
+			t.Error("Incorrect result:", tc.tags, tc.filter)
+			t.Error("Expected:", tc.ok)
+		}
+		if t.Failed() {
+			return
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The Prometheus endpoint exposes the latest tick of the live metrics.
+// Counters are exposed as counters named <name>_total, which count the
+// values of all ticks since the metric became live; timers as summaries
+// with the quartiles and percentiles of the latest tick; histograms as
+// histograms; and the other types as gauges. Tags of the form key:value
+// become labels, tags without a value become labels with the value
+// "true".
+
+const promContentType = "text/plain; version=0.0.4"
+
+type promMetric struct {
+	family string
+	typ    string
+	labels string
+	cv     *CurrentValue
+}
+
+type promMetrics []promMetric
+
+func (s promMetrics) Len() int { return len(s) }
+func (s promMetrics) Less(i, j int) bool {
+	if s[i].family != s[j].family {
+		return s[i].family < s[j].family
+	}
+	return s[i].labels < s[j].labels
+}
+func (s promMetrics) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+func (ha *HttpApi) servePrometheus(rw http.ResponseWriter, rq *http.Request) {
+	cvs, err := ha.Server.CurrentValues()
+	if err != nil {
+		ha.sendError(err, rw)
+		return
+	}
+
+	var ms []promMetric
+	for i := range cvs {
+		cv := &cvs[i]
+		if strings.Contains(cv.Name, "*") {
+			continue
+		}
+		m := promMetric{family: promName(cv.Name), labels: promLabels(cv.Tags), cv: cv}
+		switch cv.Type {
+		case Counter:
+			m.family, m.typ = m.family+"_total", "counter"
+		case Timer:
+			m.typ = "summary"
+		case Histogram:
+			m.typ = "histogram"
+		default:
+			m.typ = "gauge"
+		}
+		ms = append(ms, m)
+	}
+	sort.Sort(promMetrics(ms))
+
+	rw.Header().Set("Content-Type", promContentType)
+	w := bufio.NewWriter(rw)
+	families, series := make(map[string]string), make(map[string]bool)
+	for _, m := range ms {
+		// Different metrics may be mapped onto the same name
+		if typ, ok := families[m.family]; ok && typ != m.typ || series[m.family+m.labels] {
+			continue
+		}
+		if _, ok := families[m.family]; !ok {
+			families[m.family] = m.typ
+			w.WriteString("# TYPE " + m.family + " " + m.typ + "\n")
+		}
+		series[m.family+m.labels] = true
+		writePromMetric(w, m)
+	}
+	w.Flush()
+}
+
+func writePromMetric(w *bufio.Writer, m promMetric) {
+	cv := m.cv
+	switch cv.Type {
+	case Counter:
+		writePromSample(w, m.family, m.labels, "", cv.Totals[0])
+	case Timer:
+		for i, ch := range metricTypes[Timer].channels {
+			if q, ok := timerQuantile(ch); ok {
+				writePromSample(w, m.family, m.labels, `quantile="`+strconv.FormatFloat(q, 'g', 12, 64)+`"`, cv.Values[i])
+			}
+		}
+		writePromSample(w, m.family+"_sum", m.labels, "", cv.Totals[getChannelIndex(Timer, "timer-sum")])
+		writePromSample(w, m.family+"_count", m.labels, "", cv.Totals[getChannelIndex(Timer, "timer-cnt")])
+	case Histogram:
+		cnt := 0.0
+		for i, ch := range cv.Channels[2:] {
+			cnt += cv.Totals[i+2]
+			le := strings.TrimPrefix(ch, "hist-")
+			if le == "inf" {
+				le = "+Inf"
+			}
+			writePromSample(w, m.family+"_bucket", m.labels, `le="`+le+`"`, cnt)
+		}
+		writePromSample(w, m.family+"_sum", m.labels, "", cv.Totals[1])
+		writePromSample(w, m.family+"_count", m.labels, "", cv.Totals[0])
+	default:
+		writePromSample(w, m.family, m.labels, "", cv.Values[0])
+	}
+}
+
+func writePromSample(w *bufio.Writer, name, labels, extra string, v float64) {
+	w.WriteString(name)
+	if labels != "" && extra != "" {
+		labels += ","
+	}
+	if labels+extra != "" {
+		w.WriteString("{" + labels + extra + "}")
+	}
+	w.WriteString(" " + formatPromValue(v) + "\n")
+}
+
+// timerQuantile returns the quantile of a timer channel, if it is one. It
+// is rounded when formatted, as percentiles like 99.9 aren't exact.
+func timerQuantile(ch string) (float64, bool) {
+	switch ch {
+	case "timer-min":
+		return 0, true
+	case "timer-quart1":
+		return 0.25, true
+	case "timer-median":
+		return 0.5, true
+	case "timer-quart3":
+		return 0.75, true
+	case "timer-max":
+		return 1, true
+	}
+	if strings.HasPrefix(ch, "timer-p") {
+		if p, err := strconv.ParseFloat(ch[len("timer-p"):], 64); err == nil {
+			return p / 100, true
+		}
+	}
+	return 0, false
+}
+
+func formatPromValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// promName replaces the characters of a metric name which are invalid in
+// Prometheus names by underscores.
+func promName(s string) string {
+	r := []byte(s)
+	for i, c := range r {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == ':' || c >= '0' && c <= '9' && i > 0) {
+			r[i] = '_'
+		}
+	}
+	return string(r)
+}
+
+// promLabels formats canonical tags as Prometheus labels. Only the first
+// of several tags with the same key is kept. Tags can't contain quotes or
+// backslashes, so the values need no escaping.
+func promLabels(tags string) string {
+	if tags == "" {
+		return ""
+	}
+	var r []string
+	seen := make(map[string]bool)
+	for _, tag := range strings.Split(tags, ",") {
+		k, v := tag, "true"
+		if i := strings.IndexByte(tag, ':'); i != -1 {
+			k, v = tag[:i], tag[i+1:]
+		}
+		k = strings.Replace(promName(k), ":", "_", -1)
+		if k == "" || seen[k] || strings.HasPrefix(k, "__") {
+			continue
+		}
+		seen[k] = true
+		r = append(r, k+`="`+v+`"`)
+	}
+	return strings.Join(r, ",")
+}
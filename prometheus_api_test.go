@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestPromLabels(t *testing.T) {
+	var testCases = []struct {
+		tags, labels string
+	}{
+		{"", ""},
+		{"host:a", `host="a"`},
+		{"dc:eu,host:a", `dc="eu",host="a"`},
+		{"canary", `canary="true"`},
+		{"host:a,host:b", `host="a"`},
+		{"my.tag:x:y", `my_tag="x:y"`},
+		{"__name__:x,:y", ""},
+	}
+
+	for _, tc := range testCases {
+		if labels := promLabels(tc.tags); labels != tc.labels {
+			t.Error("Incorrect result:", tc.tags)
+			t.Error("Expected:", tc.labels)
+			t.Error("Returned:", labels)
+		}
+	}
+}
+
+func TestWritePromMetric(t *testing.T) {
+	ht := histogramType(defaultHistogramBuckets)
+	bounds := make([]float64, len(ht.channels))
+	bounds[0], bounds[1], bounds[2], bounds[len(bounds)-1] = 3, 12, 1, 2
+	var testCases = []struct {
+		m   promMetric
+		out string
+	}{
+		{
+			promMetric{"web_hits_total", "counter", `host="a"`, &CurrentValue{Type: Counter, Values: []float64{2}, Totals: []float64{10}}},
+			"web_hits_total{host=\"a\"} 10\n",
+		},
+		{
+			promMetric{"temp", "gauge", "", &CurrentValue{Type: Gauge, Values: []float64{math.NaN()}}},
+			"temp NaN\n",
+		},
+		{
+			promMetric{"size", "histogram", "", &CurrentValue{Type: Histogram, Channels: ht.channels, Totals: bounds}},
+			"size_bucket{le=\"1\"} 1\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		writePromMetric(w, tc.m)
+		w.Flush()
+		out := buf.String()
+		if tc.m.typ == "histogram" {
+			if !bytes.HasPrefix(buf.Bytes(), []byte(tc.out)) ||
+				!bytes.HasSuffix(buf.Bytes(), []byte("size_bucket{le=\"+Inf\"} 3\nsize_sum 12\nsize_count 3\n")) {
+				t.Error("Incorrect histogram:", out)
+			}
+		} else if out != tc.out {
+			t.Error("Incorrect result:", tc.m.family)
+			t.Error("Expected:", tc.out)
+			t.Error("Returned:", out)
+		}
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	fsDsRetentionInterval = 10 * time.Minute
+	fsDsRollupChunk       = 1440
+)
+
+// RetentionTier keeps records of Resolution seconds for Keep seconds, or
+// forever if Keep is 0.
+type RetentionTier struct {
+	Resolution int64
+	Keep       int64
+}
+
+// RetentionPolicy applies to the series whose datastore name (without the
+// channel) matches Pattern. The first tier must have the resolution of the
+// datastore, every other tier is rolled up from the one before it.
+type RetentionPolicy struct {
+	Pattern string
+	Tiers   []RetentionTier
+}
+
+// ParseRetention parses a semicolon separated list of policies such as
+// "*=1m:30d,1h:2y;stats.*=1m:7d,10m". Durations are in seconds unless
+// followed by s, m, h, d, w or y.
+func ParseRetention(s string) ([]RetentionPolicy, error) {
+	var r []RetentionPolicy
+	for _, rule := range strings.Split(s, ";") {
+		kv := strings.SplitN(rule, "=", 2)
+		if len(kv) != 2 {
+			return nil, Error("Invalid retention policy: " + rule)
+		}
+		p := RetentionPolicy{Pattern: kv[0]}
+		for _, tier := range strings.Split(kv[1], ",") {
+			rk := strings.SplitN(tier, ":", 2)
+			res, err := parseDuration(rk[0])
+			if err != nil {
+				return nil, err
+			}
+			var keep int64
+			if len(rk) == 2 {
+				if keep, err = parseDuration(rk[1]); err != nil {
+					return nil, err
+				}
+			}
+			p.Tiers = append(p.Tiers, RetentionTier{Resolution: res, Keep: keep})
+		}
+		r = append(r, p)
+	}
+	return r, nil
+}
+
+func parseDuration(s string) (int64, error) {
+	units := map[byte]int64{
+		's': 1,
+		'm': 60,
+		'h': 3600,
+		'd': 86400,
+		'w': 7 * 86400,
+		'y': 365 * 86400,
+	}
+	mul := int64(1)
+	if len(s) > 0 {
+		if u, ok := units[s[len(s)-1]]; ok {
+			s, mul = s[:len(s)-1], u
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, Error("Invalid duration: " + s)
+	}
+	return n * mul, nil
+}
+
+func (ds *FsDatastore) checkRetention() error {
+	for _, p := range ds.Retention {
+		if len(p.Tiers) == 0 {
+			return Error("No retention tiers: " + p.Pattern)
+		}
+		if p.Tiers[0].Resolution != ds.res {
+			return Error("First retention tier must have the datastore resolution: " + p.Pattern)
+		}
+		for i := 1; i < len(p.Tiers); i++ {
+			prev, res := p.Tiers[i-1].Resolution, p.Tiers[i].Resolution
+			if res <= prev || res%prev != 0 {
+				return Error("Retention tiers must be multiples of each other: " + p.Pattern)
+			}
+		}
+	}
+	return nil
+}
+
+func (ds *FsDatastore) retentionPolicy(base string) *RetentionPolicy {
+	for i := range ds.Retention {
+		if MatchMetricName(base, ds.Retention[i].Pattern) {
+			return &ds.Retention[i]
+		}
+	}
+	return nil
+}
+
+// tierName returns the name of the stream keeping name at resolution res.
+func (ds *FsDatastore) tierName(name string, res int64) string {
+	if res == ds.res {
+		return name
+	}
+	return name + "@" + strconv.FormatInt(res, 10)
+}
+
+// isTierName reports whether name is a rolled up stream, which is not
+// listed by ListNames.
+func isTierName(name string) bool {
+	return strings.Contains(name[strings.LastIndex(name, ":")+1:], "@")
+}
+
+func (ds *FsDatastore) streamRes(name string) int64 {
+	ch := name[strings.LastIndex(name, ":")+1:]
+	if i := strings.Index(ch, "@"); i != -1 {
+		if res, err := strconv.ParseInt(ch[i+1:], 10, 64); err == nil && res > 0 {
+			return res
+		}
+	}
+	return ds.res
+}
+
+// tiers returns the resolutions kept for name, finest first.
+func (ds *FsDatastore) tiers(name string) []int64 {
+	var p *RetentionPolicy
+	if i := strings.LastIndex(name, ":"); i != -1 {
+		p = ds.retentionPolicy(name[:i])
+	}
+	if p == nil {
+		return []int64{ds.res}
+	}
+	r := make([]int64, len(p.Tiers))
+	for i, t := range p.Tiers {
+		r[i] = t.Resolution
+	}
+	return r
+}
+
+// QueryGranularity returns the records of name in (from, until] from the
+// coarsest tier whose resolution divides both from and gran. The time not
+// yet rolled up into that tier is filled from the finer tiers.
+func (ds *FsDatastore) QueryGranularity(name string, from, until, gran int64) ([]Record, error) {
+	tiers, start := ds.tiers(name), from
+	var result []Record
+	for i := len(tiers) - 1; i >= 0; i-- {
+		res := tiers[i]
+		if gran%res != 0 || start%res != 0 {
+			continue
+		}
+		recs, err := ds.Query(ds.tierName(name, res), from+res, until)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, recs...)
+		if len(recs) > 0 {
+			from = recs[len(recs)-1].Ts
+		}
+	}
+	return result, nil
+}
+
+// QuerySketches returns the sketches of name in (from, until] from the
+// tiers QueryGranularity would use.
+func (ds *FsDatastore) QuerySketches(name string, from, until, gran int64) ([]Sketch, error) {
+	tiers, start := ds.tiers(name), from
+	var result []Sketch
+	for i := len(tiers) - 1; i >= 0; i-- {
+		res := tiers[i]
+		if gran%res != 0 || start%res != 0 {
+			continue
+		}
+		s, err := ds.querySketches(ds.tierName(name, res), from+res, until)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, s...)
+		if len(s) > 0 {
+			from = s[len(s)-1].Ts
+		}
+	}
+	return result, nil
+}
+
+func (ds *FsDatastore) retain() {
+	defer ds.rwg.Done()
+	for {
+		ds.applyRetention()
+		select {
+		case <-ds.rquit:
+			return
+		case <-time.After(fsDsRetentionInterval):
+		}
+	}
+}
+
+func (ds *FsDatastore) applyRetention() {
+	// A series may have been used with several metric types
+	type typedSeries struct {
+		base string
+		typ  MetricType
+	}
+	ds.mu.Lock()
+	series := make(map[typedSeries][]string)
+	for name := range ds.names {
+		i := strings.LastIndex(name, ":")
+		if typ, ok := channelType(name[i+1:]); ok {
+			ts := typedSeries{name[:i], typ}
+			series[ts] = append(series[ts], name[i+1:])
+		}
+	}
+	ds.mu.Unlock()
+
+	now := time.Now().Unix()
+	for ts, chs := range series {
+		select {
+		case <-ds.rquit:
+			return
+		default:
+		}
+		// Histograms are rolled up with the buckets they were archived with
+		mt := &metricTypes[ts.typ]
+		if ts.typ == Histogram {
+			ht := histogramType(histogramBounds(chs))
+			mt = &ht
+		}
+		if p := ds.retentionPolicy(ts.base); p != nil {
+			ds.rmu.Lock()
+			ds.retainSeries(ts.base, mt, p.Tiers, now)
+			ds.rmu.Unlock()
+		}
+	}
+}
+
+func (ds *FsDatastore) retainSeries(base string, mt *metricType, tiers []RetentionTier, now int64) {
+	if err := ds.rollUp(base, mt, tiers); err != nil {
+		log.Println("FsDatastore.rollUp:", err)
+		return
+	}
+	if err := ds.expire(base, mt, tiers, now); err != nil {
+		log.Println("FsDatastore.expire:", err)
+	}
+}
+
+// rollUp aggregates the complete intervals of every tier into the next
+// one, starting after the last record of the coarser tier.
+func (ds *FsDatastore) rollUp(base string, mt *metricType, tiers []RetentionTier) error {
+	first := base + ":" + mt.channels[0]
+	for i := 1; i < len(tiers); i++ {
+		src, dst := tiers[i-1].Resolution, tiers[i].Resolution
+
+		last, err := ds.latestBefore(ds.tierName(first, src), math.MaxInt64)
+		if err == ErrNoData {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		end := last.Ts - last.Ts%dst
+
+		var lo int64
+		r, err := ds.latestBefore(ds.tierName(first, dst), math.MaxInt64)
+		if err == ErrNoData {
+			if lo, err = ds.earliest(ds.tierName(first, src)); err != nil {
+				return err
+			}
+			lo -= src
+			lo -= lo % dst
+		} else if err != nil {
+			return err
+		} else {
+			lo = r.Ts
+		}
+		// Intervals already rolled up are rolled up again from the
+		// earliest record backfilled since
+		bf, marked := ds.takeBackfill(base, mt.channels, src)
+		if b := bf - src; marked && b-b%dst < lo {
+			lo = b - b%dst
+		}
+
+		step := dst * (fsDsRollupChunk * src / dst)
+		if step < dst {
+			step = dst
+		}
+		for lo < end {
+			hi := lo + step
+			if hi > end {
+				hi = end
+			}
+			if err := ds.rollUpRange(base, mt, src, dst, lo, hi); err != nil {
+				if marked {
+					ds.markBackfill(ds.tierName(first, src), bf)
+				}
+				return err
+			}
+			lo = hi
+		}
+	}
+	return nil
+}
+
+// markBackfill notes that records from ts on were backfilled into the
+// stream name, unless it is the coarsest tier.
+func (ds *FsDatastore) markBackfill(name string, ts int64) {
+	if tiers := ds.tiers(name); ds.streamRes(name) >= tiers[len(tiers)-1] {
+		return
+	}
+	ds.bmu.Lock()
+	defer ds.bmu.Unlock()
+	if ds.backfills == nil {
+		ds.backfills = make(map[string]int64)
+	}
+	if t, ok := ds.backfills[name]; !ok || ts < t {
+		ds.backfills[name] = ts
+	}
+}
+
+// takeBackfill returns and clears the earliest record backfilled into the
+// channels chs of base at resolution res.
+func (ds *FsDatastore) takeBackfill(base string, chs []string, res int64) (int64, bool) {
+	ds.bmu.Lock()
+	defer ds.bmu.Unlock()
+	var first int64
+	marked := false
+	for _, ch := range chs {
+		name := ds.tierName(base+":"+ch, res)
+		if ts, ok := ds.backfills[name]; ok {
+			if !marked || ts < first {
+				first = ts
+			}
+			marked = true
+			delete(ds.backfills, name)
+		}
+	}
+	return first, marked
+}
+
+func (ds *FsDatastore) rollUpRange(base string, mt *metricType, src, dst, from, until int64) error {
+	aggr := mt.aggregator(mt.channels)
+	inChs := aggr.channels()
+	input, tmp := make([][]Record, len(inChs)), make([]float64, len(inChs))
+	for i, j := range inChs {
+		name := ds.tierName(base+":"+mt.channels[j], src)
+		in, err := ds.Query(name, from+src, until)
+		if err != nil {
+			return err
+		}
+		input[i] = in
+		tmp[i] = mt.defaults[j]
+		if mt.persist[j] {
+			if r, err := ds.latestBefore(name, from); err == nil {
+				tmp[i] = r.Value
+			} else if err != ErrNoData {
+				return err
+			}
+		}
+	}
+	aggr.init(tmp)
+	sa, _ := aggr.(sketchAggregator)
+	var sketches []Sketch
+	if sa != nil {
+		var err error
+		if sketches, err = ds.querySketches(ds.tierName(base+":"+mt.sketch, src), from+src, until); err != nil {
+			return err
+		}
+	}
+
+	for ts := from; ts < until; ts += dst {
+		if feedAggregator(aggr, input, ts, dst) == 0 {
+			continue
+		}
+		if sa != nil {
+			feedSketches(sa, &sketches, ts, dst)
+			if data := sa.getSketch(); data != nil {
+				name := ds.tierName(base+":"+mt.sketch, dst)
+				if err := ds.InsertSketch(name, Sketch{Ts: ts + dst, Data: data}); err != nil {
+					return err
+				}
+			}
+		}
+		for i, v := range aggr.get() {
+			name := ds.tierName(base+":"+mt.channels[i], dst)
+			if err := ds.Insert(name, Record{Ts: ts + dst, Value: v}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expire removes the records older than the retention of each tier. Data
+// is never removed before it has been rolled up into the next tier.
+func (ds *FsDatastore) expire(base string, mt *metricType, tiers []RetentionTier, now int64) error {
+	chs := mt.channels
+	for i, t := range tiers {
+		if t.Keep == 0 {
+			continue
+		}
+		cutoff := now - t.Keep
+		if i+1 < len(tiers) {
+			r, err := ds.latestBefore(ds.tierName(base+":"+chs[0], tiers[i+1].Resolution), math.MaxInt64)
+			if err == ErrNoData {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if r.Ts < cutoff {
+				cutoff = r.Ts
+			}
+		}
+		for _, ch := range chs {
+			if err := ds.truncate(ds.tierName(base+":"+ch, t.Resolution), cutoff); err != nil {
+				return err
+			}
+		}
+		if sk := mt.sketch; sk != "" {
+			if err := ds.truncateSketches(ds.tierName(base+":"+sk, t.Resolution), cutoff); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ds *FsDatastore) earliest(name string) (int64, error) {
+	s, err := ds.takeSnapshot(name)
+	if err != nil {
+		return 0, err
+	}
+	defer s.close()
+
+	if s.isize != 0 {
+		ts, _, err := s.readIdxEntry(0)
+		return ts, err
+	}
+	for _, r := range s.tail {
+		if r.Ts%s.res == 0 && r.Ts > s.lastWr {
+			return r.Ts, nil
+		}
+	}
+	return 0, ErrNoData
+}
+
+func (ds *FsDatastore) truncate(name string, ts int64) error {
+	st := ds.getStream(name)
+	if st == nil {
+		return Error("Datastore not running")
+	}
+	defer st.Unlock()
+	return st.truncate(ts)
+}
+
+// truncate removes the records up to and including ts from the files.
+// Whole blocks are dropped, only the block holding ts is rewritten.
+func (st *fsDsStream) truncate(ts int64) error {
+	if err := st.openFiles(false); err != nil {
+		return err
+	}
+	defer st.closeFiles()
+
+	s := st.view()
+	k, err := s.findIdx(ts)
+	if err != nil || k == -1 {
+		return err
+	}
+	b, err := s.readBlock(k)
+	if err != nil {
+		return err
+	}
+	n := 0
+	for n < len(b) && b[n].Ts <= ts {
+		n++
+	}
+	return st.rewriteTo(k+1, b[n:])
+}
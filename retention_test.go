@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRetention(t *testing.T) {
+	var testCases = []struct {
+		s  string
+		ps []RetentionPolicy
+	}{
+		{"*=60", []RetentionPolicy{{"*", []RetentionTier{{60, 0}}}}},
+		{"*=1m:30d,1h:2y", []RetentionPolicy{{"*", []RetentionTier{{60, 30 * 86400}, {3600, 2 * 365 * 86400}}}}},
+		{"a.*=1m:1w;*=1m", []RetentionPolicy{
+			{"a.*", []RetentionTier{{60, 7 * 86400}}},
+			{"*", []RetentionTier{{60, 0}}},
+		}},
+		{"", nil},
+		{"*", nil},
+		{"*=1x", nil},
+		{"*=1m:-1d", nil},
+		{"*=1m,", nil},
+	}
+
+	for _, tc := range testCases {
+		ps, err := ParseRetention(tc.s)
+		if tc.ps == nil {
+			if err == nil {
+				t.Error("Should have failed:", tc.s)
+			}
+		} else if err != nil {
+			t.Error("Shouldn't have failed:", tc.s, err)
+		} else if !reflect.DeepEqual(ps, tc.ps) {
+			t.Error("Incorrect result:", tc.s)
+			t.Error("Expected:", tc.ps)
+			t.Error("Result:", ps)
+		}
+	}
+}
+
+// waitFlushed waits until the writer of ds has flushed every tail.
+func waitFlushed(t *testing.T, ds *FsDatastore) {
+	for i := 0; i < 500; i++ {
+		ds.mu.Lock()
+		n := len(ds.queue)
+		ds.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Tails not flushed")
+}
+
+func TestRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ds := &FsDatastore{Dir: dir, NoSync: true, Interval: 60}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	// Set after Open, so the retention is only applied by the test
+	ds.Retention = []RetentionPolicy{{"*", []RetentionTier{{60, 600}, {600, 0}}}}
+
+	for ts := int64(60); ts <= 1800; ts += 60 {
+		ds.Insert("c:counter", Record{Ts: ts, Value: 1})
+	}
+	waitFlushed(t, ds)
+	ds.retainSeries("c", &metricTypes[Counter], ds.Retention[0].Tiers, 2000)
+	ds.retainSeries("d", &metricTypes[Counter], ds.Retention[0].Tiers, 2000)
+	for ts := int64(1860); ts <= 2400; ts += 60 {
+		ds.Insert("c:counter", Record{Ts: ts, Value: 2})
+	}
+
+	var testCases = []struct {
+		from, until, gran int64
+		ts                []int64
+		sum               float64
+	}{
+		// Expired up to the last record rolled up before now-600
+		{0, 1800, 60, []int64{1440, 1800}, 7},
+		{0, 1800, 600, []int64{600, 1800}, 30},
+		{0, 2400, 600, []int64{600, 2400}, 50},
+		{60, 2400, 600, []int64{1440, 2400}, 27},
+	}
+	for _, tc := range testCases {
+		recs, err := ds.QueryGranularity("c:counter", tc.from, tc.until, tc.gran)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := 0.0
+		for _, r := range recs {
+			sum += r.Value
+		}
+		if len(recs) == 0 || recs[0].Ts != tc.ts[0] || recs[len(recs)-1].Ts != tc.ts[1] || sum != tc.sum {
+			t.Error("Query", tc.from, tc.until, tc.gran, "returned", recs)
+		}
+	}
+
+	// Series without data have no tiers created by reading them
+	if files, _ := filepath.Glob(dir + "/d:*"); len(files) != 0 {
+		t.Error("Created", files)
+	}
+}
+
+func TestRetentionBackfill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ds := &FsDatastore{Dir: dir, NoSync: true, Interval: 60}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	tiers := []RetentionTier{{60, 0}, {600, 0}, {3600, 0}}
+	ds.Retention = []RetentionPolicy{{"*", tiers}}
+
+	for ts := int64(60); ts <= 7200; ts += 60 {
+		ds.Insert("c:counter", Record{Ts: ts, Value: 1})
+	}
+	waitFlushed(t, ds)
+	ds.retainSeries("c", &metricTypes[Counter], tiers, 8000)
+	waitFlushed(t, ds)
+
+	// The backfilled record is rolled up into every tier
+	ds.Insert("c:counter", Record{Ts: 300, Value: 5})
+	for i := 0; i < 2; i++ {
+		waitFlushed(t, ds)
+		ds.retainSeries("c", &metricTypes[Counter], tiers, 8000)
+	}
+	waitFlushed(t, ds)
+
+	var testCases = []struct {
+		gran   int64
+		values []float64
+	}{
+		{600, []float64{14, 10, 10}},
+		{3600, []float64{64, 60}},
+	}
+	for _, tc := range testCases {
+		recs, err := ds.QueryGranularity("c:counter", 0, 7200, tc.gran)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var values []float64
+		for i := 0; i < len(recs) && i < len(tc.values); i++ {
+			values = append(values, recs[i].Value)
+		}
+		if !reflect.DeepEqual(values, tc.values) {
+			t.Error("Granularity", tc.gran, "returned", recs)
+		}
+	}
+}
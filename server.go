@@ -1,7 +1,11 @@
 package main
 
 import (
+	"container/list"
 	"log"
+	"math"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -12,6 +16,17 @@ type Metric struct {
 	Type       MetricType
 	Value      float64
 	SampleRate float64
+	Tags       string
+	SetValue   string
+}
+
+// ImportRecord is an archived value of a channel, e.g. exported from
+// another system.
+type ImportRecord struct {
+	Name    string
+	Tags    string
+	Channel string
+	Record
 }
 
 type Error string
@@ -20,31 +35,74 @@ func (err Error) Error() string {
 	return string(err)
 }
 
-const LiveLogSize = 600
+// DefaultLiveLogSize is the number of ticks kept in the live log when
+// Server.LiveLogSize is not set.
+const DefaultLiveLogSize = 600
 
 type Server struct {
-	Ds        Datastore
-	Prefix    string
-	AutoWc    bool
-	mu        sync.Mutex
-	wg        sync.WaitGroup
-	metrics   [NMetricTypes]map[string]*metricEntry
-	wildcards [NMetricTypes]map[string]int
-	running   bool
-	stopping  bool
-	quit      chan int
-	lastTick  int64
+	Ds           Datastore
+	Prefix       string
+	AutoWc       bool
+	TickInterval int64
+	LiveLogSize  int64
+	// HistogramBuckets are the upper bounds of the histogram buckets,
+	// increasing; nil for the default ones
+	HistogramBuckets []float64
+	mu               sync.Mutex
+	wg               sync.WaitGroup
+	metrics          [NMetricTypes]map[string]*metricEntry
+	wildcards        [NMetricTypes]map[string]int
+	running          bool
+	stopping         bool
+	quit             chan int
+	lastTick         int64
+	tickIvl          int64
+	flushIvl         int64
+	liveSize         int64
+	types            [NMetricTypes]metricType
+	pmu              sync.Mutex
+	past             map[pastKey]*list.Element
+	pastOrder        list.List
+}
+
+// An interval injected into after it was flushed is kept for pastRetain
+// flush intervals, so that further points of the interval are merged
+// without reading it again. At most pastMaxEntries intervals are kept.
+const (
+	pastRetain     = 10
+	pastMaxEntries = 10000
+)
+
+type pastKey struct {
+	typ    MetricType
+	series string
+	ts     int64
+}
+
+// pastEntry is the archived record of an interval with the points
+// injected into it merged. It is locked while being updated.
+type pastEntry struct {
+	sync.Mutex
+	key     pastKey
+	touched int64
+	read    bool
+	data    []float64
+	sketch  []byte
 }
 
 type metricEntry struct {
 	metric
 	sync.Mutex
 	typ            MetricType
+	mt             *metricType
 	name           string
+	tags           string
 	recvdInput     bool
 	recvdInputTick bool
 	idleTicks      int
-	liveLog        []*[LiveLogSize]float64
+	liveLog        [][]float64
+	totals         []float64
+	liveSize       int64
 	livePtr        int64
 	lastTick       int64
 	watchers       []*Watcher
@@ -72,10 +130,32 @@ func (srv *Server) Start(lld *LiveLogData, wildcards []string) error {
 		return Error("Server is stopping")
 	}
 
+	srv.tickIvl, srv.flushIvl = srv.TickInterval, srv.Ds.Resolution()
+	if srv.tickIvl <= 0 {
+		srv.tickIvl = 1
+	}
+	if srv.flushIvl%srv.tickIvl != 0 {
+		return Error("Datastore resolution must be divisible by the tick interval")
+	}
+	srv.liveSize = srv.LiveLogSize
+	if srv.liveSize <= 0 {
+		srv.liveSize = DefaultLiveLogSize
+	}
+	srv.types = metricTypes
+	if srv.HistogramBuckets != nil {
+		if err := checkHistogramBuckets(srv.HistogramBuckets); err != nil {
+			return err
+		}
+		srv.types[Histogram] = histogramType(append([]float64(nil), srv.HistogramBuckets...))
+	}
+
 	for i := range srv.metrics {
 		srv.metrics[i] = make(map[string]*metricEntry)
 	}
+	srv.past = make(map[pastKey]*list.Element)
+	srv.pastOrder.Init()
 	srv.lastTick = time.Now().Unix()
+	srv.lastTick -= srv.lastTick % srv.tickIvl
 	if lld != nil {
 		lld.restore(srv)
 	}
@@ -150,7 +230,7 @@ func (srv *Server) InjectWithoutWildcards(metric *Metric) error {
 		return err
 	}
 
-	me, err := srv.getMetricEntry(metric.Type, metric.Name, false)
+	me, err := srv.getMetricEntry(metric.Type, metric.Name, metric.Tags, false)
 	if err != nil {
 		return err
 	}
@@ -178,6 +258,274 @@ func (srv *Server) Inject(metric *Metric) error {
 	return nil
 }
 
+// InjectAt injects a metric that was measured at the given time. Metrics
+// belonging to the interval that is not flushed yet are injected as usual,
+// older ones are merged with the other points of their interval injected
+// recently and written straight to the datastore, which has to accept
+// records older than the latest ones, see FsDatastore.Insert.
+func (srv *Server) InjectAt(metric *Metric, ts int64) error {
+	srv.mu.Lock()
+	running, res, now := srv.running, srv.flushIvl, srv.lastTick
+	srv.mu.Unlock()
+	if !running {
+		return Error("Server not running")
+	}
+	next := now - now%res + res
+
+	if ts <= 0 {
+		return srv.Inject(metric)
+	}
+	t := ts
+	if ts%res != 0 {
+		ts += res - ts%res
+	}
+	if ts >= next {
+		return srv.Inject(metric)
+	}
+
+	if err := srv.insertPast(metric, t, ts, res, now); err != nil {
+		return err
+	}
+	wcs, m := srv.getMatchingWildcards(metric.Type, metric.Name), *metric
+	for _, wc := range wcs {
+		m.Name = wc
+		if err := srv.insertPast(&m, t, ts, res, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertPast merges the metric measured at t into the interval ending at
+// ts and writes the interval to the datastore.
+func (srv *Server) insertPast(metric *Metric, t, ts, res, now int64) error {
+	if metric.Type >= NMetricTypes || metric.Type < 0 {
+		return Error("Metric type invalid")
+	}
+	if metric.SampleRate <= 0 {
+		return Error("Sample rate invalid")
+	}
+	if err := CheckMetricName(metric.Name); err != nil {
+		return err
+	}
+	tags, err := ParseTags(metric.Tags)
+	if err != nil {
+		return err
+	}
+
+	mt, series := &srv.types[metric.Type], SeriesName(metric.Name, tags)
+	e := srv.pastEntry(pastKey{metric.Type, series, ts}, now, now-pastRetain*res)
+	e.Lock()
+	defer e.Unlock()
+	if !e.read {
+		if err := srv.readPast(e, mt, res); err != nil {
+			return err
+		}
+	}
+
+	initData := make([]float64, len(mt.channels))
+	for i := range initData {
+		if mt.persist[i] && e.data != nil {
+			initData[i] = e.data[i]
+		} else {
+			initData[i] = srv.getChannelDefault(metric.Type, series, i, ts-res)
+		}
+	}
+	m := mt.create()
+	m.init(initData)
+	m.inject(metric)
+	m.tick()
+	data := m.flush()
+	var sketch []byte
+	if sm, ok := m.(sketchMetric); ok {
+		sketch = sm.sketch()
+	}
+	if e.data != nil {
+		data, sketch = mergePast(mt, initData, e.data, e.sketch, data, sketch)
+	}
+	e.data, e.sketch = data, sketch
+
+	for i, n := range mt.channels {
+		rec := Record{Ts: ts, Value: data[i]}
+		if err := srv.Ds.Insert(srv.Prefix+series+":"+n, rec); err != nil {
+			return err
+		}
+	}
+	if sds, ok := srv.Ds.(SketchDatastore); ok && sketch != nil {
+		if err := sds.InsertSketch(srv.Prefix+series+":"+mt.sketch, Sketch{Ts: ts, Data: sketch}); err != nil {
+			return err
+		}
+	}
+
+	srv.mu.Lock()
+	me := srv.metrics[metric.Type][series]
+	srv.mu.Unlock()
+	if me != nil {
+		me.Lock()
+		me.updatePastLiveLog(metric, t, srv.tickIvl)
+		me.Unlock()
+	}
+	return nil
+}
+
+// pastEntry returns the entry of an interval, creating it if needed, and
+// drops the entries not touched since expire.
+func (srv *Server) pastEntry(key pastKey, now, expire int64) *pastEntry {
+	srv.pmu.Lock()
+	defer srv.pmu.Unlock()
+	for el := srv.pastOrder.Front(); el != nil; el = srv.pastOrder.Front() {
+		e := el.Value.(*pastEntry)
+		if e.touched >= expire && srv.pastOrder.Len() < pastMaxEntries {
+			break
+		}
+		srv.pastOrder.Remove(el)
+		delete(srv.past, e.key)
+	}
+
+	if el := srv.past[key]; el != nil {
+		e := el.Value.(*pastEntry)
+		e.touched = now
+		srv.pastOrder.MoveToBack(el)
+		return e
+	}
+	e := &pastEntry{key: key, touched: now}
+	srv.past[key] = srv.pastOrder.PushBack(e)
+	return e
+}
+
+// readPast reads the archived record of the interval of e, if it has the
+// required channels.
+func (srv *Server) readPast(e *pastEntry, mt *metricType, res int64) error {
+	name, ts := srv.Prefix+e.key.series+":", e.key.ts
+	data := make([]float64, len(mt.channels))
+	for i, n := range mt.channels {
+		recs, err := srv.Ds.Query(name+n, ts, ts)
+		if err != nil {
+			return err
+		}
+		data[i] = math.NaN()
+		if len(recs) > 0 {
+			data[i] = recs[0].Value
+		}
+	}
+	aggr := mt.aggregator(mt.channels)
+	required := len(aggr.channels())
+	if pa, ok := aggr.(partialAggregator); ok {
+		required = pa.required()
+	}
+	for _, j := range aggr.channels()[:required] {
+		if math.IsNaN(data[j]) {
+			e.read = true
+			return nil
+		}
+	}
+
+	if sds, ok := srv.Ds.(SketchDatastore); ok && mt.sketch != "" {
+		sketches, err := sds.QuerySketches(name+mt.sketch, ts-res, ts, res)
+		if err != nil {
+			return err
+		}
+		if len(sketches) > 0 && sketches[len(sketches)-1].Ts == ts {
+			e.sketch = sketches[len(sketches)-1].Data
+		}
+	}
+	e.read, e.data = true, data
+	return nil
+}
+
+// mergePast merges two records of the same interval with the aggregator
+// of their type, as the records of several intervals are rolled up. The
+// record of a gauge is the latter one.
+func mergePast(mt *metricType, initData, a []float64, aSketch []byte, b []float64, bSketch []byte) ([]float64, []byte) {
+	aggr := mt.aggregator(mt.channels)
+	inChs := aggr.channels()
+	input := func(data []float64) []float64 {
+		r := make([]float64, len(inChs))
+		for i, j := range inChs {
+			r[i] = data[j]
+		}
+		return r
+	}
+	aggr.init(input(initData))
+	aggr.put(input(a))
+	aggr.put(input(b))
+	var sketch []byte
+	if sa, ok := aggr.(sketchAggregator); ok {
+		sa.putSketch(aSketch)
+		sa.putSketch(bSketch)
+		sketch = sa.getSketch()
+	}
+	return aggr.get(), sketch
+}
+
+// updatePastLiveLog merges the metric measured at t into the tick of the
+// live log it belongs to, and adds it to the totals.
+func (me *metricEntry) updatePastLiveLog(metric *Metric, t int64, tick int64) {
+	if t%tick != 0 {
+		t += tick - t%tick
+	}
+	k := (me.lastTick - t) / tick
+	if k < 0 || k >= me.liveSize {
+		return
+	}
+	i := ((me.livePtr-1-k)%me.liveSize + me.liveSize) % me.liveSize
+
+	initData, live := make([]float64, len(me.mt.channels)), make([]float64, len(me.mt.channels))
+	for ch := range initData {
+		live[ch] = me.liveLog[ch][i]
+		initData[ch] = me.mt.defaults[ch]
+		if me.mt.persist[ch] {
+			initData[ch] = live[ch]
+		}
+	}
+	m := me.mt.create()
+	m.init(initData)
+	m.inject(metric)
+	point := m.tick()
+	merged, _ := mergePast(me.mt, initData, live, nil, point, nil)
+	for ch, v := range merged {
+		me.liveLog[ch][i] = v
+	}
+
+	if me.totals == nil {
+		return
+	}
+	for ch, v := range point {
+		if me.mt.isTotal(ch) && !math.IsNaN(v) {
+			me.totals[ch] += v
+		}
+	}
+}
+
+// Import writes a record straight to the datastore, replacing the record
+// of the same channel and time if there is one.
+func (srv *Server) Import(rec *ImportRecord) error {
+	srv.mu.Lock()
+	running, res := srv.running, srv.flushIvl
+	srv.mu.Unlock()
+	if !running {
+		return Error("Server not running")
+	}
+
+	if err := CheckMetricName(rec.Name); err != nil {
+		return err
+	}
+	if tags, err := ParseTags(rec.Tags); err != nil {
+		return err
+	} else if tags != rec.Tags {
+		return Error("Tags must be sorted")
+	}
+	if _, ok := channelType(rec.Channel); !ok {
+		return Error("No such channel: " + rec.Channel)
+	}
+	if rec.Ts%res != 0 {
+		return Error("Timestamp must be divisable by " + strconv.FormatInt(res, 10))
+	}
+
+	name := srv.Prefix + SeriesName(rec.Name, rec.Tags) + ":" + rec.Channel
+	return srv.Ds.Insert(name, rec.Record)
+}
+
 func (srv *Server) getMatchingWildcards(typ MetricType, name string) []string {
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
@@ -262,16 +610,30 @@ func (srv *Server) getWildcards() []string {
 	r := make([]string, 0)
 	for typ, wcs := range srv.wildcards {
 		for name, _ := range wcs {
-			r = append(r, name+":"+metricTypes[typ].channels[0])
+			r = append(r, name+":"+srv.types[typ].channels[0])
 		}
 	}
 	return r
 }
 
-func (srv *Server) getMetricEntry(typ MetricType, name string, wc bool) (*metricEntry, error) {
+// getMetricEntry returns the locked entry of a series, creating it if
+// needed. With wc set, as for queries, tags may be some of the tags of the
+// series, but they must select exactly one series; batch queries return
+// every series matching them.
+func (srv *Server) getMetricEntry(typ MetricType, name, tags string, wc bool) (*metricEntry, error) {
 	if err := CheckMetricName(name); err != nil {
 		return nil, err
 	}
+	tags, err := ParseTags(tags)
+	if err != nil {
+		return nil, err
+	}
+	if wc && len(tags) > 0 {
+		if tags, err = srv.matchSeries(typ, name, tags); err != nil {
+			return nil, err
+		}
+	}
+	series := SeriesName(name, tags)
 
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
@@ -280,10 +642,10 @@ func (srv *Server) getMetricEntry(typ MetricType, name string, wc bool) (*metric
 		return nil, Error("Server not running")
 	}
 
-	me := srv.metrics[typ][name]
+	me := srv.metrics[typ][series]
 	if me == nil {
-		me = srv.createMetricEntry(typ, name)
-		srv.metrics[typ][name] = me
+		me = srv.createMetricEntry(typ, name, tags)
+		srv.metrics[typ][series] = me
 	}
 
 	if wc && srv.AutoWc {
@@ -294,22 +656,75 @@ func (srv *Server) getMetricEntry(typ MetricType, name string, wc bool) (*metric
 	return me, nil
 }
 
-func (srv *Server) createMetricEntry(typ MetricType, name string) *metricEntry {
-	chs := metricTypes[typ].channels
+// matchSeries returns the tags of the only live or archived series of a
+// metric which has all of the given tags, or the tags themselves if the
+// series exists. The archive is listed without holding srv.mu.
+func (srv *Server) matchSeries(typ MetricType, name, tags string) (string, error) {
+	srv.mu.Lock()
+	if !srv.running {
+		srv.mu.Unlock()
+		return "", Error("Server not running")
+	}
+	found := make(map[string]bool)
+	for _, me := range srv.metrics[typ] {
+		if me.name == name {
+			found[me.tags] = true
+		}
+	}
+	ch := srv.types[typ].channels[0]
+	srv.mu.Unlock()
+	if found[tags] {
+		return tags, nil
+	}
+
+	names, err := srv.Ds.ListNames(escapePattern(srv.Prefix+name) + "#*:" + escapePattern(ch))
+	if err != nil {
+		return "", err
+	}
+	for _, n := range names {
+		_, t := splitSeriesName(n[len(srv.Prefix) : len(n)-len(ch)-1])
+		found[t] = true
+	}
+	if found[tags] {
+		return tags, nil
+	}
+
+	var r []string
+	for t := range found {
+		if MatchTags(t, tags) {
+			r = append(r, t)
+		}
+	}
+	switch len(r) {
+	case 0:
+		return "", Error("No series of " + name + " has the tags " + tags)
+	case 1:
+		return r[0], nil
+	}
+	sort.Strings(r)
+	return "", Error("Tags match several series of " + name + ": " + strings.Join(r, " "))
+}
+
+func (srv *Server) createMetricEntry(typ MetricType, name, tags string) *metricEntry {
+	mt := &srv.types[typ]
+	chs := mt.channels
 
 	me := &metricEntry{
-		metric:   metricTypes[typ].create(),
+		metric:   mt.create(),
 		typ:      typ,
+		mt:       mt,
 		name:     name,
-		liveLog:  make([]*[LiveLogSize]float64, len(chs)),
+		tags:     tags,
+		liveLog:  make([][]float64, len(chs)),
+		liveSize: srv.liveSize,
 		lastTick: srv.lastTick,
 	}
 
 	initData := make([]float64, len(chs))
 	for i := range chs {
-		def := srv.getChannelDefault(typ, name, i, srv.lastTick)
+		def := srv.getChannelDefault(typ, me.series(), i, srv.lastTick)
 		initData[i] = def
-		live := new([LiveLogSize]float64)
+		live := make([]float64, srv.liveSize)
 		for i := range live {
 			live[i] = def
 		}
@@ -317,14 +732,21 @@ func (srv *Server) createMetricEntry(typ MetricType, name string) *metricEntry {
 	}
 	me.init(initData)
 
+	for i := range chs {
+		if mt.isTotal(i) {
+			me.totals = make([]float64, len(chs))
+			break
+		}
+	}
+
 	return me
 }
 
-func (srv *Server) getChannelDefault(typ MetricType, name string, i int, ts int64) float64 {
-	mt := metricTypes[typ]
+func (srv *Server) getChannelDefault(typ MetricType, series string, i int, ts int64) float64 {
+	mt := &srv.types[typ]
 	def := mt.defaults[i]
 	if mt.persist[i] {
-		rec, err := srv.Ds.LatestBefore(srv.Prefix+name+":"+mt.channels[i], ts)
+		rec, err := srv.Ds.LatestBefore(srv.Prefix+series+":"+mt.channels[i], ts)
 		if err == nil {
 			def = rec.Value
 		} else if err != ErrNoData {
@@ -334,14 +756,46 @@ func (srv *Server) getChannelDefault(typ MetricType, name string, i int, ts int6
 	return def
 }
 
+// metricTypeByChannels returns the metric type of chs, which must be
+// channels of the metric types of srv.
+func (srv *Server) metricTypeByChannels(chs []string) (MetricType, error) {
+	typ, err := metricTypeByChannels(chs)
+	if err != nil {
+		return typ, err
+	}
+	for _, ch := range chs {
+		if srv.types[typ].channelIndex(ch) == -1 {
+			return -1, Error("No such channel: " + ch)
+		}
+	}
+	return typ, nil
+}
+
+// Resolutions returns the length of a tick and the interval between two
+// flushes to the datastore in seconds.
+func (srv *Server) Resolutions() (tick, flush int64) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.tickIvl, srv.flushIvl
+}
+
+// LiveSize returns the number of ticks kept in the live log.
+func (srv *Server) LiveSize() int64 {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.liveSize
+}
+
 func (srv *Server) tick() {
-	time.Sleep(time.Duration(1e9 - time.Now().Nanosecond()))
-	ticker := time.NewTicker(time.Second)
+	ivl := time.Duration(srv.tickIvl) * time.Second
+	now := time.Now()
+	time.Sleep(now.Truncate(ivl).Add(ivl).Sub(now))
+	ticker := time.NewTicker(ivl)
 	for {
 		select {
 		case t := <-ticker.C:
 			ts := t.Unix()
-			if srv.handleTick(ts) {
+			if srv.handleTick(ts - ts%srv.tickIvl) {
 				ticker.Stop()
 				srv.quit <- 1
 			}
@@ -354,8 +808,8 @@ func (srv *Server) handleTick(ts int64) bool {
 	defer srv.mu.Unlock()
 
 	for srv.lastTick < ts {
-		srv.lastTick++
-		if srv.lastTick%60 != 0 {
+		srv.lastTick += srv.tickIvl
+		if srv.lastTick%srv.flushIvl != 0 {
 			srv.tickMetrics()
 		} else {
 			srv.flushMetrics()
@@ -377,6 +831,8 @@ func (srv *Server) tickMetrics() {
 	srv.wg.Wait()
 }
 
+// flushMetrics writes the intervals of all metrics, which are durable once
+// it returns.
 func (srv *Server) flushMetrics() {
 	for _, metrics := range srv.metrics {
 		for _, me := range metrics {
@@ -384,6 +840,18 @@ func (srv *Server) flushMetrics() {
 		}
 	}
 	srv.wg.Wait()
+	if err := srv.Sync(); err != nil {
+		log.Println("Server.flushMetrics:", err)
+	}
+}
+
+// Sync makes the records written to the datastore so far durable, if the
+// datastore buffers them.
+func (srv *Server) Sync() error {
+	if sd, ok := srv.Ds.(SyncDatastore); ok {
+		return sd.Sync()
+	}
+	return nil
 }
 
 func (srv *Server) tickMetric(me *metricEntry) {
@@ -404,11 +872,15 @@ func (srv *Server) flushOrDelete(me *metricEntry) {
 	if me.recvdInput || len(me.watchers) != 0 {
 		srv.wg.Add(1)
 		go srv.flushMetric(me)
-	} else if me.idleTicks > LiveLogSize {
-		delete(srv.metrics[me.typ], me.name)
+	} else if int64(me.idleTicks) > me.liveSize {
+		delete(srv.metrics[me.typ], me.series())
 	}
 }
 
+func (me *metricEntry) series() string {
+	return SeriesName(me.name, me.tags)
+}
+
 func (me *metricEntry) updateIdle() {
 	if me.recvdInputTick {
 		me.idleTicks = 0
@@ -423,8 +895,13 @@ func (me *metricEntry) updateLiveLog(ts int64) {
 	for ch, live := range me.liveLog {
 		live[me.livePtr] = data[ch]
 	}
-	me.livePtr = (me.livePtr + 1) % LiveLogSize
+	me.livePtr = (me.livePtr + 1) % me.liveSize
 	me.lastTick = ts
+	for ch := range me.totals {
+		if me.mt.isTotal(ch) && !math.IsNaN(data[ch]) {
+			me.totals[ch] += data[ch]
+		}
+	}
 
 	for _, w := range me.watchers {
 		if w.aggr != nil {
@@ -446,15 +923,27 @@ func (srv *Server) flushMetric(me *metricEntry) {
 	me.updateLiveLog(srv.lastTick)
 	data := me.flush()
 
+	var sketch []byte
+	if sm, ok := me.metric.(sketchMetric); ok {
+		sketch = sm.sketch()
+	}
+
 	if me.recvdInput {
-		for i, n := range metricTypes[me.typ].channels {
-			dbName := srv.Prefix + me.name + ":" + n
+		mt := me.mt
+		for i, n := range mt.channels {
+			dbName := srv.Prefix + me.series() + ":" + n
 			rec := Record{Ts: srv.lastTick, Value: data[i]}
 			err := srv.Ds.Insert(dbName, rec)
 			if err != nil {
 				log.Println("Server.flushMetric:", err)
 			}
 		}
+		if sds, ok := srv.Ds.(SketchDatastore); ok && sketch != nil {
+			dbName := srv.Prefix + me.series() + ":" + mt.sketch
+			if err := sds.InsertSketch(dbName, Sketch{Ts: srv.lastTick, Data: sketch}); err != nil {
+				log.Println("Server.flushMetric:", err)
+			}
+		}
 		me.recvdInput = false
 	}
 
@@ -467,6 +956,9 @@ func (srv *Server) flushMetric(me *metricEntry) {
 			wdata[i] = data[j]
 		}
 		w.aggr.put(wdata)
+		if sa, ok := w.aggr.(sketchAggregator); ok && sketch != nil {
+			sa.putSketch(sketch)
+		}
 		if (me.lastTick-w.offs)%w.gran == 0 {
 			w.in <- w.aggr.get()
 		}
@@ -474,25 +966,27 @@ func (srv *Server) flushMetric(me *metricEntry) {
 
 }
 
-func (srv *Server) LiveLog(name string, chs []string) ([][]float64, int64, error) {
-	typ, err := metricTypeByChannels(chs)
+func (srv *Server) LiveLog(name, tags string, chs []string) ([][]float64, int64, error) {
+	tick, _ := srv.Resolutions()
+
+	typ, err := srv.metricTypeByChannels(chs)
 	if err != nil {
 		return nil, 0, err
 	}
 
-	me, err := srv.getMetricEntry(typ, name, true)
+	me, err := srv.getMetricEntry(typ, name, tags, true)
 	if err != nil {
 		return nil, 0, err
 	}
 	defer me.Unlock()
 
-	logs, ptr := make([]*[LiveLogSize]float64, len(chs)), me.livePtr
+	logs, ptr, size := make([][]float64, len(chs)), me.livePtr, me.liveSize
 	for i, n := range chs {
-		logs[i] = me.liveLog[getChannelIndex(typ, n)]
+		logs[i] = me.liveLog[me.mt.channelIndex(n)]
 	}
 
-	result, ts := make([][]float64, LiveLogSize), me.lastTick-LiveLogSize
-	for i := ptr; i < LiveLogSize; i++ {
+	result, ts := make([][]float64, size), me.lastTick-size*tick
+	for i := ptr; i < size; i++ {
 		row := make([]float64, len(chs))
 		for j, log := range logs {
 			row[j] = log[i]
@@ -504,32 +998,81 @@ func (srv *Server) LiveLog(name string, chs []string) ([][]float64, int64, error
 		for j, log := range logs {
 			row[j] = log[i]
 		}
-		result[i+LiveLogSize-ptr] = row
+		result[i+size-ptr] = row
 	}
 
 	return result, ts, nil
 }
 
-func (srv *Server) Log(name string, chs []string, from, length, gran int64) ([][]float64, error) {
-	if from%60 != 0 {
-		return nil, Error("From must be divisable by 60")
+// CurrentValue holds the values of the channels of a live metric in its
+// latest tick, and the sums of the total channels over all ticks since
+// the metric became live.
+type CurrentValue struct {
+	Type     MetricType
+	Name     string
+	Tags     string
+	Ts       int64
+	Channels []string
+	Values   []float64
+	Totals   []float64
+}
+
+func (srv *Server) CurrentValues() ([]CurrentValue, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if !srv.running {
+		return nil, Error("Server not running")
+	}
+
+	var r []CurrentValue
+	for typ, metrics := range srv.metrics {
+		for _, me := range metrics {
+			me.Lock()
+			cv := CurrentValue{
+				Type:     MetricType(typ),
+				Name:     me.name,
+				Tags:     me.tags,
+				Ts:       me.lastTick,
+				Channels: me.mt.channels,
+				Values:   make([]float64, len(me.liveLog)),
+				Totals:   append([]float64(nil), me.totals...),
+			}
+			i := (me.livePtr + me.liveSize - 1) % me.liveSize
+			for ch, live := range me.liveLog {
+				cv.Values[ch] = live[i]
+			}
+			me.Unlock()
+			r = append(r, cv)
+		}
+	}
+	return r, nil
+}
+
+func (srv *Server) Log(name, tags string, chs []string, from, length, gran int64) ([][]float64, error) {
+	_, res := srv.Resolutions()
+	if res <= 0 {
+		return nil, Error("Server not running")
+	}
+	if from%res != 0 {
+		return nil, Error("From must be divisable by " + strconv.FormatInt(res, 10))
 	}
 	if gran < 1 {
 		return nil, Error("Granularity must be positive")
 	}
-	if gran%60 != 0 {
-		return nil, Error("Granularity must be divisable by 60")
+	if gran%res != 0 {
+		return nil, Error("Granularity must be divisable by " + strconv.FormatInt(res, 10))
 	}
 	if length < 0 {
 		return nil, Error("Length must not be negative")
 	}
 
-	typ, err := metricTypeByChannels(chs)
+	typ, err := srv.metricTypeByChannels(chs)
 	if err != nil {
 		return nil, err
 	}
 
-	me, err := srv.getMetricEntry(typ, name, true)
+	me, err := srv.getMetricEntry(typ, name, tags, true)
 	if err != nil {
 		return nil, err
 	}
@@ -545,8 +1088,8 @@ func (srv *Server) Log(name string, chs []string, from, length, gran int64) ([][
 		return [][]float64{}, nil
 	}
 
-	aggr := metricTypes[typ].aggregator(chs)
-	input, err := srv.initAggregator(aggr, name, typ, from, from+gran*length)
+	aggr := srv.types[typ].aggregator(chs)
+	input, sketches, err := srv.initAggregator(aggr, me.series(), typ, from, from+gran*length, gran)
 	if err != nil {
 		return nil, err
 	}
@@ -554,6 +1097,9 @@ func (srv *Server) Log(name string, chs []string, from, length, gran int64) ([][
 	output := make([][]float64, length)
 	for i, ts := int64(0), from; i < length; i++ {
 		feedAggregator(aggr, input, ts, gran)
+		if sa, ok := aggr.(sketchAggregator); ok {
+			feedSketches(sa, &sketches, ts, gran)
+		}
 		ts += gran
 		output[i] = aggr.get()
 	}
@@ -561,45 +1107,88 @@ func (srv *Server) Log(name string, chs []string, from, length, gran int64) ([][
 	return output, nil
 }
 
-func (srv *Server) initAggregator(aggr aggregator, name string, typ MetricType, from, until int64) ([][]Record, error) {
+// initAggregator reads the input of aggr in (from, until], and the
+// sketches if it merges them. Datastores keeping coarser copies of old
+// data are asked for the best one for gran.
+func (srv *Server) initAggregator(aggr aggregator, series string, typ MetricType, from, until, gran int64) ([][]Record, []Sketch, error) {
+	_, res := srv.Resolutions()
 	inChs := aggr.channels()
 	input, tmp := make([][]Record, len(inChs)), make([]float64, len(inChs))
 	for i, j := range inChs {
-		ch := metricTypes[typ].channels[j]
-		in, err := srv.Ds.Query(srv.Prefix+name+":"+ch, from+60, until)
+		var (
+			in  []Record
+			err error
+		)
+		name := srv.Prefix + series + ":" + srv.types[typ].channels[j]
+		if tds, ok := srv.Ds.(TieredDatastore); ok {
+			in, err = tds.QueryGranularity(name, from, until, gran)
+		} else {
+			in, err = srv.Ds.Query(name, from+res, until)
+		}
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		input[i] = in
-		tmp[i] = srv.getChannelDefault(typ, name, j, from)
+		tmp[i] = srv.getChannelDefault(typ, series, j, from)
 	}
 	aggr.init(tmp)
-	return input, nil
+
+	sds, ok := srv.Ds.(SketchDatastore)
+	if _, merges := aggr.(sketchAggregator); !ok || !merges {
+		return input, nil, nil
+	}
+	sketches, err := sds.QuerySketches(srv.Prefix+series+":"+srv.types[typ].sketch, from, until, gran)
+	if err != nil {
+		return nil, nil, err
+	}
+	return input, sketches, nil
 }
 
-func feedAggregator(aggr aggregator, in [][]Record, ts, gran int64) {
-	tmp := make([]float64, len(in))
-	for j := int64(0); j < gran; j += 60 {
-		ts += 60
-		missing := false
+// feedAggregator puts the records in (ts, ts+gran] present in every
+// required channel and returns their number. The records may be of
+// different resolutions.
+func feedAggregator(aggr aggregator, in [][]Record, ts, gran int64) int {
+	tmp, n, required := make([]float64, len(in)), 0, len(in)
+	if pa, ok := aggr.(partialAggregator); ok {
+		required = pa.required()
+	}
+	for len(in[0]) > 0 && in[0][0].Ts <= ts+gran {
+		t, missing := in[0][0].Ts, false
 		for k := range tmp {
-			for len(in[k]) > 0 && in[k][0].Ts < ts {
+			for len(in[k]) > 0 && in[k][0].Ts < t {
 				in[k] = in[k][1:]
 			}
-			if len(in[k]) > 0 && in[k][0].Ts == ts {
+			if len(in[k]) > 0 && in[k][0].Ts == t {
 				tmp[k] = in[k][0].Value
+			} else if k >= required {
+				tmp[k] = math.NaN()
 			} else {
 				missing = true
 			}
 		}
-		if !missing {
+		in[0] = in[0][1:]
+		if !missing && t > ts {
 			aggr.put(tmp)
+			n++
 		}
 	}
+	return n
 }
 
-func (srv *Server) LiveWatch(name string, chs []string) (*Watcher, error) {
-	typ, err := metricTypeByChannels(chs)
+// feedSketches puts the sketches in (ts, ts+gran] and drops them.
+func feedSketches(aggr sketchAggregator, sketches *[]Sketch, ts, gran int64) {
+	s := *sketches
+	for len(s) > 0 && s[0].Ts <= ts+gran {
+		if s[0].Ts > ts {
+			aggr.putSketch(s[0].Data)
+		}
+		s = s[1:]
+	}
+	*sketches = s
+}
+
+func (srv *Server) LiveWatch(name, tags string, chs []string) (*Watcher, error) {
+	typ, err := srv.metricTypeByChannels(chs)
 	if err != nil {
 		return nil, err
 	}
@@ -612,10 +1201,10 @@ func (srv *Server) LiveWatch(name string, chs []string) (*Watcher, error) {
 	w.C = w.out
 
 	for i, n := range chs {
-		w.chs[i] = getChannelIndex(typ, n)
+		w.chs[i] = srv.types[typ].channelIndex(n)
 	}
 
-	me, err := srv.getMetricEntry(typ, name, true)
+	me, err := srv.getMetricEntry(typ, name, tags, true)
 	if err != nil {
 		return nil, err
 	}
@@ -629,18 +1218,22 @@ func (srv *Server) LiveWatch(name string, chs []string) (*Watcher, error) {
 	return w, nil
 }
 
-func (srv *Server) Watch(name string, chs []string, offs, gran int64) (*Watcher, error) {
-	if offs%60 != 0 {
-		return nil, Error("Offset must be divisable by 60")
+func (srv *Server) Watch(name, tags string, chs []string, offs, gran int64) (*Watcher, error) {
+	_, res := srv.Resolutions()
+	if res <= 0 {
+		return nil, Error("Server not running")
+	}
+	if offs%res != 0 {
+		return nil, Error("Offset must be divisable by " + strconv.FormatInt(res, 10))
 	}
 	if gran < 1 {
 		return nil, Error("Granularity must be positive")
 	}
-	if gran%60 != 0 {
-		return nil, Error("Granularity must be divisable by 60")
+	if gran%res != 0 {
+		return nil, Error("Granularity must be divisable by " + strconv.FormatInt(res, 10))
 	}
 
-	typ, err := metricTypeByChannels(chs)
+	typ, err := srv.metricTypeByChannels(chs)
 	if err != nil {
 		return nil, err
 	}
@@ -648,14 +1241,14 @@ func (srv *Server) Watch(name string, chs []string, offs, gran int64) (*Watcher,
 	w := &Watcher{
 		in:   make(chan []float64),
 		out:  make(chan []float64),
-		aggr: metricTypes[typ].aggregator(chs),
+		aggr: srv.types[typ].aggregator(chs),
 		gran: gran,
 		offs: offs,
 	}
 	w.chs = w.aggr.channels()
 	w.C = w.out
 
-	me, err := srv.getMetricEntry(typ, name, true)
+	me, err := srv.getMetricEntry(typ, name, tags, true)
 	if err != nil {
 		return nil, err
 	}
@@ -664,11 +1257,14 @@ func (srv *Server) Watch(name string, chs []string, offs, gran int64) (*Watcher,
 	w.me = me
 	w.Ts = me.lastTick - ((me.lastTick-offs)%gran+gran)%gran
 
-	input, err := srv.initAggregator(w.aggr, name, typ, w.Ts, w.Ts+gran)
+	input, sketches, err := srv.initAggregator(w.aggr, me.series(), typ, w.Ts, w.Ts+gran, gran)
 	if err != nil {
 		return nil, err
 	}
 	feedAggregator(w.aggr, input, w.Ts, gran)
+	if sa, ok := w.aggr.(sketchAggregator); ok {
+		feedSketches(sa, &sketches, w.Ts, gran)
+	}
 
 	me.watchers = append(me.watchers, w)
 	go w.run()
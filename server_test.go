@@ -0,0 +1,194 @@
+package main
+
+import (
+	"container/list"
+	"testing"
+	"time"
+)
+
+func TestQueryTags(t *testing.T) {
+	ds := &MemDatastore{Interval: 1}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	srv := &Server{Ds: ds}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	from := time.Now().Unix() - 60
+	for ts := from + 1; ts <= from+4; ts++ {
+		ds.Insert("web#env:prod,host:a:counter", Record{Ts: ts, Value: 1})
+		ds.Insert("web#env:test,host:a:counter", Record{Ts: ts, Value: 2})
+		ds.Insert("web#env:test,host:b:counter", Record{Ts: ts, Value: 3})
+	}
+
+	var testCases = []struct {
+		tags  string
+		value float64
+		ok    bool
+	}{
+		{"env:prod", 1, true},
+		{"host:a,env:prod", 1, true},
+		{"host:b", 3, true},
+		{"env:test,host:b", 3, true},
+		{"env:test", 0, false},
+		{"host:a", 0, false},
+		{"env:dev", 0, false},
+	}
+
+	// A filter must select exactly one series
+	for _, tc := range testCases {
+		data, err := srv.Log("web", tc.tags, []string{"counter"}, from, 2, 2)
+		if (err == nil) != tc.ok {
+			t.Error(tc.tags, "returned", err)
+		} else if tc.ok && (len(data) != 2 || data[0][0] != 2*tc.value) {
+			t.Error(tc.tags, "returned", data)
+		}
+	}
+	if _, err := srv.Log("web", "env:test", []string{"counter"}, from, 2, 2); err == nil ||
+		err.Error() != "Tags match several series of web: env:test,host:a env:test,host:b" {
+		t.Error("env:test returned", err)
+	}
+
+	srv.mu.Lock()
+	n := len(srv.metrics[Counter])
+	srv.mu.Unlock()
+	if n != 2 {
+		t.Error("Queries created", n, "entries, expected 2")
+	}
+}
+
+// lockCheckDs fails the test if ListNames is called with srv.mu held.
+type lockCheckDs struct {
+	Datastore
+	t   *testing.T
+	srv *Server
+}
+
+func (ds lockCheckDs) ListNames(pattern string) ([]string, error) {
+	locked := make(chan bool)
+	go func() {
+		ds.srv.mu.Lock()
+		ds.srv.mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		ds.t.Error("ListNames called with the server locked")
+	}
+	return ds.Datastore.ListNames(pattern)
+}
+
+func TestQueryTagsUnlocked(t *testing.T) {
+	ds := &MemDatastore{Interval: 1}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	srv := &Server{}
+	srv.Ds = lockCheckDs{ds, t, srv}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	from := time.Now().Unix() - 60
+	ds.Insert("web#env:prod,host:a:counter", Record{Ts: from + 1, Value: 1})
+	if _, err := srv.Log("web", "env:prod", []string{"counter"}, from, 2, 2); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInjectAtPast(t *testing.T) {
+	ds := &MemDatastore{Interval: 2}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	srv := &Server{Ds: ds}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+	if err := srv.AddWildcard(Counter, "c*"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := srv.LiveLog("c1", "", []string{"counter"}); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.mu.Lock()
+	ts := srv.lastTick - srv.lastTick%2 - 10
+	srv.mu.Unlock()
+	for i, v := range []float64{1, 2, 4} {
+		if err := srv.InjectAt(&Metric{Name: "c1", Type: Counter, Value: v, SampleRate: 1}, ts-1+int64(i%2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"c1:counter", "c*:counter"} {
+		recs, err := ds.Query(name, ts, ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(recs) != 1 || recs[0].Value != 7 {
+			t.Error(name, "archived", recs)
+		}
+	}
+
+	data, from, err := srv.LiveLog("c1", "", []string{"counter"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i := ts - from - 1; data[i-1][0] != 5 || data[i][0] != 2 {
+		t.Error("Live log has", data[i-1], data[i])
+	}
+
+	// Points are merged into the intervals flushed from live data, except
+	// for gauges
+	ds.Insert("c2:counter", Record{Ts: ts - 2, Value: 10})
+	ds.Insert("g:gauge", Record{Ts: ts - 2, Value: 10})
+	srv.InjectAt(&Metric{Name: "c2", Type: Counter, Value: 1, SampleRate: 1}, ts-3)
+	srv.InjectAt(&Metric{Name: "g", Type: Gauge, Value: 3, SampleRate: 1}, ts-3)
+	for name, v := range map[string]float64{"c2:counter": 11, "g:gauge": 3} {
+		if recs, _ := ds.Query(name, ts-2, ts-2); len(recs) != 1 || recs[0].Value != v {
+			t.Error(name, "archived", recs)
+		}
+	}
+}
+
+func TestPastEntries(t *testing.T) {
+	srv := &Server{past: make(map[pastKey]*list.Element)}
+	for i := int64(0); i < 5; i++ {
+		srv.pastEntry(pastKey{Counter, "a", i}, i, 0)
+	}
+	srv.pastEntry(pastKey{Counter, "a", 1}, 5, 0)
+	srv.pastEntry(pastKey{Counter, "a", 5}, 6, 3)
+	if len(srv.past) != 4 || srv.past[pastKey{Counter, "a", 1}] == nil || srv.past[pastKey{Counter, "a", 2}] != nil {
+		t.Error("Entries left:", len(srv.past))
+	}
+
+	for i := int64(0); i < pastMaxEntries+10; i++ {
+		srv.pastEntry(pastKey{Counter, "b", i}, 10, 0)
+	}
+	if len(srv.past) != pastMaxEntries || srv.pastOrder.Len() != pastMaxEntries {
+		t.Error("Entries left:", len(srv.past))
+	}
+}
+
+func TestServerNotRunning(t *testing.T) {
+	srv := &Server{Ds: &MemDatastore{Interval: 1}}
+	if _, err := srv.Log("a", "", []string{"counter"}, 0, 1, 1); err == nil {
+		t.Error("Log succeeded")
+	}
+	if _, err := srv.Watch("a", "", []string{"counter"}, 0, 1); err == nil {
+		t.Error("Watch succeeded")
+	}
+	if err := srv.InjectAt(&Metric{Name: "a", Type: Counter, Value: 1, SampleRate: 1}, 1); err == nil {
+		t.Error("InjectAt succeeded")
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	fsDsSketchExt    = ".skt"
+	fsDsSketchHeader = 8
+)
+
+// The sketches of a stream are kept in <name>.skt, which starts with the
+// size of the sketches, followed by the timestamp and the data of each
+// sketch in the order of the timestamps. Appending and replacing a sketch
+// is done in place, anything else rewrites the file and renames it into
+// place. A sketch cut short by a crash is ignored and overwritten by the
+// next one appended.
+type fsDsSketchFile struct {
+	f    *os.File
+	size int64
+	n    int64
+}
+
+func openSketchFile(fn string, flag int) (*fsDsSketchFile, error) {
+	f, err := os.OpenFile(fn, flag, 0666)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	d := make([]byte, fsDsSketchHeader)
+	if _, err := f.ReadAt(d, 0); err != nil {
+		f.Close()
+		return nil, Error("Invalid sketch file: " + filepath.Base(fn))
+	}
+	sf := &fsDsSketchFile{f: f, size: int64(binary.LittleEndian.Uint64(d))}
+	if sf.size <= 0 || sf.size > fsDsWalSegment {
+		f.Close()
+		return nil, Error("Invalid sketch file: " + filepath.Base(fn))
+	}
+	sf.n = (fi.Size() - fsDsSketchHeader) / (8 + sf.size)
+	return sf, nil
+}
+
+func (sf *fsDsSketchFile) close() {
+	sf.f.Close()
+}
+
+func (sf *fsDsSketchFile) offset(i int64) int64 {
+	return fsDsSketchHeader + i*(8+sf.size)
+}
+
+func (sf *fsDsSketchFile) ts(i int64) (int64, error) {
+	d := make([]byte, 8)
+	if _, err := sf.f.ReadAt(d, sf.offset(i)); err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(d)), nil
+}
+
+// search returns the index of the first sketch at or after ts.
+func (sf *fsDsSketchFile) search(ts int64) (int64, error) {
+	i, j := int64(0), sf.n
+	for i < j {
+		k := (i + j) / 2
+		t, err := sf.ts(k)
+		if err != nil {
+			return 0, err
+		}
+		if t < ts {
+			i = k + 1
+		} else {
+			j = k
+		}
+	}
+	return i, nil
+}
+
+// read returns the sketches from the ith one on up to and including until.
+func (sf *fsDsSketchFile) read(i, until int64) ([]Sketch, error) {
+	var r []Sketch
+	d := make([]byte, 8+sf.size)
+	for ; i < sf.n; i++ {
+		if _, err := sf.f.ReadAt(d, sf.offset(i)); err != nil {
+			return nil, err
+		}
+		ts := int64(binary.LittleEndian.Uint64(d))
+		if ts > until {
+			break
+		}
+		r = append(r, Sketch{Ts: ts, Data: append([]byte(nil), d[8:]...)})
+	}
+	return r, nil
+}
+
+func (sf *fsDsSketchFile) write(i int64, s Sketch) error {
+	d := make([]byte, 8, 8+sf.size)
+	binary.LittleEndian.PutUint64(d, uint64(s.Ts))
+	_, err := sf.f.WriteAt(append(d, s.Data...), sf.offset(i))
+	return err
+}
+
+// writeSketchFile replaces the file fn with one holding sketches of the
+// given size.
+func writeSketchFile(fn string, size int64, sketches []Sketch, nosync bool) error {
+	f, err := os.Create(fn + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w, le := bufio.NewWriter(f), binary.LittleEndian
+	if err := binary.Write(w, le, size); err != nil {
+		return err
+	}
+	for _, s := range sketches {
+		if err := binary.Write(w, le, s.Ts); err != nil {
+			return err
+		}
+		if _, err := w.Write(s.Data); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if !nosync {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return os.Rename(fn+".tmp", fn)
+}
+
+func (ds *FsDatastore) sketchPath(name string) string {
+	return ds.Dir + string(os.PathSeparator) + name + fsDsSketchExt
+}
+
+func (ds *FsDatastore) isRunning() bool {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.running
+}
+
+// InsertSketch adds a sketch to the file of name, replacing the sketch
+// with the same timestamp. All sketches of a name must have the same size.
+func (ds *FsDatastore) InsertSketch(name string, s Sketch) error {
+	if res := ds.streamRes(name); s.Ts%res != 0 {
+		return Error("Timestamp not divisible by resolution")
+	}
+	if len(s.Data) == 0 {
+		return Error("Empty sketch")
+	}
+	if !ds.isRunning() {
+		return Error("Datastore not running")
+	}
+	ds.smu.Lock()
+	defer ds.smu.Unlock()
+
+	fn := ds.sketchPath(name)
+	sf, err := openSketchFile(fn, os.O_RDWR)
+	if os.IsNotExist(err) {
+		return writeSketchFile(fn, int64(len(s.Data)), []Sketch{s}, ds.NoSync)
+	} else if err != nil {
+		return err
+	}
+	defer sf.close()
+	if int64(len(s.Data)) != sf.size {
+		return Error("Sketch size mismatch: " + name)
+	}
+
+	i, err := sf.search(s.Ts)
+	if err != nil {
+		return err
+	}
+	if i < sf.n {
+		if ts, err := sf.ts(i); err != nil {
+			return err
+		} else if ts != s.Ts {
+			all, err := sf.read(0, 1<<63-1)
+			if err != nil {
+				return err
+			}
+			all = append(all[:i], append([]Sketch{s}, all[i:]...)...)
+			return writeSketchFile(fn, sf.size, all, ds.NoSync)
+		}
+	}
+	if err := sf.write(i, s); err != nil {
+		return err
+	}
+	if !ds.NoSync {
+		return sf.f.Sync()
+	}
+	return nil
+}
+
+// querySketches returns the sketches of name in [from, until].
+func (ds *FsDatastore) querySketches(name string, from, until int64) ([]Sketch, error) {
+	if !ds.isRunning() {
+		return nil, Error("Datastore not running")
+	}
+	sf, err := openSketchFile(ds.sketchPath(name), os.O_RDONLY)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer sf.close()
+
+	i, err := sf.search(from)
+	if err != nil {
+		return nil, err
+	}
+	return sf.read(i, until)
+}
+
+// truncateSketches removes the sketches up to and including ts.
+func (ds *FsDatastore) truncateSketches(name string, ts int64) error {
+	ds.smu.Lock()
+	defer ds.smu.Unlock()
+
+	fn := ds.sketchPath(name)
+	sf, err := openSketchFile(fn, os.O_RDONLY)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer sf.close()
+
+	i, err := sf.search(ts + 1)
+	if err != nil || i == 0 {
+		return err
+	}
+	rest, err := sf.read(i, 1<<63-1)
+	if err != nil {
+		return err
+	}
+	return writeSketchFile(fn, sf.size, rest, ds.NoSync)
+}
+
+// sketchNames returns the names of every sketch file, including those of
+// rolled up tiers.
+func (ds *FsDatastore) sketchNames() ([]string, error) {
+	files, err := ioutil.ReadDir(ds.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var r []string
+	for _, fi := range files {
+		if fn := fi.Name(); strings.HasSuffix(fn, fsDsSketchExt) {
+			r = append(r, fn[:len(fn)-len(fsDsSketchExt)])
+		}
+	}
+	return r, nil
+}
+
+// deleteSketches removes the sketches matching pattern together with
+// their tiers and returns their names.
+func (ds *FsDatastore) deleteSketches(pattern string) ([]string, error) {
+	ds.smu.Lock()
+	defer ds.smu.Unlock()
+
+	all, err := ds.sketchNames()
+	if err != nil {
+		return nil, err
+	}
+	var r []string
+	for _, name := range all {
+		base := name
+		if isTierName(name) {
+			base = name[:strings.LastIndex(name, "@")]
+		}
+		m, err := filepath.Match(pattern, base)
+		if err != nil {
+			return r, err
+		}
+		if !m {
+			continue
+		}
+		if err := os.Remove(ds.sketchPath(name)); err != nil {
+			return r, err
+		}
+		if base == name {
+			r = append(r, name)
+		}
+	}
+	sort.Strings(r)
+	return r, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFsDatastoreSketches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sketch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ds := &FsDatastore{Dir: dir, NoSync: true}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	name := "a:timer-digest"
+	for _, s := range []Sketch{{120, []byte{2, 2}}, {60, []byte{1, 1}}, {240, []byte{4, 4}}, {180, []byte{3, 3}}, {120, []byte{5, 5}}} {
+		if err := ds.InsertSketch(name, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ds.InsertSketch(name, Sketch{300, []byte{1}}); err == nil {
+		t.Error("Sketch of a different size inserted")
+	}
+
+	expect := func(name string, from, until int64, ts ...int64) {
+		s, err := ds.QuerySketches(name, from, until, 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := map[int64]byte{60: 1, 120: 5, 180: 3, 240: 4}
+		ok := len(s) == len(ts)
+		for i := 0; ok && i < len(s); i++ {
+			ok = s[i].Ts == ts[i] && s[i].Data[0] == data[ts[i]]
+		}
+		if !ok {
+			t.Fatal("Query", name, from, until, "returned", s)
+		}
+	}
+	expect(name, 0, 300, 60, 120, 180, 240)
+	expect(name, 60, 180, 120, 180)
+
+	if err := ds.truncateSketches(name, 120); err != nil {
+		t.Fatal(err)
+	}
+	expect(name, 0, 300, 180, 240)
+
+	if names, _ := ds.ListNames("*"); len(names) != 0 {
+		t.Error("Sketches listed:", names)
+	}
+	if err := ds.Rename(seriesOf(name), "b"); err != nil {
+		t.Fatal(err)
+	}
+	expect(name, 0, 300)
+	expect("b:timer-digest", 0, 300, 180, 240)
+	if names, err := ds.Delete("b:*"); err != nil || len(names) != 1 {
+		t.Error("Delete returned", names, err)
+	}
+	expect("b:timer-digest", 0, 300)
+}
@@ -2,108 +2,45 @@ package main
 
 import (
 	"log"
-	"net"
-	"sync"
+	"sync/atomic"
 )
 
-const TcpMsgMaxSize = 128
+const (
+	TcpMsgMaxSize    = 64 * 1024
+	TcpDroppedMetric = "statsd.tcp.dropped"
+)
 
 type TCPInjector struct {
-	Addr     string
-	Server   *Server
-	mu, cmu  sync.Mutex
-	listener *net.TCPListener
-	conns    []*net.TCPConn
-	running  bool
-	wg       sync.WaitGroup
+	dropped     uint64 // first for 64-bit alignment
+	Addr        string
+	Server      *Server
+	MaxLineSize int
+	ls          lineServer
 }
 
 func (ti *TCPInjector) Start() error {
-	ti.mu.Lock()
-	defer ti.mu.Unlock()
-
-	if ti.running {
-		return Error("Injector already running")
-	}
-
-	addr, err := net.ResolveTCPAddr("tcp", ti.Addr)
-	if err != nil {
-		return err
+	ti.ls.network, ti.ls.addr = "tcp", ti.Addr
+	ti.ls.maxLine, ti.ls.handle, ti.ls.dropped = ti.MaxLineSize, ti.Server.InjectBytes, ti.drop
+	if ti.ls.maxLine <= 0 {
+		ti.ls.maxLine = TcpMsgMaxSize
 	}
-
-	listener, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		return err
-	}
-
-	ti.listener, ti.running = listener, true
-
-	go ti.run()
-	return nil
+	return ti.ls.start()
 }
 
 func (ti *TCPInjector) Stop() error {
-	ti.mu.Lock()
-	defer ti.mu.Unlock()
-
-	if !ti.running {
-		return Error("Injector not running")
-	}
-
-	ti.running = false
-	ti.listener.Close()
-	ti.wg.Wait()
-	return nil
+	return ti.ls.stop()
 }
 
-func (ti *TCPInjector) run() {
-	for {
-		conn, err := ti.listener.AcceptTCP()
-		if err != nil {
-			log.Println("TCPListener.Accept:", err)
-			break
-		}
-		ti.cmu.Lock()
-		ti.conns = append(ti.conns, conn)
-		i := len(ti.conns) - 1
-		ti.cmu.Unlock()
-		ti.wg.Add(1)
-		go ti.serve(conn, i)
-	}
-	ti.cmu.Lock()
-	for _, conn := range ti.conns {
-		conn.Close()
-	}
-	ti.cmu.Unlock()
+// Dropped returns the number of lines dropped for being longer than
+// MaxLineSize. Drops are also counted by the TcpDroppedMetric counter.
+func (ti *TCPInjector) Dropped() uint64 {
+	return atomic.LoadUint64(&ti.dropped)
 }
 
-func (ti *TCPInjector) serve(conn *net.TCPConn, i int) {
-	buff, bsize, drop := make([]byte, TcpMsgMaxSize), 0, false
-	for {
-		n, err := conn.Read(buff[bsize:])
-		if n > 0 {
-			bsize += n
-			for i := 0; i < bsize; i++ {
-				if buff[i] == '\n' {
-					if !drop {
-						ti.Server.InjectBytes(buff[0:i])
-					}
-					bsize = copy(buff[0:], buff[i+1:bsize])
-					i, drop = 0, false
-				}
-			}
-			if bsize == len(buff) {
-				drop, bsize = true, 0
-			}
-		}
-		if err != nil {
-			log.Println("TCPConn.Read:", err)
-			break
-		}
+func (ti *TCPInjector) drop() {
+	atomic.AddUint64(&ti.dropped, 1)
+	metric := &Metric{Name: TcpDroppedMetric, Type: Counter, Value: 1, SampleRate: 1}
+	if err := ti.Server.Inject(metric); err != nil {
+		log.Println("TCPInjector.drop:", err)
 	}
-	ti.cmu.Lock()
-	ti.conns[i] = ti.conns[len(ti.conns)-1]
-	ti.conns = ti.conns[0 : len(ti.conns)-1]
-	ti.cmu.Unlock()
-	ti.wg.Done()
 }
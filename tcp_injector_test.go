@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// liveNames returns the sorted names of the live metrics of srv.
+func liveNames(t *testing.T, srv *Server) []string {
+	cvs, err := srv.CurrentValues()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r []string
+	for _, cv := range cvs {
+		r = append(r, cv.Name)
+	}
+	sort.Strings(r)
+	return r
+}
+
+func TestTCPInjector(t *testing.T) {
+	ds := &MemDatastore{Interval: 1}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	srv := &Server{Ds: ds}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	ti := &TCPInjector{Addr: "127.0.0.1:0", Server: srv, MaxLineSize: 32}
+	if err := ti.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer ti.Stop()
+
+	conn, err := net.Dial("tcp", ti.ls.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("a:1|c\n" + strings.Repeat("x", 100) + ":1|c\nb:1|c\n"))
+	conn.Close()
+
+	expected := "a b " + TcpDroppedMetric
+	for i := 0; i < 100 && strings.Join(liveNames(t, srv), " ") != expected; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if names := liveNames(t, srv); strings.Join(names, " ") != expected || ti.Dropped() != 1 {
+		t.Error("Injected", names, "dropped", ti.Dropped())
+	}
+}
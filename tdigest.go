@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// Maximum number of centroids kept by a tDigest, the archived form of a
+// digest is a fixed array of tdCentroids means followed by their weights.
+const tdCentroids = 32
+
+type tdCentroid struct {
+	mean, weight float64
+}
+
+// tDigest is a merging t-digest using a logarithmic (k2 style) scale
+// function so that the tails, where the interesting percentiles are,
+// get small centroids.
+type tDigest struct {
+	cs     []tdCentroid
+	buff   []tdCentroid
+	weight float64
+}
+
+func (td *tDigest) add(mean, weight float64) {
+	if weight <= 0 || math.IsNaN(mean) {
+		return
+	}
+	td.buff = append(td.buff, tdCentroid{mean, weight})
+	td.weight += weight
+	if len(td.buff) >= 8*tdCentroids {
+		td.compress()
+	}
+}
+
+func (td *tDigest) reset() {
+	td.cs, td.buff, td.weight = nil, nil, 0
+}
+
+func (td *tDigest) compress() {
+	if len(td.buff) == 0 {
+		return
+	}
+	all := append(td.cs, td.buff...)
+	sort.Sort(tdSorter(all))
+	td.buff = nil
+
+	norm := float64(tdCentroids) / (2 * math.Log(2*math.Max(td.weight, 1)))
+	for {
+		td.cs = tdMerge(all, td.weight, norm)
+		if len(td.cs) <= tdCentroids {
+			break
+		}
+		norm *= 0.8
+	}
+}
+
+func tdMerge(in []tdCentroid, total, norm float64) []tdCentroid {
+	k := func(w float64) float64 {
+		q := math.Min(math.Max(w/total, 0.5/total), 1-0.5/total)
+		return norm * math.Log(q/(1-q))
+	}
+
+	out := make([]tdCentroid, 0, tdCentroids)
+	cur, before := in[0], 0.0
+	for _, c := range in[1:] {
+		if k(before+cur.weight+c.weight)-k(before) <= 1 {
+			w := cur.weight + c.weight
+			cur.mean += (c.mean - cur.mean) * c.weight / w
+			cur.weight = w
+		} else {
+			out = append(out, cur)
+			before += cur.weight
+			cur = c
+		}
+	}
+	return append(out, cur)
+}
+
+// quantile estimates the q-th quantile (0 <= q <= 1) of the digest, min
+// and max are the exact extremes of the data, used to interpolate in the
+// outermost centroids.
+func (td *tDigest) quantile(q, min, max float64) float64 {
+	td.compress()
+	if len(td.cs) == 0 {
+		return math.NaN()
+	}
+
+	target := q * td.weight
+	first, last := td.cs[0], td.cs[len(td.cs)-1]
+	if target < first.weight/2 {
+		return tdInterpolate(min, first.mean, target/(first.weight/2))
+	}
+	if target > td.weight-last.weight/2 {
+		return tdInterpolate(last.mean, max, 1-(td.weight-target)/(last.weight/2))
+	}
+
+	cum := first.weight / 2
+	for i := 1; i < len(td.cs); i++ {
+		prev, c := td.cs[i-1], td.cs[i]
+		step := (prev.weight + c.weight) / 2
+		if target <= cum+step {
+			return tdInterpolate(prev.mean, c.mean, (target-cum)/step)
+		}
+		cum += step
+	}
+	return last.mean
+}
+
+func tdInterpolate(a, b, t float64) float64 {
+	if math.IsNaN(a) || math.IsInf(a, 0) {
+		return b
+	}
+	if math.IsNaN(b) || math.IsInf(b, 0) {
+		return a
+	}
+	return a + (b-a)*t
+}
+
+func (td *tDigest) pack(data []float64) {
+	td.compress()
+	for i := 0; i < tdCentroids; i++ {
+		if i < len(td.cs) {
+			data[i], data[tdCentroids+i] = td.cs[i].mean, td.cs[i].weight
+		} else {
+			data[i], data[tdCentroids+i] = 0, 0
+		}
+	}
+}
+
+func (td *tDigest) mergePacked(data []float64) {
+	for i := 0; i < tdCentroids; i++ {
+		td.add(data[i], data[tdCentroids+i])
+	}
+}
+
+// marshal returns the packed digest as little endian floats, the form it
+// is archived in as a sketch.
+func (td *tDigest) marshal() []byte {
+	data := make([]float64, 2*tdCentroids)
+	td.pack(data)
+	b := make([]byte, 8*len(data))
+	for i, v := range data {
+		binary.LittleEndian.PutUint64(b[8*i:], math.Float64bits(v))
+	}
+	return b
+}
+
+// mergeMarshaled merges a marshaled digest and reports whether it was a
+// valid one of some weight.
+func (td *tDigest) mergeMarshaled(b []byte) bool {
+	if len(b) != 16*tdCentroids {
+		return false
+	}
+	data, weight := make([]float64, 2*tdCentroids), 0.0
+	for i := range data {
+		data[i] = math.Float64frombits(binary.LittleEndian.Uint64(b[8*i:]))
+	}
+	for _, w := range data[tdCentroids:] {
+		if w > 0 {
+			weight += w
+		}
+	}
+	if !(weight > 0) {
+		return false
+	}
+	td.mergePacked(data)
+	return true
+}
+
+type tdSorter []tdCentroid
+
+func (s tdSorter) Len() int {
+	return len(s)
+}
+
+func (s tdSorter) Less(i, j int) bool {
+	return s[i].mean < s[j].mean
+}
+
+func (s tdSorter) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
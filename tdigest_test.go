@@ -0,0 +1,52 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestTDigestQuantile(t *testing.T) {
+	var td tDigest
+	rnd := rand.New(rand.NewSource(1))
+	n := 100000
+	for i := 0; i < n; i++ {
+		td.add(float64(rnd.Intn(n)), 1)
+	}
+
+	for _, q := range []float64{0.25, 0.5, 0.9, 0.99, 0.999} {
+		v := td.quantile(q, 0, float64(n-1))
+		if math.Abs(v-q*float64(n)) > 0.02*float64(n) {
+			t.Error("Quantile too far off:", q)
+			t.Error("Returned:", v)
+		}
+	}
+	if len(td.cs) > tdCentroids {
+		t.Error("Too many centroids:", len(td.cs))
+	}
+}
+
+func TestTDigestPacked(t *testing.T) {
+	var a, b, c tDigest
+	for i := 0; i < 1000; i++ {
+		a.add(float64(i), 1)
+		b.add(float64(i+1000), 1)
+	}
+
+	data := make([]float64, 2*tdCentroids)
+	a.pack(data)
+	c.mergePacked(data)
+	b.pack(data)
+	c.mergePacked(data)
+
+	if c.weight != 2000 {
+		t.Error("Incorrect weight:", c.weight)
+	}
+	for _, q := range []float64{0.1, 0.5, 0.99} {
+		v := c.quantile(q, 0, 1999)
+		if math.Abs(v-q*2000) > 40 {
+			t.Error("Quantile too far off:", q)
+			t.Error("Returned:", v)
+		}
+	}
+}
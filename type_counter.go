@@ -6,6 +6,7 @@ func init() {
 		channels:   []string{"counter"},
 		defaults:   []float64{0},
 		persist:    []bool{false},
+		total:      []bool{true},
 		aggregator: func([]string) aggregator { return &counterAggregator{} },
 	}
 	registerMetricType(Counter, mt)
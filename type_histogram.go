@@ -0,0 +1,165 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var defaultHistogramBuckets = []float64{1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+func init() {
+	registerMetricType(Histogram, histogramType(defaultHistogramBuckets))
+}
+
+func checkHistogramBuckets(bounds []float64) error {
+	if len(bounds) == 0 {
+		return Error("No histogram buckets specified")
+	}
+	for i, b := range bounds {
+		if math.IsNaN(b) || math.IsInf(b, 0) {
+			return Error("Histogram bucket bound invalid")
+		}
+		if i > 0 && b <= bounds[i-1] {
+			return Error("Histogram bucket bounds must be increasing")
+		}
+	}
+	return nil
+}
+
+func ParseHistogramBuckets(s string) ([]float64, error) {
+	var r []float64
+	for _, f := range strings.Split(s, ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, Error("Histogram bucket bound invalid: " + f)
+		}
+		r = append(r, b)
+	}
+	return r, checkHistogramBuckets(r)
+}
+
+// histogramType returns the metric type of histograms with the given
+// upper bounds of the buckets. The registered type has the default
+// bounds, a Server may use others, see Server.HistogramBuckets.
+func histogramType(bounds []float64) metricType {
+	n := 2 + len(bounds) + 1
+	mt := metricType{
+		create:   func() metric { return &histMetric{bounds: bounds} },
+		channels: make([]string, 0, n),
+		defaults: make([]float64, n),
+		persist:  make([]bool, n),
+		total:    make([]bool, n),
+	}
+	for i := range mt.total {
+		mt.total[i] = true
+	}
+	mt.channels = append(mt.channels, "hist-cnt", "hist-sum")
+	for _, b := range bounds {
+		mt.channels = append(mt.channels, "hist-"+strconv.FormatFloat(b, 'g', -1, 64))
+	}
+	mt.channels = append(mt.channels, "hist-inf")
+	all := mt.channels
+	mt.aggregator = func(chs []string) aggregator {
+		return createHistAggregator(all, chs)
+	}
+	return mt
+}
+
+// histogramBounds returns the bounds of the bucket channels in chs, in
+// order. Other channels are ignored.
+func histogramBounds(chs []string) []float64 {
+	var r []float64
+	for _, ch := range chs {
+		if b, ok := histogramBound(ch); ok {
+			r = append(r, b)
+		}
+	}
+	sort.Float64s(r)
+	return r
+}
+
+// histogramBound returns the upper bound of a bucket channel with a finite
+// bound.
+func histogramBound(ch string) (float64, bool) {
+	if !strings.HasPrefix(ch, "hist-") {
+		return 0, false
+	}
+	b, err := strconv.ParseFloat(ch[len("hist-"):], 64)
+	if err != nil || math.IsNaN(b) || math.IsInf(b, 0) || "hist-"+strconv.FormatFloat(b, 'g', -1, 64) != ch {
+		return 0, false
+	}
+	return b, true
+}
+
+type histMetric struct {
+	bounds         []float64
+	tickData, data []float64
+}
+
+func (m *histMetric) init([]float64) {
+	m.tickData = make([]float64, 2+len(m.bounds)+1)
+	m.data = make([]float64, len(m.tickData))
+}
+
+func (m *histMetric) inject(metric *Metric) {
+	cnt := 1 / metric.SampleRate
+	m.tickData[0] += cnt
+	m.tickData[1] += metric.Value * cnt
+	m.tickData[2+sort.SearchFloat64s(m.bounds, metric.Value)] += cnt
+}
+
+func (m *histMetric) tick() []float64 {
+	data := m.tickData
+	for i, v := range data {
+		m.data[i] += v
+	}
+	m.tickData = make([]float64, len(data))
+	return data
+}
+
+func (m *histMetric) flush() []float64 {
+	data := m.data
+	m.data = make([]float64, len(data))
+	return data
+}
+
+type histAggregator struct {
+	chs  []int
+	sums []float64
+}
+
+func createHistAggregator(all, chs []string) aggregator {
+	aggr := &histAggregator{
+		chs:  make([]int, len(chs)),
+		sums: make([]float64, len(chs)),
+	}
+	for i, ch := range chs {
+		for j, n := range all {
+			if n == ch {
+				aggr.chs[i] = j
+			}
+		}
+	}
+	return aggr
+}
+
+func (aggr *histAggregator) channels() []int {
+	return aggr.chs
+}
+
+func (aggr *histAggregator) init([]float64) {
+}
+
+func (aggr *histAggregator) put(data []float64) {
+	for i, v := range data {
+		aggr.sums[i] += v
+	}
+}
+
+func (aggr *histAggregator) get() []float64 {
+	sums := aggr.sums
+	aggr.sums = make([]float64, len(sums))
+	return sums
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseHistogramBuckets(t *testing.T) {
+	var testCases = []struct {
+		s      string
+		bounds []float64
+		ok     bool
+	}{
+		{"1,2.5,10", []float64{1, 2.5, 10}, true},
+		{" -1, 0 ", []float64{-1, 0}, true},
+		{"1,1", nil, false},
+		{"2,1", nil, false},
+		{"1,inf", nil, false},
+		{"1,,2", nil, false},
+	}
+
+	for _, tc := range testCases {
+		bounds, err := ParseHistogramBuckets(tc.s)
+		if (err == nil) != tc.ok {
+			t.Error("Unexpected error for", tc.s, err)
+		} else if tc.ok && !reflect.DeepEqual(bounds, tc.bounds) {
+			t.Error("Incorrect bounds for", tc.s, bounds)
+		}
+	}
+}
+
+func TestHistogramInject(t *testing.T) {
+	mt := histogramType([]float64{1, 5})
+	if expected := []string{"hist-cnt", "hist-sum", "hist-1", "hist-5", "hist-inf"}; !reflect.DeepEqual(mt.channels, expected) {
+		t.Fatal("Channels:", mt.channels)
+	}
+
+	// Values equal to a bound go into its bucket
+	m := mt.create()
+	m.init(mt.defaults)
+	for _, v := range []float64{0, 1, 1.5, 5, 5.5} {
+		m.inject(&Metric{Type: Histogram, Value: v, SampleRate: 1})
+	}
+	m.inject(&Metric{Type: Histogram, Value: 2, SampleRate: 0.5})
+	if data := m.tick(); !reflect.DeepEqual(data, []float64{7, 17, 2, 4, 1}) {
+		t.Error("Tick returned", data)
+	}
+	if data := m.flush(); !reflect.DeepEqual(data, []float64{7, 17, 2, 4, 1}) {
+		t.Error("Flush returned", data)
+	}
+}
+
+func TestHistogramArchive(t *testing.T) {
+	ds := &MemDatastore{Interval: 1}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	srv := &Server{Ds: ds, HistogramBuckets: []float64{1, 5}}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	from := time.Now().Unix() - 60
+	mt := &srv.types[Histogram]
+	for i, values := range [][]float64{{1, 3}, {6, 0.5, 5}} {
+		m := mt.create()
+		m.init(mt.defaults)
+		for _, v := range values {
+			m.inject(&Metric{Type: Histogram, Value: v, SampleRate: 1})
+		}
+		m.tick()
+		for j, v := range m.flush() {
+			ds.Insert("h:"+mt.channels[j], Record{Ts: from + int64(i) + 1, Value: v})
+		}
+	}
+
+	var testCases = []struct {
+		chs    []string
+		gran   int64
+		result [][]float64
+	}{
+		{[]string{"hist-cnt", "hist-1", "hist-inf"}, 1, [][]float64{{2, 1, 0}, {3, 1, 1}}},
+		{[]string{"hist-5", "hist-sum"}, 2, [][]float64{{2, 15.5}}},
+	}
+	for _, tc := range testCases {
+		data, err := srv.Log("h", "", tc.chs, from, 2/tc.gran, tc.gran)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(data, tc.result) {
+			t.Error(tc.chs, "granularity", tc.gran, "returned", data)
+		}
+	}
+
+	// The default buckets are not those of this server
+	if _, err := srv.Log("h", "", []string{"hist-10"}, from, 2, 1); err == nil {
+		t.Error("Unknown bucket accepted")
+	}
+}
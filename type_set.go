@@ -0,0 +1,99 @@
+package main
+
+func init() {
+	registerMetricType(Set, metricType{
+		create:     func() metric { return &setMetric{} },
+		channels:   []string{"set-card"},
+		defaults:   []float64{0},
+		persist:    []bool{false},
+		sketch:     "set-hll",
+		aggregator: createSetAggregator,
+	})
+}
+
+type setMetric struct {
+	tickHll, hll hyperLogLog
+	regs         []byte
+}
+
+func (m *setMetric) init([]float64) {
+}
+
+func (m *setMetric) inject(metric *Metric) {
+	m.tickHll.add(metric.SetValue)
+}
+
+func (m *setMetric) tick() []float64 {
+	card := m.tickHll.estimate()
+	m.hll.merge(&m.tickHll)
+	m.tickHll.reset()
+	return []float64{card}
+}
+
+func (m *setMetric) flush() []float64 {
+	card := m.hll.estimate()
+	m.regs = nil
+	if card > 0 {
+		m.regs = m.hll.marshal()
+	}
+	m.hll.reset()
+	return []float64{card}
+}
+
+func (m *setMetric) sketch() []byte {
+	return m.regs
+}
+
+// setAggregator estimates the cardinality of coarser granularities from
+// the merged sketches of the intervals. Intervals archived without a
+// sketch only count as a lower bound.
+type setAggregator struct {
+	puts, sketches int
+	card, maxCard  float64
+	hll            hyperLogLog
+}
+
+func createSetAggregator(chs []string) aggregator {
+	return &setAggregator{}
+}
+
+func (aggr *setAggregator) channels() []int {
+	return []int{0}
+}
+
+func (aggr *setAggregator) init([]float64) {
+}
+
+func (aggr *setAggregator) put(data []float64) {
+	aggr.puts++
+	aggr.card = data[0]
+	if data[0] > aggr.maxCard {
+		aggr.maxCard = data[0]
+	}
+}
+
+func (aggr *setAggregator) putSketch(b []byte) {
+	if aggr.hll.mergeMarshaled(b) {
+		aggr.sketches++
+	}
+}
+
+func (aggr *setAggregator) getSketch() []byte {
+	if aggr.sketches == 0 {
+		return nil
+	}
+	return aggr.hll.marshal()
+}
+
+func (aggr *setAggregator) get() []float64 {
+	card := aggr.hll.estimate()
+	if aggr.puts == 1 {
+		card = aggr.card
+	} else if aggr.maxCard > card {
+		card = aggr.maxCard
+	}
+	aggr.puts, aggr.sketches = 0, 0
+	aggr.card, aggr.maxCard = 0, 0
+	aggr.hll.reset()
+	return []float64{card}
+}
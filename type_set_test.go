@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSetArchive(t *testing.T) {
+	ds := &MemDatastore{Interval: 1}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	srv := &Server{Ds: ds}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	// The series old has no sketches, like archives of older versions
+	from := time.Now().Unix() - 60
+	m := metricTypes[Set].create()
+	for i, values := range [][]string{{"a", "b"}, {"b", "c", "d"}} {
+		for _, v := range values {
+			m.inject(&Metric{Type: Set, SetValue: v, SampleRate: 1})
+		}
+		m.tick()
+		ts, card := from+int64(i)+1, m.flush()[0]
+		for _, name := range []string{"s", "old"} {
+			ds.Insert(name+":set-card", Record{Ts: ts, Value: card})
+		}
+		ds.InsertSketch("s:set-hll", Sketch{Ts: ts, Data: m.(sketchMetric).sketch()})
+	}
+
+	if names, _ := ds.ListNames("s*"); !reflect.DeepEqual(names, []string{"s:set-card"}) {
+		t.Error("Listed:", names)
+	}
+
+	var testCases = []struct {
+		name   string
+		gran   int64
+		result []float64
+	}{
+		{"s", 1, []float64{2, 3}},
+		{"s", 2, []float64{4}},
+		{"old", 2, []float64{3}},
+	}
+	for _, tc := range testCases {
+		data, err := srv.Log(tc.name, "", []string{"set-card"}, from, 2/tc.gran, tc.gran)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r []float64
+		for _, values := range data {
+			r = append(r, values[0])
+		}
+		if !reflect.DeepEqual(r, tc.result) {
+			t.Error(tc.name, "granularity", tc.gran, "returned", r)
+		}
+	}
+}
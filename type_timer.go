@@ -3,11 +3,53 @@ package main
 import (
 	"math"
 	"sort"
+	"strconv"
+	"strings"
 )
 
+const timerStatChannels = 9
+
+var timerPercentiles = []float64{90, 95, 99, 99.9}
+
 func init() {
+	registerTimer(timerPercentiles)
+}
+
+// SetTimerPercentiles replaces the list of percentiles exposed as timer
+// channels. It must be called before any Server is started.
+func SetTimerPercentiles(ps []float64) error {
+	for i, p := range ps {
+		if !(p > 0 && p < 100) {
+			return Error("Percentile must be between 0 and 100")
+		}
+		if i > 0 && p <= ps[i-1] {
+			return Error("Percentiles must be increasing")
+		}
+	}
+
+	for _, ch := range metricTypes[Timer].channels {
+		delete(outputChannels, ch)
+	}
+	timerPercentiles = append([]float64(nil), ps...)
+	registerTimer(timerPercentiles)
+	return nil
+}
+
+func ParsePercentiles(s string) ([]float64, error) {
+	var r []float64
+	for _, f := range strings.Split(s, ",") {
+		p, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, Error("Percentile invalid: " + f)
+		}
+		r = append(r, p)
+	}
+	return r, nil
+}
+
+func registerTimer(percentiles []float64) {
 	mt := metricType{
-		create: func() metric { return &timerMetric{} },
+		create: func() metric { return &timerMetric{percentiles: percentiles} },
 		channels: []string{
 			"timer-min",
 			"timer-quart1",
@@ -15,6 +57,9 @@ func init() {
 			"timer-quart3",
 			"timer-max",
 			"timer-cnt",
+			"timer-mean",
+			"timer-sum",
+			"timer-stddev",
 		},
 		defaults: []float64{
 			math.NaN(),
@@ -23,6 +68,9 @@ func init() {
 			math.NaN(),
 			math.NaN(),
 			0,
+			math.NaN(),
+			0,
+			math.NaN(),
 		},
 		persist: []bool{
 			false,
@@ -31,15 +79,38 @@ func init() {
 			false,
 			false,
 			false,
+			false,
+			false,
+			false,
+		},
+		total: []bool{
+			false,
+			false,
+			false,
+			false,
+			false,
+			true,
+			false,
+			true,
+			false,
 		},
+		sketch:     "timer-digest",
 		aggregator: createTimerAggregator,
 	}
+	for _, p := range percentiles {
+		mt.channels = append(mt.channels, "timer-p"+strconv.FormatFloat(p, 'g', -1, 64))
+		mt.defaults = append(mt.defaults, math.NaN())
+		mt.persist = append(mt.persist, false)
+		mt.total = append(mt.total, false)
+	}
 	registerMetricType(Timer, mt)
 }
 
 type timerMetric struct {
+	percentiles    []float64
 	tickData, data []float64
 	tickCnt, cnt   []float64
+	digest         []byte
 }
 
 func (m *timerMetric) init([]float64) {
@@ -51,7 +122,7 @@ func (m *timerMetric) inject(metric *Metric) {
 }
 
 func (m *timerMetric) tick() []float64 {
-	stats := timerStats(m.tickData, m.tickCnt)
+	stats := timerStats(m.tickData, m.tickCnt, m.percentiles)
 	m.data = append(m.data, m.tickData...)
 	m.cnt = append(m.cnt, m.tickCnt...)
 	m.tickData = make([]float64, 0, 2*len(m.tickData))
@@ -60,35 +131,67 @@ func (m *timerMetric) tick() []float64 {
 }
 
 func (m *timerMetric) flush() []float64 {
-	stats := timerStats(m.data, m.cnt)
+	stats := timerStats(m.data, m.cnt, m.percentiles)
+
+	// timerStats left the samples sorted
+	var td tDigest
+	for i, v := range m.data {
+		td.add(v, m.cnt[i])
+	}
+	m.digest = nil
+	if len(m.data) > 0 {
+		m.digest = td.marshal()
+	}
+
 	m.data = make([]float64, 0, 2*len(m.data))
 	m.cnt = make([]float64, 0, len(m.data))
 	return stats
 }
 
-func timerStats(data []float64, cnt []float64) []float64 {
-	if nan := math.NaN(); len(data) == 0 {
-		return []float64{nan, nan, nan, nan, nan, 0}
+func (m *timerMetric) sketch() []byte {
+	return m.digest
+}
+
+func timerStats(data []float64, cnt []float64, percentiles []float64) []float64 {
+	stats := make([]float64, timerStatChannels+len(percentiles))
+	if len(data) == 0 {
+		for i := range stats {
+			stats[i] = math.NaN()
+		}
+		stats[5], stats[7] = 0, 0
+		return stats
 	}
 
-	var quart1, median, quart3, n float64
-	for _, v := range cnt {
+	qs := []float64{0.25, 0.50, 0.75}
+	for _, p := range percentiles {
+		qs = append(qs, p/100)
+	}
+	vs := make([]float64, len(qs))
+
+	var n, sum float64
+	for i, v := range cnt {
 		n += v
+		sum += data[i] * v
+	}
+	mean, sqDev := sum/n, 0.0
+	for i, v := range cnt {
+		sqDev += (data[i] - mean) * (data[i] - mean) * v
 	}
 	sort.Sort(&timerSorter{data, cnt})
 	for i, m := 0, float64(0); i < len(data); i++ {
-		if m+cnt[i] >= n*0.25 && m < n*0.25 {
-			quart1 = data[i]
-		}
-		if m+cnt[i] >= n*0.50 && m < n*0.50 {
-			median = data[i]
-		}
-		if m+cnt[i] >= n*0.75 && m < n*0.75 {
-			quart3 = data[i]
+		for j, q := range qs {
+			if m+cnt[i] >= n*q && m < n*q {
+				vs[j] = data[i]
+			}
 		}
 		m += cnt[i]
 	}
-	return []float64{data[0], quart1, median, quart3, data[len(data)-1], n}
+
+	stats[0], stats[1], stats[2], stats[3] = data[0], vs[0], vs[1], vs[2]
+	stats[4], stats[5] = data[len(data)-1], n
+	stats[6], stats[7], stats[8] = mean, sum, math.Sqrt(sqDev/n)
+	copy(stats[timerStatChannels:], vs[3:])
+	return stats
 }
 
 type timerSorter struct {
@@ -109,45 +212,151 @@ func (s *timerSorter) Swap(i, j int) {
 	s.data[j], s.cnt[j] = t1, t2
 }
 
+// timerAggregator merges the archived digests of the intervals, so that
+// the percentiles of coarser granularities are computed from the
+// distribution of the samples rather than from the percentiles of each
+// interval. Only the channels archived by every version are required:
+// intervals without a digest, mean, sum or stddev are estimated from
+// their quartiles.
 type timerAggregator struct {
-	chs       []int
-	data, cnt []float64
+	chs      []int
+	nstats   int
+	last     []float64
+	puts     int
+	min, max float64
+	cnt, sum float64
+	sqSum    float64
+	est      tDigest
+	td       tDigest
+	sketches int
 }
 
+// Weights of min, quartiles and max approximating the distribution of an
+// interval by the trapezoidal rule.
+var timerQuartileWeights = []float64{0.125, 0.25, 0.25, 0.25, 0.125}
+
 func createTimerAggregator(chs []string) aggregator {
-	aggr := &timerAggregator{chs: make([]int, len(chs))}
+	aggr := &timerAggregator{
+		chs:    make([]int, len(chs)),
+		nstats: timerStatChannels + len(timerPercentiles),
+	}
 	for i, ch := range chs {
-		for j, ch2 := range metricTypes[Timer].channels {
-			if ch == ch2 {
-				aggr.chs[i] = j
-				break
-			}
-		}
+		aggr.chs[i] = getChannelIndex(Timer, ch)
 	}
+	aggr.reset()
 	return aggr
 }
 
 func (aggr *timerAggregator) channels() []int {
-	return []int{0, 1, 2, 3, 4, 5}
+	r := make([]int, aggr.nstats)
+	for i := range r {
+		r[i] = i
+	}
+	return r
+}
+
+// required returns the number of channels up to timer-cnt.
+func (aggr *timerAggregator) required() int {
+	return 6
 }
 
 func (aggr *timerAggregator) init(data []float64) {
 }
 
 func (aggr *timerAggregator) put(data []float64) {
-	aggr.data = append(aggr.data, data[0], data[1], data[2], data[3], data[4])
-	aggr.cnt = append(aggr.cnt, data[5], data[5], data[5], data[5], data[5])
+	cnt := data[5]
+	if !(cnt > 0) {
+		return
+	}
+	aggr.puts++
+	aggr.last = append(aggr.last[:0], data...)
+	aggr.min = math.Min(aggr.min, data[0])
+	aggr.max = math.Max(aggr.max, data[4])
+	aggr.cnt += cnt
+	for i, w := range timerQuartileWeights {
+		aggr.est.add(data[i], cnt*w)
+	}
+
+	sum, sd := data[7], data[8]
+	if math.IsNaN(sum) || math.IsNaN(sd) {
+		var mean, sqDev float64
+		for i, w := range timerQuartileWeights {
+			mean += w * data[i]
+		}
+		for i, w := range timerQuartileWeights {
+			sqDev += w * (data[i] - mean) * (data[i] - mean)
+		}
+		if math.IsNaN(sum) {
+			sum = mean * cnt
+		}
+		if math.IsNaN(sd) {
+			sd = math.Sqrt(sqDev)
+		}
+	}
+	aggr.sum += sum
+	aggr.sqSum += cnt * (sd*sd + (sum/cnt)*(sum/cnt))
+}
+
+func (aggr *timerAggregator) putSketch(b []byte) {
+	if aggr.td.mergeMarshaled(b) {
+		aggr.sketches++
+	}
+}
+
+// digest returns the merged digests if every interval had one, and the
+// estimate from the quartiles otherwise.
+func (aggr *timerAggregator) digest() *tDigest {
+	if aggr.sketches >= aggr.puts {
+		return &aggr.td
+	}
+	return &aggr.est
+}
+
+func (aggr *timerAggregator) getSketch() []byte {
+	if aggr.puts == 0 {
+		return nil
+	}
+	return aggr.digest().marshal()
 }
 
 func (aggr *timerAggregator) get() []float64 {
-	// TODO: optimize
-	stats := timerStats(aggr.data, aggr.cnt)
-	stats[5] /= 5
+	stats := timerStats(nil, nil, timerPercentiles)
+	if aggr.puts > 0 {
+		td := aggr.digest()
+		stats[0] = aggr.min
+		stats[1] = td.quantile(0.25, aggr.min, aggr.max)
+		stats[2] = td.quantile(0.50, aggr.min, aggr.max)
+		stats[3] = td.quantile(0.75, aggr.min, aggr.max)
+		stats[4] = aggr.max
+		stats[5] = aggr.cnt
+		stats[6] = aggr.sum / aggr.cnt
+		stats[7] = aggr.sum
+		stats[8] = math.Sqrt(math.Max(aggr.sqSum/aggr.cnt-stats[6]*stats[6], 0))
+		for i, p := range timerPercentiles {
+			stats[timerStatChannels+i] = td.quantile(p/100, aggr.min, aggr.max)
+		}
+	}
+	if aggr.puts == 1 {
+		// The archived values of a single interval are exact
+		for i, v := range aggr.last {
+			if !math.IsNaN(v) {
+				stats[i] = v
+			}
+		}
+	}
+
 	r := make([]float64, len(aggr.chs))
 	for i, j := range aggr.chs {
 		r[i] = stats[j]
 	}
-	aggr.data = make([]float64, 0, len(aggr.data))
-	aggr.cnt = make([]float64, 0, len(aggr.data))
+	aggr.reset()
 	return r
 }
+
+func (aggr *timerAggregator) reset() {
+	aggr.puts, aggr.sketches = 0, 0
+	aggr.min, aggr.max = math.Inf(1), math.Inf(-1)
+	aggr.cnt, aggr.sum, aggr.sqSum = 0, 0, 0
+	aggr.est.reset()
+	aggr.td.reset()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTimerBaselineArchive(t *testing.T) {
+	ds := &MemDatastore{Interval: 1}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	srv := &Server{Ds: ds}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	// Archived with only the channels of the original timers
+	from := time.Now().Unix() - 60
+	chs := []string{"timer-min", "timer-quart1", "timer-median", "timer-quart3", "timer-max", "timer-cnt"}
+	for k := int64(1); k <= 4; k++ {
+		for i, ch := range chs[:5] {
+			ds.Insert("t:"+ch, Record{Ts: from + k, Value: float64(k + int64(i))})
+		}
+		ds.Insert("t:timer-cnt", Record{Ts: from + k, Value: 4})
+	}
+
+	query := []string{"timer-median", "timer-cnt", "timer-p90", "timer-mean"}
+	data, err := srv.Log("t", "", query, from, 4, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 4 || data[0][0] != 3 || data[0][1] != 4 {
+		t.Fatal("Unexpected data:", data)
+	}
+	if p := data[0][2]; !(p > 4 && p < 5) {
+		t.Error("p90 of a single interval:", p)
+	}
+
+	data, err = srv.Log("t", "", query, from, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 2 || data[0][1] != 8 || data[1][1] != 8 {
+		t.Fatal("Unexpected data:", data)
+	}
+	for _, v := range data[0] {
+		if math.IsNaN(v) {
+			t.Error("Missing values:", data[0])
+		}
+	}
+	if m := data[0][0]; !(m > 3 && m < 4) {
+		t.Error("Median of two intervals:", m)
+	}
+	if m := data[0][3]; !(m > 3 && m < 4) {
+		t.Error("Mean estimated from the quartiles:", m)
+	}
+}
+
+func TestTimerMoments(t *testing.T) {
+	ds := &MemDatastore{Interval: 1}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	srv := &Server{Ds: ds}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	// 1, 2 and 3 in one interval, 4 and 5 in the ticks of the next
+	from := time.Now().Unix() - 60
+	m := metricTypes[Timer].create()
+	for i, ticks := range [][][]float64{{{1, 2, 3}}, {{4}, {5}}} {
+		for _, tick := range ticks {
+			for _, v := range tick {
+				m.inject(&Metric{Type: Timer, Value: v, SampleRate: 1})
+			}
+			m.tick()
+		}
+		for j, v := range m.flush() {
+			ds.Insert("t:"+metricTypes[Timer].channels[j], Record{Ts: from + int64(i) + 1, Value: v})
+		}
+	}
+
+	chs := []string{"timer-cnt", "timer-mean", "timer-sum", "timer-stddev"}
+	var testCases = []struct {
+		gran   int64
+		result [][]float64
+	}{
+		{1, [][]float64{{3, 2, 6, math.Sqrt(2.0 / 3)}, {2, 4.5, 9, 0.5}}},
+		{2, [][]float64{{5, 3, 15, math.Sqrt(2)}}},
+	}
+	for _, tc := range testCases {
+		data, err := srv.Log("t", "", chs, from, 2/tc.gran, tc.gran)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != len(tc.result) {
+			t.Fatal("Granularity", tc.gran, "returned", data)
+		}
+		for i, values := range data {
+			for j, v := range values {
+				if math.Abs(v-tc.result[i][j]) > 1e-9 {
+					t.Error("Granularity", tc.gran, "returned", data)
+					t.Error("Expected:", tc.result)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestTimerSketches(t *testing.T) {
+	m := metricTypes[Timer].create()
+	for i := 1; i <= 1000; i++ {
+		m.inject(&Metric{Type: Timer, Value: float64(i), SampleRate: 1})
+	}
+	m.tick()
+	stats := m.flush()
+	sketch := m.(sketchMetric).sketch()
+	if len(sketch) != 16*tdCentroids {
+		t.Fatal("Sketch size:", len(sketch))
+	}
+
+	p99 := timerStatChannels + 2
+	aggr := createTimerAggregator([]string{"timer-cnt", "timer-p99"})
+	aggr.put(stats)
+	aggr.put(stats)
+	aggr.(sketchAggregator).putSketch(sketch)
+	aggr.(sketchAggregator).putSketch(sketch)
+	r := aggr.get()
+	if r[0] != 2000 || math.Abs(r[1]-stats[p99]) > 5 {
+		t.Error("Percentile of merged sketches:", r, stats[p99])
+	}
+
+	// Without a sketch for every interval, the quartiles are used
+	aggr.put(stats)
+	aggr.put(stats)
+	aggr.(sketchAggregator).putSketch(sketch)
+	r = aggr.get()
+	if r[0] != 2000 || !(r[1] > stats[3] && r[1] <= stats[4]) {
+		t.Error("Percentile estimated from the quartiles:", r)
+	}
+
+	m.tick()
+	m.flush()
+	if m.(sketchMetric).sketch() != nil {
+		t.Error("Sketch of an empty interval")
+	}
+}
@@ -8,6 +8,8 @@ const (
 	Gauge
 	Averager
 	Accumulator
+	Set
+	Histogram
 	NMetricTypes = iota
 )
 
@@ -30,14 +32,44 @@ type aggregator interface {
 	get() []float64
 }
 
+// sketchMetric is implemented by metrics which archive a sketch of every
+// flushed interval, returned by sketch after flush. It is nil if the
+// interval had no samples.
+type sketchMetric interface {
+	sketch() []byte
+}
+
+// sketchAggregator is implemented by aggregators which merge the archived
+// sketches of the intervals put. getSketch returns the merged sketch and
+// must be called before get, which resets the aggregator.
+type sketchAggregator interface {
+	putSketch([]byte)
+	getSketch() []byte
+}
+
+// partialAggregator is implemented by aggregators which can do without
+// the inputs after the first required ones, such as channels archives
+// written by older versions don't have. Missing inputs are put as NaN.
+type partialAggregator interface {
+	required() int
+}
+
 type metricType struct {
 	create     func() metric
 	channels   []string
 	defaults   []float64
 	persist    []bool
+	total      []bool
+	sketch     string
 	aggregator func([]string) aggregator
 }
 
+// Total channels are summed over all ticks of a live metric, for the
+// Prometheus counters.
+func (mt *metricType) isTotal(i int) bool {
+	return mt.total != nil && mt.total[i]
+}
+
 func registerMetricType(typ MetricType, mt metricType) {
 	metricTypes[typ] = mt
 	for _, ch := range mt.channels {
@@ -50,14 +82,14 @@ func metricTypeByChannels(chs []string) (MetricType, error) {
 		return -1, Error("No channels specified")
 	}
 
-	typ, ok := outputChannels[chs[0]]
+	typ, ok := channelType(chs[0])
 	if !ok {
 		return -1, Error("No such channel: " + chs[0])
 	}
 
 	names := map[string]bool{chs[0]: true}
 	for _, ch := range chs[1:] {
-		t, ok := outputChannels[ch]
+		t, ok := channelType(ch)
 		if !ok {
 			return -1, Error("No such channel: " + ch)
 		}
@@ -72,8 +104,25 @@ func metricTypeByChannels(chs []string) (MetricType, error) {
 	return typ, nil
 }
 
+// channelType returns the metric type of a channel. Histogram buckets of
+// any bound are channels, as servers may use other bounds than the
+// default ones.
+func channelType(ch string) (MetricType, bool) {
+	if typ, ok := outputChannels[ch]; ok {
+		return typ, true
+	}
+	if _, ok := histogramBound(ch); ok {
+		return Histogram, true
+	}
+	return -1, false
+}
+
 func getChannelIndex(typ MetricType, ch string) int {
-	for i, n := range metricTypes[typ].channels {
+	return metricTypes[typ].channelIndex(ch)
+}
+
+func (mt *metricType) channelIndex(ch string) int {
+	for i, n := range mt.channels {
 		if n == ch {
 			return i
 		}
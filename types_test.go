@@ -14,6 +14,10 @@ func TestMetricTypeByChannels(t *testing.T) {
 		{[]string{"avg", "counter"}, -1},
 		{[]string{"avg", "avg-cnt"}, Averager},
 		{[]string{"avg", "avg-cnt", "counter"}, -1},
+		{[]string{"set-card"}, Set},
+		{[]string{"set-hll0"}, -1},
+		{[]string{"timer-p99", "timer-median"}, Timer},
+		{[]string{"timer-digest0"}, -1},
 	}
 
 	for _, tc := range testCases {
@@ -52,9 +56,14 @@ func TestGetChannelIndex(t *testing.T) {
 	}{
 		{Counter, "counter", true},
 		{Timer, "timer-min", true},
+		{Timer, "timer-p99.9", true},
+		{Timer, "timer-stddev", true},
 		{Gauge, "gauge", true},
 		{Averager, "avg", true},
 		{Accumulator, "acc", true},
+		{Set, "set-card", true},
+		{Histogram, "hist-cnt", true},
+		{Histogram, "hist-inf", true},
 		{Counter, "xyz", false},
 		{Counter, "timer-min", false},
 	}
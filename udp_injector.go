@@ -2,73 +2,79 @@ package main
 
 import (
 	"log"
-	"net"
-	"sync"
+	"time"
 )
 
-const UdpMsgMaxSize = 512
+const (
+	UdpMsgMaxSize      = 64 * 1024
+	UdpReceivedMetric  = "statsd.udp.received"
+	UdpTruncatedMetric = "statsd.udp.truncated"
+)
 
 type UDPInjector struct {
-	Addr    string
-	Server  *Server
-	mu      sync.Mutex
-	conn    *net.UDPConn
-	running bool
-	wg      sync.WaitGroup
+	Addr       string
+	Server     *Server
+	MaxMsgSize int
+	Workers    int
+	ReadBuffer int
+	ps         packetServer
+	quit       chan int
 }
 
 func (ui *UDPInjector) Start() error {
-	ui.mu.Lock()
-	defer ui.mu.Unlock()
-
-	if ui.running {
-		return Error("Injector already running")
-	}
-
-	addr, err := net.ResolveUDPAddr("udp", ui.Addr)
-	if err != nil {
-		return err
+	ui.ps.network, ui.ps.addr = "udp", ui.Addr
+	ui.ps.maxSize, ui.ps.handle = ui.MaxMsgSize, ui.Server.InjectBytes
+	ui.ps.workers, ui.ps.readBuffer = ui.Workers, ui.ReadBuffer
+	if ui.ps.maxSize <= 0 {
+		ui.ps.maxSize = UdpMsgMaxSize
 	}
-
-	conn, err := net.ListenUDP("udp", addr)
-	if err != nil {
+	if err := ui.ps.start(); err != nil {
 		return err
 	}
-
-	ui.conn, ui.running = conn, true
-
-	go ui.run()
+	ui.quit = make(chan int)
+	go ui.report()
 	return nil
 }
 
 func (ui *UDPInjector) Stop() error {
-	ui.mu.Lock()
-	defer ui.mu.Unlock()
-
-	if !ui.running {
-		return Error("Injector not running")
+	if err := ui.ps.stop(); err != nil {
+		return err
 	}
-
-	ui.running = false
-	ui.conn.Close()
-	ui.wg.Wait()
+	close(ui.quit)
 	return nil
 }
 
-func (ui *UDPInjector) run() {
+// Counters returns the number of datagrams received and the number of
+// those that were longer than MaxMsgSize. Both are also reported every
+// second by the UdpReceivedMetric and UdpTruncatedMetric counters.
+func (ui *UDPInjector) Counters() (received, truncated uint64) {
+	return ui.ps.counters()
+}
+
+func (ui *UDPInjector) report() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var lastRecvd, lastTrunc uint64
 	for {
-		buff := make([]byte, UdpMsgMaxSize)
-		n, err := ui.conn.Read(buff)
-		if n > 0 {
-			ui.wg.Add(1)
-			go func() {
-				ui.Server.InjectBytes(buff[0:n])
-				ui.wg.Done()
-			}()
-		}
-		if err != nil {
-			log.Println("UDPConn.Read:", err)
-			break
+		select {
+		case <-ui.quit:
+			return
+		case <-ticker.C:
+			recvd, trunc := ui.ps.counters()
+			ui.inject(UdpReceivedMetric, recvd-lastRecvd)
+			ui.inject(UdpTruncatedMetric, trunc-lastTrunc)
+			lastRecvd, lastTrunc = recvd, trunc
 		}
 	}
 }
+
+func (ui *UDPInjector) inject(name string, n uint64) {
+	if n == 0 {
+		return
+	}
+	metric := &Metric{Name: name, Type: Counter, Value: float64(n), SampleRate: 1}
+	if err := ui.Server.Inject(metric); err != nil {
+		log.Println("UDPInjector.report:", err)
+	}
+}
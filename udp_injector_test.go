@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUDPInjector(t *testing.T) {
+	ds := &MemDatastore{Interval: 1}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	srv := &Server{Ds: ds}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	ui := &UDPInjector{Addr: "127.0.0.1:0", Server: srv, MaxMsgSize: 16, Workers: 2}
+	if err := ui.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer ui.Stop()
+
+	conn, err := net.Dial("udp", ui.ps.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Fits, is truncated to its first two lines, has no complete line
+	for _, msg := range []string{"a:1|c\nb:1|c\n", "c:1|c\nd:1|c\ne:1|c\n", strings.Repeat("x", 20) + ":1|c"} {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The counters are injected every second
+	expected := "a b c d " + UdpReceivedMetric + " " + UdpTruncatedMetric
+	for i := 0; i < 300 && strings.Join(liveNames(t, srv), " ") != expected; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if names := liveNames(t, srv); strings.Join(names, " ") != expected {
+		t.Error("Injected", names)
+	}
+	if recvd, trunc := ui.Counters(); recvd != 3 || trunc != 2 {
+		t.Error("Received", recvd, "truncated", trunc)
+	}
+}
+
+func TestPacketServerWorkers(t *testing.T) {
+	const workers = 4
+	started, release := make(chan bool, workers), make(chan bool)
+	ps := &packetServer{network: "udp", addr: "127.0.0.1:0", maxSize: 16, workers: workers}
+	ps.handle = func([]byte) {
+		started <- true
+		<-release
+	}
+	if err := ps.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer ps.stop()
+
+	conn, err := net.Dial("udp", ps.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < workers; i++ {
+		conn.Write([]byte("a:1|c\n"))
+	}
+
+	// Every worker handles a datagram at the same time
+	for i := 0; i < workers; i++ {
+		select {
+		case <-started:
+		case <-time.After(2 * time.Second):
+			t.Fatal(i, "workers busy, expected", workers)
+		}
+	}
+	close(release)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+const UnixMsgMaxSize = 8192
+
+type UnixInjector struct {
+	Path       string
+	StreamPath string
+	Server     *Server
+	ps         packetServer
+	ls         lineServer
+}
+
+func (ui *UnixInjector) Start() error {
+	if len(ui.Path) > 0 {
+		if err := removeStaleSocket("unixgram", ui.Path); err != nil {
+			return err
+		}
+		ui.ps.network, ui.ps.addr = "unixgram", ui.Path
+		ui.ps.maxSize, ui.ps.handle = UnixMsgMaxSize, ui.Server.InjectBytes
+		if err := ui.ps.start(); err != nil {
+			return err
+		}
+	}
+	if len(ui.StreamPath) > 0 {
+		ui.ls.network, ui.ls.addr = "unix", ui.StreamPath
+		ui.ls.maxLine, ui.ls.handle = UnixMsgMaxSize, ui.Server.InjectBytes
+		err := removeStaleSocket("unix", ui.StreamPath)
+		if err == nil {
+			err = ui.ls.start()
+		}
+		if err != nil {
+			if len(ui.Path) > 0 {
+				ui.ps.stop()
+				os.Remove(ui.Path)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop stops both listeners and returns the first error.
+func (ui *UnixInjector) Stop() error {
+	var err error
+	if len(ui.Path) > 0 {
+		if err = ui.ps.stop(); err == nil {
+			os.Remove(ui.Path)
+		}
+	}
+	if len(ui.StreamPath) > 0 {
+		if err2 := ui.ls.stop(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// removeStaleSocket removes a socket file left behind by a previous run,
+// binding to an existing path fails otherwise. A socket somebody still
+// listens on is left alone.
+func removeStaleSocket(network, path string) error {
+	if fi, err := os.Lstat(path); err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	conn, err := net.Dial(network, path)
+	if err == nil {
+		conn.Close()
+		return Error("Socket in use: " + path)
+	}
+	if oe, ok := err.(*net.OpError); ok {
+		if se, ok := oe.Err.(*os.SyscallError); ok && se.Err == syscall.ECONNREFUSED {
+			return os.Remove(path)
+		}
+	}
+	return nil
+}
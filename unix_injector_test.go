@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestUnixInjector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds := &MemDatastore{Interval: 1}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	srv := &Server{Ds: ds}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	// A socket left behind by a crash is replaced
+	path, streamPath := dir+"/statsd.sock", dir+"/statsd-stream.sock"
+	stale, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	ui := &UnixInjector{Path: path, StreamPath: streamPath, Server: srv}
+	if err := ui.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer ui.Stop()
+
+	// A socket in use is not
+	other := &UnixInjector{Path: path, Server: srv}
+	if err := other.Start(); err == nil {
+		other.Stop()
+		t.Fatal("Started on a socket in use")
+	}
+	other = &UnixInjector{StreamPath: streamPath, Server: srv}
+	if err := other.Start(); err == nil {
+		other.Stop()
+		t.Fatal("Started on a stream socket in use")
+	}
+
+	for network, p := range map[string]string{"unixgram": path, "unix": streamPath} {
+		conn, err := net.Dial(network, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("u:1|c\nu:2|c\n"))
+		conn.Close()
+	}
+
+	// The totals are updated every tick
+	for i := 0; i < 300; i++ {
+		cvs, err := srv.CurrentValues()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cvs) == 1 && cvs[0].Totals[0] == 6 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Metrics not injected")
+}
+
+func TestUnixInjectorStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The stream listener is stopped although stopping the other one fails
+	ui := &UnixInjector{Path: dir + "/statsd.sock", StreamPath: dir + "/statsd-stream.sock", Server: &Server{}}
+	if err := ui.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ui.ps.stop()
+	if err := ui.Stop(); err == nil {
+		t.Error("Stop succeeded")
+	}
+	if ui.ls.running {
+		t.Error("Stream listener still running")
+	}
+}
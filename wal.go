@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	fsDsWalSegment  = 16 << 20
+	fsDsWalInterval = time.Second
+	fsDsWalHeader   = 24
+	fsDsWalBuffer   = 64 << 10
+)
+
+const errWalDamaged = Error("Truncated or corrupt WAL record")
+
+// Operations other than inserts are flagged in the length of the name.
+const (
+	fsDsWalInsert = 0
+	fsDsWalDelete = 1 << 31
+	fsDsWalRename = 1 << 30
+	fsDsWalOps    = fsDsWalDelete | fsDsWalRename
+)
+
+// fsDsWal is the write-ahead log every inserted record goes through before
+// it is added to the tail of its stream. The log is split into numbered
+// segments; a segment is removed once every stream has flushed the records
+// it holds.
+//
+// Every record is a CRC-32 of the rest of the record, the length of the
+// name, the timestamp, the value and the name. Deleting a stream is logged
+// as a record without a value, renaming a series as a record whose name is
+// the old and the new names of its streams and sketches, separated by NUL
+// bytes.
+//
+// Records are buffered and written at least every fsDsWalInterval.
+type fsDsWal struct {
+	mu    sync.Mutex
+	dir   string
+	seq   int64
+	f     *os.File
+	w     *bufio.Writer
+	size  int64
+	dirty bool
+}
+
+func (w *fsDsWal) path(seq int64) string {
+	return w.dir + string(os.PathSeparator) + "wal." + strconv.FormatInt(seq, 10)
+}
+
+func (w *fsDsWal) segments() ([]int64, error) {
+	files, err := filepath.Glob(w.dir + string(os.PathSeparator) + "wal.*")
+	if err != nil {
+		return nil, err
+	}
+	var r []int64
+	for _, fn := range files {
+		fn = filepath.Base(fn)
+		seq, err := strconv.ParseInt(fn[strings.Index(fn, ".")+1:], 10, 64)
+		if err == nil && seq > 0 {
+			r = append(r, seq)
+		}
+	}
+	sort.Sort(int64Slice(r))
+	return r, nil
+}
+
+func (w *fsDsWal) open(seq int64) error {
+	f, err := os.OpenFile(w.path(seq), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	w.f, w.seq, w.size = f, seq, 0
+	if w.w == nil {
+		w.w = bufio.NewWriterSize(f, fsDsWalBuffer)
+	} else {
+		w.w.Reset(f)
+	}
+	return nil
+}
+
+// closeFile writes the buffer and closes the current segment.
+func (w *fsDsWal) closeFile() error {
+	err := w.w.Flush()
+	if err2 := w.f.Sync(); err == nil {
+		err = err2
+	}
+	if err2 := w.f.Close(); err == nil {
+		err = err2
+	}
+	w.f = nil
+	return err
+}
+
+func (w *fsDsWal) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	return w.closeFile()
+}
+
+// current returns the segment the next record will be written to, or a
+// segment before it.
+func (w *fsDsWal) current() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.seq
+}
+
+func (w *fsDsWal) append(name string, r Record) error {
+	return w.log(fsDsWalInsert, name, r)
+}
+
+func (w *fsDsWal) log(op uint32, name string, r Record) error {
+	buff := make([]byte, fsDsWalHeader+len(name))
+	le := binary.LittleEndian
+	le.PutUint32(buff[4:], op|uint32(len(name)))
+	le.PutUint64(buff[8:], uint64(r.Ts))
+	le.PutUint64(buff[16:], math.Float64bits(r.Value))
+	copy(buff[fsDsWalHeader:], name)
+	le.PutUint32(buff, crc32.ChecksumIEEE(buff[4:]))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return Error("Datastore not running")
+	}
+	if w.size+int64(len(buff)) > fsDsWalSegment && w.size > 0 {
+		if err := w.closeFile(); err != nil {
+			log.Println("fsDsWal.append:", err)
+		}
+		if err := w.open(w.seq + 1); err != nil {
+			return err
+		}
+	}
+	n, err := w.w.Write(buff)
+	w.size += int64(n)
+	w.dirty = true
+	return err
+}
+
+// flush writes the buffered records to the current segment, and syncs it
+// unless noSync is set.
+func (w *fsDsWal) flush(noSync bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.dirty || w.f == nil {
+		return nil
+	}
+	w.dirty = false
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	if noSync {
+		return nil
+	}
+	return w.f.Sync()
+}
+
+// remove deletes the segments before seq.
+func (w *fsDsWal) remove(seq int64) error {
+	segs, err := w.segments()
+	if err != nil {
+		return err
+	}
+	for _, s := range segs {
+		if s >= seq {
+			break
+		}
+		if err := os.Remove(w.path(s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read calls fn for every record of the segment and returns the size of
+// the records read. A truncated or corrupt record, left by a crash while
+// writing, ends the segment with errWalDamaged.
+func (w *fsDsWal) read(seq int64, fn func(op uint32, name string, r fsDsRecord)) (int64, error) {
+	f, err := os.Open(w.path(seq))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	rd, le := bufio.NewReader(f), binary.LittleEndian
+
+	var size int64
+	header := make([]byte, fsDsWalHeader)
+	for {
+		if _, err := io.ReadFull(rd, header); err == io.EOF {
+			return size, nil
+		} else if err != nil {
+			return size, errWalDamaged
+		}
+		op := le.Uint32(header[4:]) & fsDsWalOps
+		name := make([]byte, le.Uint32(header[4:])&^fsDsWalOps)
+		if len(name) > fsDsWalSegment {
+			return size, errWalDamaged
+		}
+		if _, err := io.ReadFull(rd, name); err != nil {
+			return size, errWalDamaged
+		}
+		crc := crc32.Update(crc32.ChecksumIEEE(header[4:]), crc32.IEEETable, name)
+		if crc != le.Uint32(header) {
+			return size, errWalDamaged
+		}
+		fn(op, string(name), fsDsRecord{
+			Ts:    int64(le.Uint64(header[8:])),
+			Value: math.Float64frombits(le.Uint64(header[16:])),
+		})
+		size += int64(len(header) + len(name))
+	}
+}
+
+// replayWal adds the records of the WAL which are not yet in the files to
+// the tails of their streams and starts a new segment.
+func (ds *FsDatastore) replayWal() error {
+	ds.wal = fsDsWal{dir: ds.Dir}
+	segs, err := ds.wal.segments()
+	if err != nil {
+		return err
+	}
+
+	// The last deletion or renaming of a stream may have been cut short by
+	// a crash, and is done again
+	var pending []fsDsWalOp
+	touch := func(names ...string) {
+		for i := 0; i < len(pending); i++ {
+			for _, name := range names {
+				if pending[i].from == name || pending[i].to == name {
+					pending = append(pending[:i], pending[i+1:]...)
+					i--
+					break
+				}
+			}
+		}
+	}
+
+	tails, first := make(map[string][]fsDsRecord), make(map[string]int64)
+	for _, seq := range segs {
+		_, err := ds.wal.read(seq, func(op uint32, name string, r fsDsRecord) {
+			switch op {
+			case fsDsWalDelete:
+				touch(name)
+				pending = append(pending, fsDsWalOp{op, name, ""})
+				delete(tails, name)
+				delete(first, name)
+				return
+			case fsDsWalRename:
+				names := strings.Split(name, "\x00")
+				if len(names)%2 != 0 {
+					return
+				}
+				for i := 0; i < len(names); i += 2 {
+					from, to := names[i], names[i+1]
+					touch(from, to)
+					pending = append(pending, fsDsWalOp{op, from, to})
+					if tail, ok := tails[from]; ok {
+						if f, ok := first[to]; !ok || first[from] < f {
+							first[to] = first[from]
+						}
+						tails[to] = append(tails[to], tail...)
+						delete(tails, from)
+						delete(first, from)
+					}
+				}
+				return
+			}
+			touch(name)
+			if _, ok := first[name]; !ok {
+				first[name] = seq
+			}
+			tails[name] = append(tails[name], r)
+		})
+		if err == errWalDamaged {
+			log.Println("WAL segment", seq, "ends with a damaged record")
+		} else if err != nil {
+			return err
+		}
+	}
+	for _, op := range pending {
+		if err := ds.redo(op); err != nil {
+			return err
+		}
+	}
+
+	for name, tail := range tails {
+		st, ok := ds.streams[name]
+		if !ok {
+			ds.createStream(name, nil)
+			st = ds.streams[name]
+		}
+		if err := st.openFiles(false); err != nil {
+			log.Println("FsDatastore.replayWal:", err)
+		} else {
+			if tail, err = st.unflushed(tail); err != nil {
+				log.Println("FsDatastore.replayWal:", err)
+			}
+			st.closeFiles()
+		}
+		if len(tail) > 0 {
+			if len(st.tail) == 0 {
+				atomic.StoreInt64(&st.walSeq, first[name])
+			}
+			st.tail = append(st.tail, tail...)
+		}
+	}
+	if len(tails) > 0 {
+		log.Println("Replayed the WAL of", len(tails), "series")
+	}
+
+	seq := int64(1)
+	if len(segs) > 0 {
+		seq = segs[len(segs)-1] + 1
+	}
+	return ds.wal.open(seq)
+}
+
+type fsDsWalOp struct {
+	op       uint32
+	from, to string
+}
+
+// redo removes or renames the files left behind by a deletion or renaming
+// interrupted by a crash.
+func (ds *FsDatastore) redo(op fsDsWalOp) error {
+	if op.op == fsDsWalRename {
+		err := os.Rename(ds.sketchPath(op.from), ds.sketchPath(op.to))
+		if err == nil {
+			log.Println("Completed the renaming of", op.from, "to", op.to)
+			return nil
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	path, done := ds.Dir+string(os.PathSeparator), false
+	for _, ext := range fsDsExts {
+		var err error
+		if op.op == fsDsWalDelete {
+			err = os.Remove(path + op.from + ext)
+		} else {
+			err = os.Rename(path+op.from+ext, path+op.to+ext)
+		}
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		done = true
+	}
+	if !done {
+		return nil
+	}
+
+	delete(ds.names, op.from)
+	if op.op == fsDsWalDelete {
+		log.Println("Completed the deletion of", op.from)
+	} else {
+		if !isTierName(op.to) {
+			ds.names[op.to] = 1
+		}
+		log.Println("Completed the renaming of", op.from, "to", op.to)
+	}
+	return nil
+}
+
+// unflushed drops the records of recs already in the files. Of several
+// records with the same timestamp, only the last one counts.
+func (st *fsDsStream) unflushed(recs []fsDsRecord) ([]fsDsRecord, error) {
+	last, from := make(map[int64]int), st.lastWr
+	for i, r := range recs {
+		last[r.Ts] = i
+		if r.Ts < from {
+			from = r.Ts
+		}
+	}
+	stored, err := st.view().query(from, st.lastWr)
+	if err != nil {
+		return recs, err
+	}
+	values := make(map[int64]uint64, len(stored))
+	for _, r := range stored {
+		values[r.Ts] = math.Float64bits(r.Value)
+	}
+
+	var r []fsDsRecord
+	for i, rec := range recs {
+		if rec.Ts > st.lastWr {
+			r = append(r, rec)
+		} else if v, ok := values[rec.Ts]; last[rec.Ts] == i && (!ok || v != math.Float64bits(rec.Value)) {
+			r = append(r, rec)
+		}
+	}
+	return r, nil
+}
+
+// maintainWal writes and syncs the WAL and removes the segments whose records have
+// been flushed by every stream.
+func (ds *FsDatastore) maintainWal() {
+	defer ds.rwg.Done()
+	for {
+		select {
+		case <-ds.wquit:
+			return
+		case <-time.After(fsDsWalInterval):
+		}
+
+		if err := ds.wal.flush(ds.NoSync); err != nil {
+			log.Println("fsDsWal.flush:", err)
+		}
+
+		min := ds.wal.current()
+		ds.mu.Lock()
+		for _, st := range ds.streams {
+			if seq := atomic.LoadInt64(&st.walSeq); seq != 0 && seq < min {
+				min = seq
+			}
+		}
+		ds.mu.Unlock()
+		if err := ds.wal.remove(min); err != nil {
+			log.Println("fsDsWal.remove:", err)
+		}
+	}
+}
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
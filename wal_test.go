@@ -0,0 +1,253 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestWalReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A crash left two segments, the last record of the second one torn
+	w := &fsDsWal{dir: dir}
+	for seq := int64(1); seq <= 2; seq++ {
+		if err := w.open(seq); err != nil {
+			t.Fatal(err)
+		}
+		for ts := seq * 60; ts <= seq*60+60; ts += 60 {
+			w.append("a:gauge", Record{Ts: ts, Value: float64(seq)})
+			w.append("b:gauge", Record{Ts: ts, Value: float64(seq)})
+		}
+		if seq == 1 {
+			w.log(fsDsWalDelete, "b:gauge", Record{})
+			w.log(fsDsWalRename, "a:gauge\x00c:gauge", Record{})
+		}
+		if err := w.close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fi, err := os.Stat(w.path(2)); err != nil || os.Truncate(w.path(2), fi.Size()-3) != nil {
+		t.Fatal("Truncating the segment failed")
+	}
+
+	ds := &FsDatastore{Dir: dir, NoSync: true}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	var testCases = []struct {
+		name string
+		recs []Record
+	}{
+		{"a:gauge", []Record{{120, 2}, {180, 2}}},
+		{"b:gauge", []Record{{120, 2}}},
+		{"c:gauge", []Record{{60, 1}, {120, 1}}},
+	}
+	for _, tc := range testCases {
+		recs, err := ds.Query(tc.name, 0, 600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(recs, tc.recs) {
+			t.Error(tc.name, "replayed", recs)
+		}
+	}
+
+	// The replayed records are flushed and not replayed again
+	waitFlushed(t, ds)
+	ds.Close()
+	ds = &FsDatastore{Dir: dir, NoSync: true}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ds.mu.Lock()
+	for _, st := range ds.queue {
+		st.Lock()
+		if len(st.tail) != 0 {
+			t.Error("Replayed", st.name, "again:", st.tail)
+		}
+		st.Unlock()
+	}
+	ds.mu.Unlock()
+	if recs, _ := ds.Query("c:gauge", 0, 600); len(recs) != 2 {
+		t.Error("Flushed", recs)
+	}
+}
+
+func TestWalRemove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := &fsDsWal{dir: dir}
+	for seq := int64(1); seq <= 3; seq++ {
+		if err := w.open(seq); err != nil {
+			t.Fatal(err)
+		}
+		w.append("a:gauge", Record{Ts: seq * 60, Value: 1})
+		if err := w.close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.remove(3); err != nil {
+		t.Fatal(err)
+	}
+	if segs, _ := w.segments(); !reflect.DeepEqual(segs, []int64{3}) {
+		t.Error("Segments left:", segs)
+	}
+
+	// Buffered records are written by flush
+	if err := w.open(4); err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+	w.append("a:gauge", Record{Ts: 240, Value: 1})
+	if err := w.flush(true); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	if _, err := w.read(4, func(uint32, string, fsDsRecord) { n++ }); err != nil || n != 1 {
+		t.Error("Read", n, "records after flush:", err)
+	}
+}
+
+func TestWalReplayRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A crash cut short the renaming of a and f and the deletion of c,
+	// while d was renamed and written again
+	ds := &FsDatastore{Dir: dir, NoSync: true, res: 60}
+	if err := writeSketchFile(ds.sketchPath("f:timer-digest"), 1, []Sketch{{60, []byte{1}}}, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a:gauge", "c:gauge", "d:gauge", "f:timer-min"} {
+		st := &fsDsStream{ds: ds, name: name, res: 60}
+		if err := st.rewrite(testRecords(1, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := &fsDsWal{dir: dir}
+	if err := w.open(1); err != nil {
+		t.Fatal(err)
+	}
+	w.append("a:gauge", Record{Ts: 660, Value: 1})
+	w.log(fsDsWalRename, "d:gauge\x00e:gauge", Record{})
+	w.append("d:gauge", Record{Ts: 60, Value: 1})
+	w.log(fsDsWalRename, "a:gauge\x00b:gauge", Record{})
+	w.log(fsDsWalDelete, "c:gauge", Record{})
+	w.log(fsDsWalRename, "f:timer-min\x00g:timer-min\x00f:timer-digest\x00g:timer-digest", Record{})
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ds = &FsDatastore{Dir: dir, NoSync: true}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	names, _ := ds.ListNames("*")
+	if sort.Strings(names); !reflect.DeepEqual(names, []string{"b:gauge", "d:gauge", "g:timer-min"}) {
+		t.Error("ListNames returned", names)
+	}
+	if sk, err := ds.QuerySketches("g:timer-digest", 0, 60, 60); err != nil || len(sk) != 1 {
+		t.Error("Sketches renamed:", sk, err)
+	}
+
+	var testCases = []struct {
+		name string
+		n    int
+	}{
+		{"a:gauge", 0},
+		{"b:gauge", 11},
+		{"c:gauge", 0},
+		{"d:gauge", 10},
+		{"e:gauge", 0},
+	}
+	for _, tc := range testCases {
+		if recs, err := ds.Query(tc.name, 0, 6000); err != nil || len(recs) != tc.n {
+			t.Error(tc.name, "has", len(recs), "records:", err)
+		}
+	}
+}
+
+func TestWalCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(dir+"/ds", 0777); err != nil {
+		t.Fatal(err)
+	}
+	ds := &FsDatastore{Dir: dir + "/ds", Interval: 1}
+	if err := ds.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	srv := &Server{Ds: ds}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	// The interval is durable once flushed, a crash right after loses nothing
+	if err := srv.Inject(&Metric{Name: "a", Type: Counter, Value: 1, SampleRate: 1}); err != nil {
+		t.Fatal(err)
+	}
+	srv.mu.Lock()
+	ts := srv.lastTick + 1
+	srv.mu.Unlock()
+	srv.handleTick(ts)
+	if err := copyDir(dir+"/ds", dir+"/crash"); err != nil {
+		t.Fatal(err)
+	}
+
+	crashed := &FsDatastore{Dir: dir + "/crash", Interval: 1, NoSync: true}
+	if err := crashed.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer crashed.Close()
+	recs, err := crashed.Query("a:counter", ts-10, ts)
+	sum := 0.0
+	for _, r := range recs {
+		sum += r.Value
+	}
+	if err != nil || sum != 1 {
+		t.Error("Replayed", recs, err)
+	}
+}
+
+func copyDir(src, dst string) error {
+	if err := os.Mkdir(dst, 0777); err != nil {
+		return err
+	}
+	files, err := filepath.Glob(src + "/*")
+	if err != nil {
+		return err
+	}
+	for _, fn := range files {
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(dst+"/"+filepath.Base(fn), data, 0666); err != nil {
+			return err
+		}
+	}
+	return nil
+}